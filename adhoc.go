@@ -0,0 +1,435 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// XEP-0050 Ad-Hoc Commands
+
+const nsCommands = "http://jabber.org/protocol/commands"
+
+// command actions
+const (
+	CommandExecute  = "execute"
+	CommandCancel   = "cancel"
+	CommandPrev     = "prev"
+	CommandNext     = "next"
+	CommandComplete = "complete"
+)
+
+// command status
+const (
+	CommandExecuting = "executing"
+	CommandCompleted = "completed"
+	CommandCanceled  = "canceled"
+)
+
+// sessions idle for longer are dropped
+const commandSessionTimeout = 10 * time.Minute
+
+type Command struct {
+	XMLName   xml.Name        `xml:"http://jabber.org/protocol/commands command"`
+	Node      string          `xml:"node,attr"`
+	SessionId string          `xml:"sessionid,attr,omitempty"`
+	Action    string          `xml:"action,attr,omitempty"`
+	Status    string          `xml:"status,attr,omitempty"`
+	Actions   *CommandActions `xml:"actions,omitempty"`
+	Notes     []CommandNote   `xml:"http://jabber.org/protocol/commands note"`
+	Form      *DataForm
+}
+
+type CommandActions struct {
+	Execute  string    `xml:"execute,attr,omitempty"`
+	Prev     *struct{} `xml:"prev"`
+	Next     *struct{} `xml:"next"`
+	Complete *struct{} `xml:"complete"`
+}
+
+type CommandNote struct {
+	Type string `xml:"type,attr,omitempty"` // info, warn, error
+	Text string `xml:",chardata"`
+}
+
+func (self *CommandActions) allows(action string) bool {
+	switch action {
+	case CommandPrev:
+		return self.Prev != nil
+	case CommandNext:
+		return self.Next != nil
+	case CommandComplete:
+		return self.Complete != nil
+	}
+	return false
+}
+
+// CommandResponse is the answer of a stage of a command. A response without
+// actions completes the command, else the requester may take the actions,
+// which must include next or complete, prev is handled by the framework.
+type CommandResponse struct {
+	Form    *DataForm
+	Notes   []CommandNote
+	Actions []string
+}
+
+// CommandSession is an execution of a command by From. Stage counts the
+// submitted stages, Data keeps the state of the command between stages.
+type CommandSession struct {
+	Id     string
+	Node   string
+	From   string
+	Action string
+	Stage  int
+	Data   map[string]interface{}
+
+	mutex     sync.Mutex
+	responses []*Command
+	touched   time.Time // guarded by the mutex of commandState
+}
+
+// CommandFunc runs a stage of a command, form is the form submitted by the
+// requester and nil when the command starts. Returning an *Error answers with
+// that error, other errors with bad-request.
+type CommandFunc func(session *CommandSession, form *DataForm) (*CommandResponse, error)
+
+// AdHocCommand is a command we offer. Allow lists the jids, bare jids or
+// domains allowed to execute it, only our own account if empty.
+type AdHocCommand struct {
+	Node    string
+	Name    string
+	Allow   []string
+	Execute CommandFunc
+}
+
+func (self *AdHocCommand) allowed(jid, ourJid string) bool {
+	if len(self.Allow) == 0 {
+		return strings.EqualFold(ToBareJID(jid), ToBareJID(ourJid))
+	}
+	bare := ToBareJID(jid)
+	domain := bare[strings.Index(bare, "@")+1:]
+	for _, allowed := range self.Allow {
+		if strings.EqualFold(allowed, jid) || strings.EqualFold(allowed, bare) || strings.EqualFold(allowed, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+type commandState struct {
+	mutex    sync.Mutex
+	commands map[string]*AdHocCommand
+	sessions map[string]*CommandSession
+}
+
+func (self *commandState) init() {
+	self.commands = make(map[string]*AdHocCommand)
+	self.sessions = make(map[string]*CommandSession)
+}
+
+// commandsNode answers the disco queries about the command list and the commands.
+type commandsNode struct {
+	client *XmppClient
+}
+
+func (self commandsNode) DiscoInfo(from, node string) *DiscoInfoQuery {
+	if node == nsCommands {
+		return &DiscoInfoQuery{
+			Identities: []DiscoIdentity{{Category: "automation", Type: "command-list"}},
+			Features:   []DiscoFeature{{nsCommands}},
+		}
+	}
+	cmd := self.client.command(from, node)
+	if cmd == nil {
+		return nil
+	}
+	return &DiscoInfoQuery{
+		Identities: []DiscoIdentity{{Category: "automation", Type: "command-node", Name: cmd.Name}},
+		Features:   []DiscoFeature{{nsCommands}, {nsDataForm}},
+	}
+}
+
+func (self commandsNode) DiscoItems(from, node string) []DiscoItem {
+	if node != nsCommands {
+		return []DiscoItem{}
+	}
+	c := &self.client.commands
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	items := []DiscoItem{}
+	for _, cmd := range c.commands {
+		if cmd.allowed(from, self.client.jid) {
+			items = append(items, DiscoItem{Jid: self.client.client.jid, Node: cmd.Node, Name: cmd.Name})
+		}
+	}
+	return items
+}
+
+// AddCommand offers cmd to the jids allowed by its ACL, it is listed in the
+// command node of disco#items.
+func (self *XmppClient) AddCommand(cmd *AdHocCommand) error {
+	if cmd.Node == "" || cmd.Execute == nil {
+		return errors.New("Command needs a node and an execute function")
+	}
+	self.commands.mutex.Lock()
+	self.commands.commands[cmd.Node] = cmd
+	self.commands.mutex.Unlock()
+	self.SetDiscoNode(nsCommands, commandsNode{self})
+	self.SetDiscoNode(cmd.Node, commandsNode{self})
+	self.AddFeature(nsCommands)
+	return nil
+}
+
+func (self *XmppClient) RemoveCommand(node string) {
+	self.commands.mutex.Lock()
+	delete(self.commands.commands, node)
+	self.commands.mutex.Unlock()
+	self.SetDiscoNode(node, nil)
+}
+
+// command returns the command node if from may execute it.
+func (self *XmppClient) command(from, node string) *AdHocCommand {
+	self.commands.mutex.Lock()
+	defer self.commands.mutex.Unlock()
+	cmd := self.commands.commands[node]
+	if cmd == nil || !cmd.allowed(from, self.jid) {
+		return nil
+	}
+	return cmd
+}
+
+// session returns the session of the request after dropping the expired sessions.
+func (self *commandState) session(id, from, node string) *CommandSession {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	now := time.Now()
+	for sid, s := range self.sessions {
+		if now.Sub(s.touched) > commandSessionTimeout {
+			delete(self.sessions, sid)
+		}
+	}
+	s := self.sessions[id]
+	if s == nil || s.From != from || s.Node != node {
+		return nil
+	}
+	s.touched = now
+	return s
+}
+
+func (self *XmppClient) processCommands(event *Event) bool {
+	iq, ok := event.Stanza.(*IQ)
+	if !ok || iq.Type != "set" || iq.Command == nil {
+		return true
+	}
+	go self.executeCommand(iq)
+	return false
+}
+
+func (self *XmppClient) executeCommand(iq *IQ) {
+	req := iq.Command
+	cmd := self.command(iq.From, req.Node)
+	if cmd == nil {
+		self.commands.mutex.Lock()
+		_, exists := self.commands.commands[req.Node]
+		self.commands.mutex.Unlock()
+		if exists {
+			self.replyIQError(iq, "auth", "forbidden")
+		} else {
+			self.replyIQError(iq, "cancel", "item-not-found")
+		}
+		return
+	}
+
+	var session *CommandSession
+	if req.SessionId == "" {
+		if req.Action != "" && req.Action != CommandExecute {
+			self.replyIQError(iq, "modify", "bad-request")
+			return
+		}
+		session = &CommandSession{
+			Id:      RandomString(10),
+			Node:    req.Node,
+			From:    iq.From,
+			Data:    make(map[string]interface{}),
+			touched: time.Now(),
+		}
+		self.commands.mutex.Lock()
+		self.commands.sessions[session.Id] = session
+		self.commands.mutex.Unlock()
+	} else if session = self.commands.session(req.SessionId, iq.From, req.Node); session == nil {
+		self.replyIQError(iq, "modify", "bad-request")
+		return
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	action := req.Action
+	if action == "" {
+		action = CommandExecute
+	}
+	var last *Command
+	if len(session.responses) > 0 {
+		last = session.responses[len(session.responses)-1]
+		if action == CommandExecute {
+			action = last.Actions.Execute
+		}
+	}
+
+	switch {
+	case action == CommandCancel:
+		self.endCommandSession(session)
+		self.Send(&IQ{Id: iq.Id, To: iq.From, Type: "result",
+			Command: &Command{Node: req.Node, SessionId: session.Id, Status: CommandCanceled}})
+		return
+	case last != nil && !last.Actions.allows(action):
+		self.replyIQError(iq, "modify", "bad-request")
+		return
+	case action == CommandPrev:
+		session.responses = session.responses[:len(session.responses)-1]
+		self.Send(&IQ{Id: iq.Id, To: iq.From, Type: "result", Command: session.responses[len(session.responses)-1]})
+		return
+	}
+
+	session.Action = action
+	session.Stage = len(session.responses)
+	var form *DataForm
+	if last != nil {
+		form = req.Form
+	}
+	resp, err := cmd.Execute(session, form)
+	if err != nil {
+		if len(session.responses) == 0 {
+			self.endCommandSession(session)
+		}
+		xmppErr, ok := err.(*Error)
+		if !ok {
+			xmppErr = &Error{Type: "modify", Any: xml.Name{Space: nsStanzas, Local: "bad-request"}, Text: err.Error()}
+		}
+		self.Send(&IQ{Id: iq.Id, To: iq.From, Type: "error", Error: xmppErr})
+		return
+	}
+	if resp == nil {
+		resp = &CommandResponse{}
+	}
+	result := &Command{Node: req.Node, SessionId: session.Id, Status: CommandCompleted, Notes: resp.Notes, Form: resp.Form}
+	if len(resp.Actions) == 0 {
+		self.endCommandSession(session)
+	} else {
+		result.Status = CommandExecuting
+		result.Actions = &CommandActions{}
+		for _, a := range resp.Actions {
+			switch a {
+			case CommandNext:
+				result.Actions.Next = &struct{}{}
+			case CommandComplete:
+				result.Actions.Complete = &struct{}{}
+			}
+		}
+		if result.Actions.Next == nil && result.Actions.Complete == nil {
+			// the command can't go on
+			if len(session.responses) == 0 {
+				self.endCommandSession(session)
+			}
+			self.replyIQError(iq, "cancel", "internal-server-error")
+			return
+		}
+		if len(session.responses) > 0 {
+			result.Actions.Prev = &struct{}{}
+		}
+		if result.Actions.Next != nil {
+			result.Actions.Execute = CommandNext
+		} else {
+			result.Actions.Execute = CommandComplete
+		}
+		session.responses = append(session.responses, result)
+	}
+	self.Send(&IQ{Id: iq.Id, To: iq.From, Type: "result", Command: result})
+}
+
+func (self *XmppClient) endCommandSession(session *CommandSession) {
+	self.commands.mutex.Lock()
+	delete(self.commands.sessions, session.Id)
+	self.commands.mutex.Unlock()
+}
+
+// CommandExecution is our execution of a command of another entity.
+type CommandExecution struct {
+	Jid      string
+	Response *Command
+	client   *XmppClient
+}
+
+// ListCommands returns the commands jid offers to us.
+func (self *XmppClient) ListCommands(jid string) ([]DiscoItem, error) {
+	items, err := self.DiscoItems(jid, nsCommands)
+	if err != nil {
+		return nil, err
+	}
+	return items.Items, nil
+}
+
+// ExecuteCommand starts the command node of jid, the response holds the
+// form of the first stage or the result of a single stage command.
+func (self *XmppClient) ExecuteCommand(jid, node string) (*CommandExecution, error) {
+	execution := &CommandExecution{Jid: jid, client: self}
+	if err := execution.send(&Command{Node: node, Action: CommandExecute}); err != nil {
+		return nil, err
+	}
+	return execution, nil
+}
+
+func (self *CommandExecution) send(cmd *Command) error {
+	resp, err := self.client.sendIQ(&IQ{To: self.Jid, Type: "set", Command: cmd})
+	if err != nil {
+		return err
+	}
+	if resp.Command == nil {
+		return errors.New("No command in response of " + self.Jid)
+	}
+	self.Response = resp.Command
+	return nil
+}
+
+func (self *CommandExecution) action(action string, form *DataForm) error {
+	if self.Completed() {
+		return errors.New("Command is not executing")
+	}
+	cmd := &Command{Node: self.Response.Node, SessionId: self.Response.SessionId, Action: action}
+	if form != nil {
+		cmd.Form = form.Submit()
+	}
+	return self.send(cmd)
+}
+
+// Completed reports whether the command is no longer executing.
+func (self *CommandExecution) Completed() bool {
+	return self.Response.Status != CommandExecuting
+}
+
+// Form returns the form of the current stage, or the result of a completed command.
+func (self *CommandExecution) Form() *DataForm {
+	return self.Response.Form
+}
+
+func (self *CommandExecution) Notes() []CommandNote {
+	return self.Response.Notes
+}
+
+// Next submits form, usually the filled Form of the current stage.
+func (self *CommandExecution) Next(form *DataForm) error {
+	return self.action(CommandNext, form)
+}
+
+func (self *CommandExecution) Prev() error {
+	return self.action(CommandPrev, nil)
+}
+
+func (self *CommandExecution) Complete(form *DataForm) error {
+	return self.action(CommandComplete, form)
+}
+
+func (self *CommandExecution) Cancel() error {
+	return self.action(CommandCancel, nil)
+}
@@ -0,0 +1,136 @@
+package xmpp
+
+import (
+	"errors"
+	"testing"
+)
+
+// greetCommand asks the name in the first stage and the greeting in the second.
+func greetCommand(session *CommandSession, form *DataForm) (*CommandResponse, error) {
+	switch session.Stage {
+	case 0:
+		form := NewDataForm(FormTypeForm, "")
+		form.AddField("name", FieldTextSingle, "Name").SetRequired(true)
+		return &CommandResponse{Form: form, Actions: []string{CommandNext}}, nil
+	case 1:
+		if form.Value("name") == "" {
+			return nil, errors.New("Name is required")
+		}
+		session.Data["name"] = form.Value("name")
+		form := NewDataForm(FormTypeForm, "")
+		form.AddField("greeting", FieldListSingle, "Greeting").AddOption("Hello", "Hello").AddOption("Hi", "Hi")
+		return &CommandResponse{Form: form, Actions: []string{CommandComplete}}, nil
+	}
+	result := NewDataForm(FormTypeResult, "")
+	result.AddField("message", "", "", form.Value("greeting")+" "+session.Data["name"].(string))
+	return &CommandResponse{Form: result, Notes: []CommandNote{{Type: "info", Text: "done"}}}, nil
+}
+
+func TestAdHocCommands(t *testing.T) {
+	server := newTestServer("example.com")
+	alice := server.connect("alice@example.com/bot")
+	bob := server.connect("bob@example.com/b")
+	mallory := server.connect("mallory@example.org/m")
+	alice.AddCommand(&AdHocCommand{Node: "greet", Name: "Greet", Allow: []string{"bob@example.com"}, Execute: greetCommand})
+	alice.AddCommand(&AdHocCommand{Node: "uptime", Name: "Uptime", Allow: []string{"example.com", "example.org"},
+		Execute: func(session *CommandSession, form *DataForm) (*CommandResponse, error) {
+			return &CommandResponse{Notes: []CommandNote{{Type: "info", Text: "up"}}}, nil
+		}})
+
+	items, err := bob.ListCommands("alice@example.com/bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatal("expected two commands for bob", items)
+	}
+	items, err = mallory.ListCommands("alice@example.com/bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Node != "uptime" || items[0].Jid != "alice@example.com/bot" {
+		t.Fatal("expected only the uptime command for mallory", items)
+	}
+	if _, err := mallory.ExecuteCommand("alice@example.com/bot", "greet"); err == nil || err.(*Error).Condition() != "forbidden" {
+		t.Fatal("expected forbidden, got", err)
+	}
+
+	uptime, err := mallory.ExecuteCommand("alice@example.com/bot", "uptime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !uptime.Completed() || len(uptime.Notes()) != 1 || uptime.Notes()[0].Text != "up" {
+		t.Fatal("unexpected response", uptime.Response)
+	}
+
+	greet, err := bob.ExecuteCommand("alice@example.com/bot", "greet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if greet.Completed() || greet.Form().Field("name") == nil {
+		t.Fatal("expected the name form", greet.Response)
+	}
+	if err := greet.Complete(greet.Form()); err == nil {
+		t.Fatal("complete is not allowed in the first stage")
+	}
+	if err := greet.Next(greet.Form()); err == nil {
+		t.Fatal("expected error for missing name")
+	}
+	greet.Form().Set("name", "Carol")
+	if err := greet.Next(greet.Form()); err != nil {
+		t.Fatal(err)
+	}
+	if greet.Form().Field("greeting") == nil || greet.Response.Actions.Prev == nil {
+		t.Fatal("expected the greeting form with prev", greet.Response)
+	}
+	if err := greet.Prev(); err != nil {
+		t.Fatal(err)
+	}
+	if greet.Form().Field("name") == nil {
+		t.Fatal("expected the name form again", greet.Response)
+	}
+	greet.Form().Set("name", "Dave")
+	if err := greet.Next(greet.Form()); err != nil {
+		t.Fatal(err)
+	}
+	greet.Form().Set("greeting", "Hi")
+	if err := greet.Complete(greet.Form()); err != nil {
+		t.Fatal(err)
+	}
+	if !greet.Completed() || greet.Form().Value("message") != "Hi Dave" {
+		t.Fatal("unexpected result", greet.Response)
+	}
+	if err := greet.Next(nil); err == nil {
+		t.Fatal("expected error after completion")
+	}
+
+	canceled, err := bob.ExecuteCommand("alice@example.com/bot", "greet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := canceled.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if canceled.Response.Status != CommandCanceled {
+		t.Fatal("expected canceled status", canceled.Response)
+	}
+	if err := (&CommandExecution{Jid: canceled.Jid, Response: &Command{Node: "greet", SessionId: canceled.Response.SessionId,
+		Status: CommandExecuting}, client: bob}).Next(nil); err == nil {
+		t.Fatal("expected error for a canceled session")
+	}
+
+	// a stage without next or complete can't go on
+	alice.AddCommand(&AdHocCommand{Node: "stuck", Name: "Stuck",
+		Execute: func(session *CommandSession, form *DataForm) (*CommandResponse, error) {
+			return &CommandResponse{Actions: []string{CommandPrev, "jump"}}, nil
+		}})
+	if _, err := alice.ExecuteCommand("alice@example.com/bot", "stuck"); err == nil || err.(*Error).Condition() != "internal-server-error" {
+		t.Fatal("expected internal-server-error, got", err)
+	}
+	alice.commands.mutex.Lock()
+	sessions := len(alice.commands.sessions)
+	alice.commands.mutex.Unlock()
+	if sessions != 0 {
+		t.Fatalf("%d command sessions left", sessions)
+	}
+}
@@ -0,0 +1,257 @@
+package xmpp
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// XEP-0084 User Avatar
+
+const NodeAvatarData = "urn:xmpp:avatar:data"
+
+type AvatarData struct {
+	XMLName xml.Name `xml:"urn:xmpp:avatar:data data"`
+	Data    string   `xml:",chardata"` // base64
+}
+
+// AvatarMetadata lists the versions of an avatar, none if it's disabled.
+type AvatarMetadata struct {
+	XMLName xml.Name     `xml:"urn:xmpp:avatar:metadata metadata"`
+	Info    []AvatarInfo `xml:"info"`
+}
+
+type AvatarInfo struct {
+	Bytes  int    `xml:"bytes,attr"`
+	Id     string `xml:"id,attr"` // hex SHA-1 of the image
+	Type   string `xml:"type,attr"`
+	Width  int    `xml:"width,attr,omitempty"`
+	Height int    `xml:"height,attr,omitempty"`
+	Url    string `xml:"url,attr,omitempty"` // the image isn't in the data node if set
+}
+
+// AvatarUpdate is the Stanza of the Avatar events, Info and Data are nil if the
+// contact disabled its avatar. Data is nil if the image is only available at Info.Url.
+type AvatarUpdate struct {
+	Jid  string
+	Info *AvatarInfo
+	Data []byte
+}
+
+// AvatarCache stores the avatar images by id.
+type AvatarCache interface {
+	Get(id string) ([]byte, bool)
+	Put(id string, data []byte)
+}
+
+type memoryAvatarCache struct {
+	mutex  sync.Mutex
+	images map[string][]byte
+}
+
+// NewMemoryAvatarCache returns the cache used by default, keeping the images in memory.
+func NewMemoryAvatarCache() AvatarCache {
+	return &memoryAvatarCache{images: make(map[string][]byte)}
+}
+
+func (self *memoryAvatarCache) Get(id string) ([]byte, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	data, ok := self.images[id]
+	return data, ok
+}
+
+func (self *memoryAvatarCache) Put(id string, data []byte) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.images[id] = data
+}
+
+// AvatarId returns the id of the image data.
+func AvatarId(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type avatarState struct {
+	mutex     sync.Mutex
+	cache     AvatarCache
+	autoFetch bool
+}
+
+func (self *avatarState) init() {
+	self.cache = NewMemoryAvatarCache()
+}
+
+func (self *avatarState) getCache() AvatarCache {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.cache
+}
+
+func (self *XmppClient) SetAvatarCache(cache AvatarCache) {
+	self.avatar.mutex.Lock()
+	defer self.avatar.mutex.Unlock()
+	self.avatar.cache = cache
+}
+
+// EnableAvatars registers our interest in the avatars of our contacts, their
+// images are fetched when they change and delivered to the avatar handlers.
+func (self *XmppClient) EnableAvatars() {
+	self.avatar.mutex.Lock()
+	self.avatar.autoFetch = true
+	self.avatar.mutex.Unlock()
+	self.AddPEPInterest(NodeAvatarMetadata)
+}
+
+// PublishAvatar publishes the image data of type mimeType, e.g. "image/png",
+// then its metadata. It returns the id of the avatar.
+func (self *XmppClient) PublishAvatar(data []byte, mimeType string, width, height int) (string, error) {
+	id := AvatarId(data)
+	payload, err := xml.Marshal(&AvatarData{Data: base64.StdEncoding.EncodeToString(data)})
+	if err != nil {
+		return "", err
+	}
+	if _, err := self.PublishPEP(NodeAvatarData, id, payload, nil); err != nil {
+		return "", err
+	}
+	self.avatar.getCache().Put(id, data)
+	info := AvatarInfo{Bytes: len(data), Id: id, Type: mimeType, Width: width, Height: height}
+	payload, err = xml.Marshal(&AvatarMetadata{Info: []AvatarInfo{info}})
+	if err != nil {
+		return "", err
+	}
+	_, err = self.PublishPEP(NodeAvatarMetadata, id, payload, nil)
+	return id, err
+}
+
+// DisableAvatar tells our contacts we have no avatar.
+func (self *XmppClient) DisableAvatar() error {
+	payload, _ := xml.Marshal(&AvatarMetadata{})
+	_, err := self.PublishPEP(NodeAvatarMetadata, "current", payload, nil)
+	return err
+}
+
+// Avatar returns the avatar of the account jid, nil if it has none. The data is
+// nil if the image is only available at the url of the info.
+func (self *XmppClient) Avatar(jid string) ([]byte, *AvatarInfo, error) {
+	items, err := self.PEPItems(jid, NodeAvatarMetadata, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(items) == 0 {
+		return nil, nil, nil
+	}
+	metadata := &AvatarMetadata{}
+	if err := items[len(items)-1].Decode(metadata); err != nil {
+		return nil, nil, err
+	}
+	info := metadata.current()
+	if info == nil || info.Url != "" {
+		return nil, info, nil
+	}
+	data, err := self.avatarData(jid, info.Id)
+	return data, info, err
+}
+
+// current returns the info of the version in the data node, PNG preferably,
+// or the first version only available at an url. It is nil if the avatar is disabled.
+func (self *AvatarMetadata) current() *AvatarInfo {
+	var found *AvatarInfo
+	for i := range self.Info {
+		info := &self.Info[i]
+		if info.Url != "" {
+			continue
+		}
+		if found == nil || info.Type == "image/png" {
+			found = info
+		}
+	}
+	if found == nil && len(self.Info) > 0 {
+		found = &self.Info[0]
+	}
+	return found
+}
+
+// avatarData returns the image id of jid, from the cache if possible.
+func (self *XmppClient) avatarData(jid, id string) ([]byte, error) {
+	cache := self.avatar.getCache()
+	if data, ok := cache.Get(id); ok {
+		return data, nil
+	}
+	item, err := self.Item(ToBareJID(jid), NodeAvatarData, id)
+	if err != nil {
+		return nil, err
+	}
+	avatar := &AvatarData{}
+	if err := item.Decode(avatar); err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(avatar.Data), ""))
+	if err != nil {
+		return nil, err
+	}
+	if AvatarId(data) != id {
+		return nil, errors.New("Avatar data doesn't match its id " + id)
+	}
+	cache.Put(id, data)
+	return data, nil
+}
+
+// Avatar handler
+type AvatarHandler struct {
+	DefaultHandler
+}
+
+func NewAvatarHandler() Handler {
+	h := &AvatarHandler{}
+	h.EventCh = make(chan *Event)
+	return h
+}
+
+func (self *AvatarHandler) Filter(event *Event) bool {
+	return event.Type == Avatar
+}
+
+func (self *AvatarHandler) IsOneTime() bool {
+	return false
+}
+
+// processAvatar fetches the avatars announced by the metadata notifications,
+// the notifications still reach the PubSub handlers.
+func (self *XmppClient) processAvatar(event *Event) bool {
+	msg, ok := event.Stanza.(*Message)
+	if !ok || msg.PubSubEvent == nil || msg.PubSubEvent.Items == nil ||
+		msg.PubSubEvent.Items.Node != NodeAvatarMetadata || len(msg.PubSubEvent.Items.Items) == 0 {
+		return true
+	}
+	self.avatar.mutex.Lock()
+	autoFetch := self.avatar.autoFetch
+	self.avatar.mutex.Unlock()
+	if !autoFetch {
+		return true
+	}
+	items := msg.PubSubEvent.Items.Items
+	metadata := &AvatarMetadata{}
+	if err := items[len(items)-1].Decode(metadata); err != nil {
+		return true
+	}
+	jid := ToBareJID(msg.From)
+	go func() {
+		update := &AvatarUpdate{Jid: jid, Info: metadata.current()}
+		if update.Info != nil && update.Info.Url == "" {
+			data, err := self.avatarData(jid, update.Info.Id)
+			if err != nil {
+				self.fireHandler(&Event{Avatar, update, err, "fetch avatar error"})
+				return
+			}
+			update.Data = data
+		}
+		self.fireHandler(&Event{Avatar, update, nil, ""})
+	}()
+	return true
+}
@@ -0,0 +1,99 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAvatar(t *testing.T) {
+	var mutex sync.Mutex
+	nodes := make(map[string][]PubSubItem)
+	dataRequests := 0
+	server := newTestServer("example.com")
+	server.handle = func(from string, stanza interface{}) []interface{} {
+		iq := stanza.(*IQ)
+		owner := iq.To
+		if owner == "" {
+			owner = ToBareJID(from)
+		}
+		resp := &IQ{Id: iq.Id, To: from, From: iq.To, Type: "result"}
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch {
+		case iq.PubSub != nil && iq.PubSub.Publish != nil:
+			publish := iq.PubSub.Publish
+			nodes[owner+" "+publish.Node] = publish.Items
+			if publish.Node == NodeAvatarMetadata {
+				server.send("bob@example.com/b", &Message{From: owner, To: "bob@example.com/b", Type: "headline",
+					PubSubEvent: &PubSubEvent{Items: &PubSubEventItems{Node: publish.Node, Items: publish.Items}}})
+			}
+		case iq.PubSub != nil && iq.PubSub.Items != nil:
+			node := iq.PubSub.Items.Node
+			if node == NodeAvatarData {
+				dataRequests++
+			}
+			resp.PubSub = &PubSub{Items: &PubSubItems{Node: node, Items: nodes[owner+" "+node]}}
+		}
+		return []interface{}{resp}
+	}
+	alice := server.connect("alice@example.com/a")
+	defer alice.Disconnect()
+	bob := server.connect("bob@example.com/b")
+	defer bob.Disconnect()
+	bob.EnableAvatars()
+	avatarHandler := NewAvatarHandler()
+	bob.AddHandler(avatarHandler)
+
+	image := []byte("\x89PNG not really")
+	id, err := alice.PublishAvatar(image, "image/png", 64, 64)
+	if err != nil || id != AvatarId(image) {
+		t.Fatalf("published %s, %v", id, err)
+	}
+	event := avatarHandler.GetEvent(time.Second)
+	if event == nil || event.Error != nil {
+		t.Fatalf("no avatar update: %v", event)
+	}
+	update := event.Stanza.(*AvatarUpdate)
+	if update.Jid != "alice@example.com" || update.Info.Width != 64 || !bytes.Equal(update.Data, image) {
+		t.Fatalf("unexpected update %+v", update)
+	}
+
+	data, info, err := bob.Avatar("alice@example.com/a")
+	if err != nil || info.Id != id || !bytes.Equal(data, image) {
+		t.Fatalf("avatar %v, %v", info, err)
+	}
+	mutex.Lock()
+	requests := dataRequests
+	mutex.Unlock()
+	if requests != 1 {
+		t.Fatalf("avatar fetched %d times, the cache isn't used", requests)
+	}
+
+	// an avatar only available at an url isn't a disabled one
+	hosted := &AvatarMetadata{Info: []AvatarInfo{{Bytes: 12345, Id: "hosted", Type: "image/gif", Url: "https://example.com/avatar.gif"}}}
+	payload, _ := xml.Marshal(hosted)
+	if _, err := alice.PublishPEP(NodeAvatarMetadata, "hosted", payload, nil); err != nil {
+		t.Fatal(err)
+	}
+	event = avatarHandler.GetEvent(time.Second)
+	if event == nil || event.Error != nil {
+		t.Fatalf("no avatar update: %v", event)
+	}
+	update = event.Stanza.(*AvatarUpdate)
+	if update.Info == nil || update.Info.Url != "https://example.com/avatar.gif" || update.Data != nil {
+		t.Fatalf("unexpected update %+v", update)
+	}
+	data, info, err = bob.Avatar("alice@example.com")
+	if err != nil || info == nil || info.Id != "hosted" || data != nil {
+		t.Fatalf("hosted avatar %v, %v", info, err)
+	}
+
+	alice.DisableAvatar()
+	event = avatarHandler.GetEvent(time.Second)
+	if event == nil || event.Stanza.(*AvatarUpdate).Info != nil {
+		t.Fatal("disabled avatar not notified")
+	}
+}
@@ -0,0 +1,211 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// XEP-0191 Blocking Command
+
+const nsBlocking = "urn:xmpp:blocking"
+
+type BlockList struct {
+	XMLName xml.Name    `xml:"urn:xmpp:blocking blocklist"`
+	Items   []BlockItem `xml:"urn:xmpp:blocking item"`
+}
+
+type Block struct {
+	XMLName xml.Name    `xml:"urn:xmpp:blocking block"`
+	Items   []BlockItem `xml:"urn:xmpp:blocking item"`
+}
+
+// Unblock without items unblocks every jid.
+type Unblock struct {
+	XMLName xml.Name    `xml:"urn:xmpp:blocking unblock"`
+	Items   []BlockItem `xml:"urn:xmpp:blocking item"`
+}
+
+type BlockItem struct {
+	Jid string `xml:"jid,attr"`
+}
+
+// blockingState is our view of the blocklist, kept up to date by the pushes
+// of the server once fetched.
+type blockingState struct {
+	mutex   sync.Mutex
+	fetched bool
+	jids    map[string]bool
+}
+
+func (self *blockingState) set(items []BlockItem) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.fetched = true
+	self.jids = make(map[string]bool)
+	for _, item := range items {
+		self.jids[strings.ToLower(item.Jid)] = true
+	}
+}
+
+func (self *blockingState) update(items []BlockItem, blocked bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.jids == nil {
+		self.jids = make(map[string]bool)
+	}
+	if !blocked && len(items) == 0 {
+		self.jids = make(map[string]bool)
+		return
+	}
+	for _, item := range items {
+		if blocked {
+			self.jids[strings.ToLower(item.Jid)] = true
+		} else {
+			delete(self.jids, strings.ToLower(item.Jid))
+		}
+	}
+}
+
+// matches checks jid against the blocked jids with the rules of XEP-0191 8.
+func (self *blockingState) matches(jid string) bool {
+	jid = strings.ToLower(jid)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if len(self.jids) == 0 {
+		return false
+	}
+	bare := ToBareJID(jid)
+	domain := bare
+	if i := strings.Index(bare, "@"); i >= 0 {
+		domain = bare[i+1:]
+	}
+	resource := ""
+	if i := strings.Index(jid, "/"); i >= 0 {
+		resource = jid[i:]
+	}
+	return self.jids[jid] || self.jids[bare] || (resource != "" && self.jids[domain+resource]) || self.jids[domain]
+}
+
+func blockItems(jids []string) []BlockItem {
+	items := make([]BlockItem, len(jids))
+	for i, jid := range jids {
+		items[i] = BlockItem{Jid: jid}
+	}
+	return items
+}
+
+// SupportsBlocking checks whether our server offers the blocking command.
+func (self *XmppClient) SupportsBlocking() (bool, error) {
+	info, err := self.DiscoInfo(self.domain, "")
+	if err != nil {
+		return false, err
+	}
+	return info.HasFeature(nsBlocking), nil
+}
+
+// FetchBlockList retrieves the blocklist from the server, the stanzas of the
+// blocked jids are dropped from then on. The list is fetched again after
+// reconnecting.
+func (self *XmppClient) FetchBlockList() ([]string, error) {
+	resp, err := self.sendIQ(&IQ{Type: "get", BlockList: &BlockList{}})
+	if err != nil {
+		return nil, err
+	}
+	if resp.BlockList == nil {
+		return nil, errors.New("No blocklist in response")
+	}
+	self.blocking.set(resp.BlockList.Items)
+	return self.BlockedJids(), nil
+}
+
+// BlockedJids returns the local view of the blocklist.
+func (self *XmppClient) BlockedJids() []string {
+	self.blocking.mutex.Lock()
+	defer self.blocking.mutex.Unlock()
+	jids := make([]string, 0, len(self.blocking.jids))
+	for jid := range self.blocking.jids {
+		jids = append(jids, jid)
+	}
+	sort.Strings(jids)
+	return jids
+}
+
+// IsBlocked checks whether the stanzas of jid are blocked, a blocked domain
+// or bare jid blocks all its jids.
+func (self *XmppClient) IsBlocked(jid string) bool {
+	return self.blocking.matches(jid)
+}
+
+func (self *XmppClient) Block(jids ...string) error {
+	if len(jids) == 0 {
+		return errors.New("No jid to block")
+	}
+	if _, err := self.sendIQ(&IQ{Type: "set", Block: &Block{Items: blockItems(jids)}}); err != nil {
+		return err
+	}
+	self.blocking.update(blockItems(jids), true)
+	return nil
+}
+
+// Unblock unblocks jids, or every jid if none is given.
+func (self *XmppClient) Unblock(jids ...string) error {
+	if _, err := self.sendIQ(&IQ{Type: "set", Unblock: &Unblock{Items: blockItems(jids)}}); err != nil {
+		return err
+	}
+	self.blocking.update(blockItems(jids), false)
+	return nil
+}
+
+func (self *XmppClient) refreshBlockList() {
+	self.blocking.mutex.Lock()
+	fetched := self.blocking.fetched
+	self.blocking.mutex.Unlock()
+	if fetched {
+		self.FetchBlockList()
+	}
+}
+
+// processBlocking applies the block and unblock pushes of the server and drops
+// the stanzas of blocked senders, answering their requests with an error.
+func (self *XmppClient) processBlocking(event *Event) bool {
+	var from string
+	switch s := event.Stanza.(type) {
+	case *IQ:
+		if s.Type == "set" && (s.Block != nil || s.Unblock != nil) {
+			if s.From != "" && !strings.EqualFold(s.From, ToBareJID(self.jid)) {
+				self.replyIQError(s, "cancel", "service-unavailable")
+				return false
+			}
+			if s.Block != nil {
+				self.blocking.update(s.Block.Items, true)
+			} else {
+				self.blocking.update(s.Unblock.Items, false)
+			}
+			self.Send(&IQ{Id: s.Id, To: s.From, Type: "result"})
+			return false
+		}
+		if s.Type == "result" || s.Type == "error" {
+			// answers to our own requests
+			return true
+		}
+		from = s.From
+	case *Message:
+		from = s.From
+	case *Presence:
+		from = s.From
+	}
+	if from == "" || strings.EqualFold(ToBareJID(from), ToBareJID(self.jid)) {
+		return true
+	}
+	if !self.blocking.matches(from) {
+		return true
+	}
+	// requests still get an answer, as if we weren't there
+	if iq, ok := event.Stanza.(*IQ); ok {
+		self.replyIQError(iq, "cancel", "service-unavailable")
+	}
+	return false
+}
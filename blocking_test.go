@@ -0,0 +1,74 @@
+package xmpp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBlocking(t *testing.T) {
+	server := newTestServer("example.com")
+	server.handle = func(from string, stanza interface{}) []interface{} {
+		iq := stanza.(*IQ)
+		resp := &IQ{Id: iq.Id, To: from, Type: "result"}
+		if iq.BlockList != nil {
+			resp.BlockList = &BlockList{Items: []BlockItem{{Jid: "spam.example.org"}}}
+		}
+		return []interface{}{resp}
+	}
+	alice := server.connect("alice@example.com/a")
+	bob := server.connect("bob@example.com/b")
+	mallory := server.connect("mallory@spam.example.org/m")
+	handler := NewChatHandler()
+	alice.AddHandler(handler)
+
+	jids, err := alice.FetchBlockList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(jids, []string{"spam.example.org"}) {
+		t.Fatal("unexpected blocklist", jids)
+	}
+	if !alice.IsBlocked("mallory@spam.example.org/m") || alice.IsBlocked("bob@example.com/b") {
+		t.Fatal("wrong matching of the blocklist")
+	}
+	mallory.Send(&Message{To: "alice@example.com/a", Type: "chat", Body: "spam"})
+	bob.Send(&Message{To: "alice@example.com/a", Type: "chat", Body: "hello"})
+	event := handler.GetEvent(time.Second)
+	if event == nil || event.Stanza.(*Message).Body != "hello" {
+		t.Fatal("expected only the message of bob", event)
+	}
+	_, err = mallory.sendIQ(&IQ{To: "alice@example.com/a", Type: "get", DiscoInfo: &DiscoInfoQuery{}})
+	if xmppErr, ok := err.(*Error); !ok || xmppErr.Condition() != "service-unavailable" {
+		t.Fatal("expected service-unavailable for the request of a blocked jid", err)
+	}
+
+	if err := alice.Block("bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !alice.IsBlocked("bob@example.com/other") {
+		t.Fatal("bare jid should block all resources")
+	}
+
+	// a push from another resource of ours
+	server.send("alice@example.com/a", &IQ{Id: "push1", From: "alice@example.com", Type: "set",
+		Unblock: &Unblock{Items: []BlockItem{{Jid: "bob@example.com"}}}})
+	// a forged push
+	server.send("alice@example.com/a", &IQ{Id: "push2", From: "mallory@spam.example.org/m", Type: "set",
+		Unblock: &Unblock{}})
+	bob.Send(&Message{To: "alice@example.com/a", Type: "chat", Body: "unblocked"})
+	event = handler.GetEvent(time.Second)
+	if event == nil || event.Stanza.(*Message).Body != "unblocked" {
+		t.Fatal("expected the message of bob after the unblock push", event)
+	}
+	if !reflect.DeepEqual(alice.BlockedJids(), []string{"spam.example.org"}) {
+		t.Fatal("unexpected blocklist", alice.BlockedJids())
+	}
+
+	if err := alice.Unblock(); err != nil {
+		t.Fatal(err)
+	}
+	if len(alice.BlockedJids()) != 0 {
+		t.Fatal("expected empty blocklist")
+	}
+}
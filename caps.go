@@ -0,0 +1,298 @@
+package xmpp
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// XEP-0115 Entity Capabilities
+
+const nsCaps = "http://jabber.org/protocol/caps"
+
+const DefaultCapsNode = "https://github.com/NoahShen/go-xmpp"
+
+type Caps struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
+	Hash    string   `xml:"hash,attr,omitempty"` // empty for legacy caps
+	Node    string   `xml:"node,attr"`
+	Ver     string   `xml:"ver,attr"`
+	Ext     string   `xml:"ext,attr,omitempty"`
+}
+
+var capsHashes = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha-1":   sha1.New,
+	"sha-224": sha256.New224,
+	"sha-256": sha256.New,
+	"sha-384": sha512.New384,
+	"sha-512": sha512.New,
+}
+
+// CapsVer computes the verification string of info with the hash function
+// hashName, e.g. "sha-1".
+func CapsVer(info *DiscoInfoQuery, hashName string) (string, error) {
+	newHash, ok := capsHashes[hashName]
+	if !ok {
+		return "", errors.New("Unsupported caps hash " + hashName)
+	}
+	var s []string
+
+	identities := make([]string, 0, len(info.Identities))
+	for _, id := range info.Identities {
+		identities = append(identities, id.Category+"/"+id.Type+"/"+id.Lang+"/"+id.Name)
+	}
+	sort.Strings(identities)
+	s = append(s, identities...)
+
+	features := make([]string, 0, len(info.Features))
+	for _, f := range info.Features {
+		features = append(features, f.Var)
+	}
+	sort.Strings(features)
+	s = append(s, features...)
+
+	forms := make([]*DataForm, 0, len(info.Forms))
+	for _, form := range info.Forms {
+		if capsFormType(form) != "" {
+			forms = append(forms, form)
+		}
+	}
+	sort.Sort(formsByType(forms))
+	for _, form := range forms {
+		s = append(s, form.FormType())
+		fields := make([]*FormField, 0, len(form.Fields))
+		for _, f := range form.Fields {
+			if f.Var != "FORM_TYPE" {
+				fields = append(fields, f)
+			}
+		}
+		sort.Sort(fieldsByVar(fields))
+		for _, f := range fields {
+			s = append(s, f.Var)
+			values := append([]string{}, f.Values...)
+			sort.Strings(values)
+			s = append(s, values...)
+		}
+	}
+
+	h := newHash()
+	h.Write([]byte(strings.Join(s, "<") + "<"))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// capsFormType returns the FORM_TYPE of an extended information form, or ""
+// for the forms ignored in the verification string: without FORM_TYPE or
+// with a FORM_TYPE field not hidden.
+func capsFormType(form *DataForm) string {
+	f := form.Field("FORM_TYPE")
+	if f == nil || f.Type != FieldHidden {
+		return ""
+	}
+	return f.Value()
+}
+
+type formsByType []*DataForm
+
+func (self formsByType) Len() int           { return len(self) }
+func (self formsByType) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self formsByType) Less(i, j int) bool { return self[i].FormType() < self[j].FormType() }
+
+type fieldsByVar []*FormField
+
+func (self fieldsByVar) Len() int           { return len(self) }
+func (self fieldsByVar) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self fieldsByVar) Less(i, j int) bool { return self[i].Var < self[j].Var }
+
+// verifyCaps checks that info is well-formed and hashes to caps.Ver (XEP-0115 5.4).
+func verifyCaps(caps *Caps, info *DiscoInfoQuery) error {
+	seen := make(map[string]bool)
+	for _, id := range info.Identities {
+		key := id.Category + "/" + id.Type + "/" + id.Lang + "/" + id.Name
+		if seen[key] {
+			return errors.New("Duplicate identity " + key)
+		}
+		seen[key] = true
+	}
+	for _, f := range info.Features {
+		if seen["<"+f.Var] {
+			return errors.New("Duplicate feature " + f.Var)
+		}
+		seen["<"+f.Var] = true
+	}
+	for _, form := range info.Forms {
+		f := form.Field("FORM_TYPE")
+		if f == nil || f.Type != FieldHidden {
+			continue
+		}
+		if len(f.Values) != 1 {
+			return errors.New("Invalid FORM_TYPE in disco#info")
+		}
+		if seen["FORM_TYPE<"+f.Value()] {
+			return errors.New("Duplicate form " + f.Value())
+		}
+		seen["FORM_TYPE<"+f.Value()] = true
+	}
+	ver, err := CapsVer(info, caps.Hash)
+	if err != nil {
+		return err
+	}
+	if ver != caps.Ver {
+		return errors.New("Caps verification string mismatch: " + caps.Ver)
+	}
+	return nil
+}
+
+type capsState struct {
+	mutex        sync.Mutex
+	node         string
+	cache        map[string]*DiscoInfoQuery // by ver, or node#ver for legacy caps
+	jids         map[string]*Caps
+	fetching     map[string]bool
+	lastPresence *Presence
+}
+
+func (self *capsState) init() {
+	self.node = DefaultCapsNode
+	self.cache = make(map[string]*DiscoInfoQuery)
+	self.jids = make(map[string]*Caps)
+	self.fetching = make(map[string]bool)
+}
+
+func capsKey(caps *Caps) string {
+	if caps.Hash == "" {
+		return caps.Node + "#" + caps.Ver
+	}
+	return caps.Ver
+}
+
+// SetCapsNode sets the URI identifying our software in the advertised caps.
+func (self *XmppClient) SetCapsNode(node string) {
+	self.caps.mutex.Lock()
+	defer self.caps.mutex.Unlock()
+	self.caps.node = node
+}
+
+// Caps returns the caps element advertising our disco#info.
+func (self *XmppClient) Caps() *Caps {
+	ver, _ := CapsVer(self.disco.info(), "sha-1")
+	self.caps.mutex.Lock()
+	defer self.caps.mutex.Unlock()
+	return &Caps{Hash: "sha-1", Node: self.caps.node, Ver: ver}
+}
+
+// CapsInfo returns the cached disco#info of the full jid, or nil if unknown.
+func (self *XmppClient) CapsInfo(jid string) *DiscoInfoQuery {
+	self.caps.mutex.Lock()
+	defer self.caps.mutex.Unlock()
+	caps, ok := self.caps.jids[jid]
+	if !ok {
+		return nil
+	}
+	return self.caps.cache[capsKey(caps)]
+}
+
+// Supports reports whether the entity fullJid advertised feature in its caps.
+// It returns false while the caps of the entity are unknown.
+func (self *XmppClient) Supports(fullJid, feature string) bool {
+	info := self.CapsInfo(fullJid)
+	return info != nil && info.HasFeature(feature)
+}
+
+func (self *XmppClient) isCapsNode(node string) bool {
+	caps := self.Caps()
+	return node == caps.Node+"#"+caps.Ver
+}
+
+// decorateCaps attaches our caps to outgoing available presences
+// and remembers the last broadcast presence.
+func (self *XmppClient) decorateCaps(stanza interface{}) {
+	presence, ok := stanza.(*Presence)
+	if !ok || presence.Type != "" {
+		return
+	}
+	if presence.Caps == nil {
+		presence.Caps = self.Caps()
+	}
+	if presence.To == "" {
+		last := *presence
+		self.caps.mutex.Lock()
+		self.caps.lastPresence = &last
+		self.caps.mutex.Unlock()
+	}
+}
+
+// discoChanged broadcasts our presence again with the new caps, after our
+// identities or features have changed.
+func (self *XmppClient) discoChanged() {
+	self.resendPresence()
+}
+
+// resendPresence broadcasts our last presence again, decorated anew.
+func (self *XmppClient) resendPresence() {
+	self.caps.mutex.Lock()
+	last := self.caps.lastPresence
+	self.caps.mutex.Unlock()
+	if last == nil || !self.isConnected() {
+		return
+	}
+	presence := *last
+	presence.Caps = nil
+	self.Send(&presence)
+}
+
+func (self *XmppClient) processCaps(event *Event) bool {
+	presence, ok := event.Stanza.(*Presence)
+	if !ok || presence.From == "" {
+		return true
+	}
+	if presence.Type == "unavailable" {
+		self.caps.mutex.Lock()
+		delete(self.caps.jids, presence.From)
+		self.caps.mutex.Unlock()
+		return true
+	}
+	caps := presence.Caps
+	if presence.Type != "" || caps == nil || caps.Ver == "" {
+		return true
+	}
+	if _, ok := capsHashes[caps.Hash]; caps.Hash != "" && !ok {
+		return true
+	}
+	key := capsKey(caps)
+	self.caps.mutex.Lock()
+	defer self.caps.mutex.Unlock()
+	self.caps.jids[presence.From] = caps
+	if _, cached := self.caps.cache[key]; !cached && !self.caps.fetching[key] {
+		self.caps.fetching[key] = true
+		go self.fetchCaps(presence.From, caps)
+	}
+	return true
+}
+
+func (self *XmppClient) fetchCaps(jid string, caps *Caps) {
+	key := capsKey(caps)
+	info, err := self.DiscoInfo(jid, caps.Node+"#"+caps.Ver)
+	if err == nil && caps.Hash != "" {
+		err = verifyCaps(caps, info)
+	}
+	self.caps.mutex.Lock()
+	defer self.caps.mutex.Unlock()
+	delete(self.caps.fetching, key)
+	if err != nil {
+		if Debug {
+			fmt.Printf("Caps of %s: %v\n", jid, err)
+		}
+		return
+	}
+	self.caps.cache[key] = info
+}
@@ -0,0 +1,81 @@
+package xmpp
+
+import (
+	"testing"
+)
+
+func TestCapsVerSimple(t *testing.T) {
+	// XEP-0115 5.2
+	info := &DiscoInfoQuery{
+		Identities: []DiscoIdentity{{Category: "client", Type: "pc", Name: "Exodus 0.9.1"}},
+		Features: []DiscoFeature{
+			{"http://jabber.org/protocol/disco#info"},
+			{"http://jabber.org/protocol/disco#items"},
+			{"http://jabber.org/protocol/muc"},
+			{"http://jabber.org/protocol/caps"},
+		},
+	}
+	ver, err := CapsVer(info, "sha-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver != "QgayPKawpkPSDYmwT/WM94uAlu0=" {
+		t.Fatalf("unexpected ver %s", ver)
+	}
+}
+
+func TestCapsVerComplex(t *testing.T) {
+	// XEP-0115 5.3
+	form := NewDataForm(FormTypeResult, "urn:xmpp:dataforms:softwareinfo")
+	form.AddField("ip_version", FieldTextMulti, "", "ipv6", "ipv4")
+	form.AddField("os", "", "", "Mac")
+	form.AddField("os_version", "", "", "10.5.1")
+	form.AddField("software", "", "", "Psi")
+	form.AddField("software_version", "", "", "0.11")
+	info := &DiscoInfoQuery{
+		Identities: []DiscoIdentity{
+			{Category: "client", Type: "pc", Name: "Psi 0.11", Lang: "en"},
+			{Category: "client", Type: "pc", Name: "Ψ 0.11", Lang: "el"},
+		},
+		Features: []DiscoFeature{
+			{"http://jabber.org/protocol/disco#info"},
+			{"http://jabber.org/protocol/disco#items"},
+			{"http://jabber.org/protocol/muc"},
+			{"http://jabber.org/protocol/caps"},
+		},
+		Forms: []*DataForm{form},
+	}
+	caps := &Caps{Hash: "sha-1", Node: "http://psi-im.org", Ver: "q07IKJEyjvHSyhy//CH0CxmKi8w="}
+	if err := verifyCaps(caps, info); err != nil {
+		t.Fatal(err)
+	}
+	// forms with a FORM_TYPE not hidden are ignored
+	other := &DataForm{Type: FormTypeResult}
+	other.AddField("FORM_TYPE", FieldTextSingle, "", "urn:example:other")
+	other.AddField("extra", "", "", "value")
+	info.Forms = append(info.Forms, other)
+	if err := verifyCaps(caps, info); err != nil {
+		t.Fatal(err)
+	}
+	info.Features = append(info.Features, DiscoFeature{"http://jabber.org/protocol/muc"})
+	if err := verifyCaps(caps, info); err == nil {
+		t.Fatal("duplicate feature not detected")
+	}
+}
+
+func TestCapsSupports(t *testing.T) {
+	xmppClient := NewXmppClient(ClientConfig{})
+	caps := &Caps{Hash: "sha-1", Node: "http://psi-im.org", Ver: "QgayPKawpkPSDYmwT/WM94uAlu0="}
+	xmppClient.caps.cache[caps.Ver] = &DiscoInfoQuery{Features: []DiscoFeature{{"http://jabber.org/protocol/muc"}}}
+	xmppClient.processStanza(&Event{Stanza, &Presence{From: "juliet@example.com/balcony", Caps: caps}, nil, ""})
+	if !xmppClient.Supports("juliet@example.com/balcony", "http://jabber.org/protocol/muc") {
+		t.Fatal("feature of cached caps not supported")
+	}
+	if xmppClient.Supports("juliet@example.com/balcony", "urn:xmpp:jingle:1") {
+		t.Fatal("unknown feature supported")
+	}
+	xmppClient.processStanza(&Event{Stanza, &Presence{From: "juliet@example.com/balcony", Type: "unavailable"}, nil, ""})
+	if xmppClient.Supports("juliet@example.com/balcony", "http://jabber.org/protocol/muc") {
+		t.Fatal("caps kept after unavailable presence")
+	}
+}
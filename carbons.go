@@ -0,0 +1,91 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// XEP-0280 Message Carbons
+
+const nsCarbons = "urn:xmpp:carbons:2"
+
+type CarbonEnable struct {
+	XMLName xml.Name `xml:"urn:xmpp:carbons:2 enable"`
+}
+
+type CarbonDisable struct {
+	XMLName xml.Name `xml:"urn:xmpp:carbons:2 disable"`
+}
+
+// CarbonReceived wraps a message received by another resource of ours.
+type CarbonReceived struct {
+	XMLName   xml.Name `xml:"urn:xmpp:carbons:2 received"`
+	Forwarded *Forwarded
+}
+
+// CarbonSent wraps a message sent by another resource of ours.
+type CarbonSent struct {
+	XMLName   xml.Name `xml:"urn:xmpp:carbons:2 sent"`
+	Forwarded *Forwarded
+}
+
+// CarbonPrivate excludes a message from being carbon-copied.
+type CarbonPrivate struct {
+	XMLName xml.Name `xml:"urn:xmpp:carbons:2 private"`
+}
+
+// EnableCarbons asks the server to copy the messages of our other resources to this session.
+// Carbons are enabled again after reconnecting.
+func (self *XmppClient) EnableCarbons() error {
+	iq := &IQ{
+		Type:         "set",
+		CarbonEnable: &CarbonEnable{},
+	}
+	if _, err := self.sendIQ(iq); err != nil {
+		return err
+	}
+	self.mutex.Lock()
+	self.carbons = true
+	self.mutex.Unlock()
+	return nil
+}
+
+func (self *XmppClient) DisableCarbons() error {
+	iq := &IQ{
+		Type:          "set",
+		CarbonDisable: &CarbonDisable{},
+	}
+	if _, err := self.sendIQ(iq); err != nil {
+		return err
+	}
+	self.mutex.Lock()
+	self.carbons = false
+	self.mutex.Unlock()
+	return nil
+}
+
+// processCarbons unwraps carbon copies into the forwarded message, marked by Message.Carbon.
+// Carbons not sent by our own bare jid are forged and dropped.
+func (self *XmppClient) processCarbons(event *Event) bool {
+	msg, ok := event.Stanza.(*Message)
+	if !ok || (msg.CarbonReceived == nil && msg.CarbonSent == nil) {
+		return true
+	}
+	if !strings.EqualFold(msg.From, ToBareJID(self.jid)) {
+		return false
+	}
+	var forwarded *Forwarded
+	carbon := "received"
+	if msg.CarbonReceived != nil {
+		forwarded = msg.CarbonReceived.Forwarded
+	} else {
+		forwarded = msg.CarbonSent.Forwarded
+		carbon = "sent"
+	}
+	if forwarded == nil || forwarded.Message == nil {
+		return false
+	}
+	forwarded.Message.Carbon = carbon
+	event.Stanza = forwarded.Message
+	return true
+}
@@ -0,0 +1,45 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"testing"
+)
+
+const sentCarbon = `<message xmlns="jabber:client" from="%s" to="romeo@montague.example/home" type="chat">
+	<sent xmlns="urn:xmpp:carbons:2"><forwarded xmlns="urn:xmpp:forward:0">
+	<message xmlns="jabber:client" to="juliet@capulet.example/balcony" from="romeo@montague.example/garden" type="chat">
+	<body>What man art thou?</body></message></forwarded></sent></message>`
+
+func TestUnwrapCarbon(t *testing.T) {
+	xmppClient := NewXmppClient(ClientConfig{})
+	xmppClient.jid = "romeo@montague.example"
+
+	var msg Message
+	if err := xml.Unmarshal([]byte(fmtCarbon("romeo@montague.example")), &msg); err != nil {
+		t.Fatal(err)
+	}
+	event := &Event{Stanza, &msg, nil, ""}
+	if !xmppClient.processStanza(event) {
+		t.Fatal("carbon from our bare jid dropped")
+	}
+	inner := event.Stanza.(*Message)
+	if inner.Carbon != "sent" || inner.To != "juliet@capulet.example/balcony" || inner.Body != "What man art thou?" {
+		t.Fatalf("unexpected unwrapped message: %+v", inner)
+	}
+	if NewChatHandler().Filter(event) {
+		t.Fatal("sent carbon dispatched to chat handler")
+	}
+
+	var forged Message
+	if err := xml.Unmarshal([]byte(fmtCarbon("mallory@evil.example/x")), &forged); err != nil {
+		t.Fatal(err)
+	}
+	if xmppClient.processStanza(&Event{Stanza, &forged, nil, ""}) {
+		t.Fatal("forged carbon not dropped")
+	}
+}
+
+func fmtCarbon(from string) string {
+	return fmt.Sprintf(sentCarbon, from)
+}
@@ -0,0 +1,246 @@
+package xmpp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// XEP-0085 Chat State Notifications
+
+const nsChatStates = "http://jabber.org/protocol/chatstates"
+
+const (
+	ChatStateActive    = "active"
+	ChatStateComposing = "composing"
+	ChatStatePaused    = "paused"
+	ChatStateInactive  = "inactive"
+	ChatStateGone      = "gone"
+)
+
+var ErrChatStatesUnsupported = errors.New("xmpp: peer does not support chat states")
+
+type ChatStateNotification struct{}
+
+// ChatState returns the chat state carried by the message, or "".
+func (self *Message) ChatState() string {
+	switch {
+	case self.StateActive != nil:
+		return ChatStateActive
+	case self.StateComposing != nil:
+		return ChatStateComposing
+	case self.StatePaused != nil:
+		return ChatStatePaused
+	case self.StateInactive != nil:
+		return ChatStateInactive
+	case self.StateGone != nil:
+		return ChatStateGone
+	}
+	return ""
+}
+
+// SetChatState replaces the chat state of the message, "" removes it.
+func (self *Message) SetChatState(state string) {
+	self.StateActive = nil
+	self.StateComposing = nil
+	self.StatePaused = nil
+	self.StateInactive = nil
+	self.StateGone = nil
+	n := &ChatStateNotification{}
+	switch state {
+	case ChatStateActive:
+		self.StateActive = n
+	case ChatStateComposing:
+		self.StateComposing = n
+	case ChatStatePaused:
+		self.StatePaused = n
+	case ChatStateInactive:
+		self.StateInactive = n
+	case ChatStateGone:
+		self.StateGone = n
+	}
+}
+
+// SendChatState sends a standalone chat state notification to jid. It fails with
+// ErrChatStatesUnsupported until jid sent us a chat state or advertised them in
+// its caps.
+func (self *XmppClient) SendChatState(jid, state string) error {
+	if !self.chatStates.supported(jid) {
+		return ErrChatStatesUnsupported
+	}
+	msg := &Message{
+		To:      jid,
+		Type:    "chat",
+		NoStore: &NoStoreHint{},
+	}
+	msg.SetChatState(state)
+	return self.Send(msg)
+}
+
+// ChatState handler, it receives the chat messages carrying a state, with or without body.
+type ChatStateHandler struct {
+	DefaultHandler
+}
+
+func NewChatStateHandler() Handler {
+	h := &ChatStateHandler{}
+	h.EventCh = make(chan *Event)
+	return h
+}
+
+func (self *ChatStateHandler) Filter(event *Event) bool {
+	if event.Type == Stanza {
+		if msg, ok := event.Stanza.(*Message); ok {
+			return msg.Type == "chat" && msg.ChatState() != "" && msg.Carbon != "sent"
+		}
+	}
+	return false
+}
+
+func (self *ChatStateHandler) IsOneTime() bool {
+	return false
+}
+
+type chatConversation struct {
+	state string
+	timer *time.Timer
+}
+
+// ChatStateManager sends our chat states per conversation and moves them on
+// after inactivity: composing to paused, paused and active to inactive,
+// inactive to gone.
+type ChatStateManager struct {
+	client        *XmppClient
+	mutex         sync.Mutex
+	pausedAfter   time.Duration
+	inactiveAfter time.Duration
+	goneAfter     time.Duration
+	conversations map[string]*chatConversation
+	// jids which sent us a chat state
+	peers map[string]bool
+}
+
+func (self *ChatStateManager) init(client *XmppClient) {
+	self.client = client
+	self.pausedAfter = 30 * time.Second
+	self.inactiveAfter = 2 * time.Minute
+	self.goneAfter = 10 * time.Minute
+	self.conversations = make(map[string]*chatConversation)
+	self.peers = make(map[string]bool)
+}
+
+func (self *ChatStateManager) supported(jid string) bool {
+	self.mutex.Lock()
+	peer := self.peers[jid]
+	self.mutex.Unlock()
+	return peer || self.client.Supports(jid, nsChatStates)
+}
+
+// SetTimeouts sets the inactivity after which composing becomes paused (30
+// seconds by default), paused or active becomes inactive (2 minutes) and
+// inactive becomes gone (10 minutes). Zero disables the transition.
+func (self *ChatStateManager) SetTimeouts(paused, inactive, gone time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.pausedAfter = paused
+	self.inactiveAfter = inactive
+	self.goneAfter = gone
+}
+
+// ChatStates returns the chat state manager, using it advertises chat state support.
+func (self *XmppClient) ChatStates() *ChatStateManager {
+	self.AddFeature(nsChatStates)
+	return &self.chatStates
+}
+
+// Composing tells jid that we are typing, e.g. while computing a reply.
+func (self *ChatStateManager) Composing(jid string) error {
+	return self.setState(jid, ChatStateComposing, true)
+}
+
+// Paused tells jid that we stopped typing.
+func (self *ChatStateManager) Paused(jid string) error {
+	return self.setState(jid, ChatStatePaused, true)
+}
+
+// Active tells jid that we are paying attention to the conversation.
+func (self *ChatStateManager) Active(jid string) error {
+	return self.setState(jid, ChatStateActive, true)
+}
+
+// Gone ends the conversation with jid.
+func (self *ChatStateManager) Gone(jid string) error {
+	return self.setState(jid, ChatStateGone, true)
+}
+
+// SendChatMessage sends a chat message carrying the active state and returns
+// its id, a receipt is requested as by XmppClient.SendChatMessage.
+func (self *ChatStateManager) SendChatMessage(jid, content string) (string, error) {
+	self.setState(jid, ChatStateActive, false)
+	return self.client.sendChatMessage(jid, content, ChatStateActive)
+}
+
+// State returns our current chat state in the conversation with jid.
+func (self *ChatStateManager) State(jid string) string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if c, ok := self.conversations[jid]; ok {
+		return c.state
+	}
+	return ""
+}
+
+func (self *ChatStateManager) setState(jid, state string, send bool) error {
+	self.mutex.Lock()
+	c, ok := self.conversations[jid]
+	if !ok {
+		c = &chatConversation{}
+		self.conversations[jid] = c
+	}
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	changed := c.state != state
+	c.state = state
+
+	next, after := "", time.Duration(0)
+	switch state {
+	case ChatStateComposing:
+		next, after = ChatStatePaused, self.pausedAfter
+	case ChatStatePaused, ChatStateActive:
+		next, after = ChatStateInactive, self.inactiveAfter
+	case ChatStateInactive:
+		next, after = ChatStateGone, self.goneAfter
+	case ChatStateGone:
+		delete(self.conversations, jid)
+	}
+	if next != "" && after > 0 {
+		c.timer = time.AfterFunc(after, func() {
+			self.mutex.Lock()
+			current := self.conversations[jid] == c && c.state == state
+			self.mutex.Unlock()
+			if current {
+				self.setState(jid, next, true)
+			}
+		})
+	}
+	self.mutex.Unlock()
+
+	if send && changed {
+		return self.client.SendChatState(jid, state)
+	}
+	return nil
+}
+
+func (self *XmppClient) processChatStates(event *Event) bool {
+	msg, ok := event.Stanza.(*Message)
+	if !ok || msg.Type != "chat" || msg.Carbon == "sent" || msg.ChatState() == "" {
+		return true
+	}
+	self.chatStates.mutex.Lock()
+	self.chatStates.peers[msg.From] = true
+	self.chatStates.peers[ToBareJID(msg.From)] = true
+	self.chatStates.mutex.Unlock()
+	return true
+}
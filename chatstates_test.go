@@ -0,0 +1,113 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestChatStateOnlyMessage(t *testing.T) {
+	var msg Message
+	err := xml.Unmarshal([]byte(`<message xmlns="jabber:client" from="bernardo@shakespeare.lit/pda" type="chat">
+		<composing xmlns="http://jabber.org/protocol/chatstates"/></message>`), &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &Event{Stanza, &msg, nil, ""}
+	if msg.ChatState() != ChatStateComposing {
+		t.Fatalf("unexpected state %s", msg.ChatState())
+	}
+	if !NewChatStateHandler().Filter(event) || NewChatHandler().Filter(event) {
+		t.Fatal("state without body must only reach the chat state handler")
+	}
+
+	msg.SetChatState(ChatStatePaused)
+	b, err := xml.Marshal(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<message xmlns="jabber:client" from="bernardo@shakespeare.lit/pda" type="chat"><paused xmlns="http://jabber.org/protocol/chatstates"></paused></message>`
+	if string(b) != expected {
+		t.Fatalf("got %s", b)
+	}
+}
+
+func TestChatStateTimeouts(t *testing.T) {
+	xmppClient := NewXmppClient(ClientConfig{})
+	states := xmppClient.ChatStates()
+	states.SetTimeouts(20*time.Millisecond, 20*time.Millisecond, time.Hour)
+
+	// juliet never sent us a state, so nothing is sent but the state moves on
+	states.Composing("juliet@capulet.example")
+	if states.State("juliet@capulet.example") != ChatStateComposing {
+		t.Fatal("state not composing")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if states.State("juliet@capulet.example") != ChatStateInactive {
+		t.Fatalf("unexpected state %s", states.State("juliet@capulet.example"))
+	}
+	states.Gone("juliet@capulet.example")
+	if states.State("juliet@capulet.example") != "" {
+		t.Fatal("conversation not ended")
+	}
+}
+
+func TestChatStateMessageReceipt(t *testing.T) {
+	server := newTestServer("example.com")
+	alice := server.connect("alice@example.com/a")
+	bob := server.connect("bob@example.com/b")
+	handler := NewChatHandler()
+	bob.AddHandler(handler)
+	bob.subs.updateRoster(&IQRoster{Items: []RosterItem{{Jid: "alice@example.com", Subscription: "both"}}})
+	alice.SetRequestReceipts(true)
+	alice.SetReceiptTimeout(time.Second)
+
+	id, err := alice.ChatStates().SendChatMessage("bob@example.com/b", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := handler.GetEvent(time.Second)
+	if event == nil {
+		t.Fatal("message not received")
+	}
+	msg := event.Stanza.(*Message)
+	if msg.ChatState() != ChatStateActive || msg.ReceiptRequest == nil {
+		t.Fatalf("expected active state and receipt request: %+v", msg)
+	}
+	if alice.Receipts().Wait(id) != ReceiptDelivered {
+		t.Fatal("receipt of the chat state message not tracked")
+	}
+}
+
+func TestChatStateNegotiation(t *testing.T) {
+	server := newTestServer("example.com")
+	alice := server.connect("alice@example.com/a")
+	bob := server.connect("bob@example.com/b")
+	defer alice.Disconnect()
+	defer bob.Disconnect()
+	chats := NewChatHandler()
+	alice.AddHandler(chats)
+	states := NewChatStateHandler()
+	bob.AddHandler(states)
+
+	if err := alice.ChatStates().Composing("bob@example.com/b"); err != ErrChatStatesUnsupported {
+		t.Fatalf("expected ErrChatStatesUnsupported, got %v", err)
+	}
+	if _, err := bob.ChatStates().SendChatMessage("alice@example.com/a", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if chats.GetEvent(time.Second) == nil {
+		t.Fatal("message not received")
+	}
+	if err := alice.ChatStates().Paused("bob@example.com/b"); err != nil {
+		t.Fatal(err)
+	}
+	event := states.GetEvent(time.Second)
+	if event == nil {
+		t.Fatal("chat state not received")
+	}
+	msg := event.Stanza.(*Message)
+	if msg.ChatState() != ChatStatePaused || msg.NoStore == nil {
+		t.Fatalf("expected paused with a no-store hint: %+v", msg)
+	}
+}
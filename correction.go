@@ -0,0 +1,261 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// XEP-0308 Last Message Correction and XEP-0424 Message Retraction
+
+const (
+	nsCorrect  = "urn:xmpp:message-correct:0"
+	nsRetract  = "urn:xmpp:message-retract:1"
+	nsFallback = "urn:xmpp:fallback:0"
+	nsHints    = "urn:xmpp:hints"
+)
+
+const retractFallbackBody = "This person attempted to retract a previous message, but it's unsupported by your client."
+
+type Replace struct {
+	XMLName xml.Name `xml:"urn:xmpp:message-correct:0 replace"`
+	Id      string   `xml:"id,attr"`
+}
+
+type Retract struct {
+	XMLName xml.Name `xml:"urn:xmpp:message-retract:1 retract"`
+	Id      string   `xml:"id,attr"`
+}
+
+// XEP-0428 Fallback Indication
+type Fallback struct {
+	XMLName xml.Name       `xml:"urn:xmpp:fallback:0 fallback"`
+	For     string         `xml:"for,attr,omitempty"`
+	Bodies  []FallbackBody `xml:"body"`
+}
+
+// FallbackBody is a range of the body, in characters, only meant for the clients without support.
+type FallbackBody struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+func NewFallbackBody(start, end int) FallbackBody {
+	return FallbackBody{Start: strconv.Itoa(start), End: strconv.Itoa(end)}
+}
+
+// Range returns the range, ok is false if it is invalid.
+func (self FallbackBody) Range() (start, end int, ok bool) {
+	start, err := strconv.Atoi(self.Start)
+	if err != nil {
+		return 0, 0, false
+	}
+	if end, err = strconv.Atoi(self.End); err != nil || start < 0 || start > end {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// XEP-0334 store hint
+type StoreHint struct {
+	XMLName xml.Name `xml:"urn:xmpp:hints store"`
+}
+
+// XEP-0334 no-store hint
+type NoStoreHint struct {
+	XMLName xml.Name `xml:"urn:xmpp:hints no-store"`
+}
+
+// IsEdit reports whether the message corrects, retracts or reacts to a previous one.
+// The chat handlers receive these messages with their fallback body too.
+func (self *Message) IsEdit() bool {
+	return self.Replace != nil || self.Retract != nil || self.Reactions != nil
+}
+
+// CorrectMessage replaces the content of our message id sent to jid and returns the id of the correction.
+func (self *XmppClient) CorrectMessage(jid, id, content string) (string, error) {
+	msg := &Message{
+		Id:      RandomString(16),
+		To:      jid,
+		Type:    self.messageType(jid),
+		Body:    content,
+		Replace: &Replace{Id: id},
+	}
+	return msg.Id, self.Send(msg)
+}
+
+// RetractMessage asks the recipients of our message id sent to jid to withdraw it.
+func (self *XmppClient) RetractMessage(jid, id string) error {
+	msg := &Message{
+		Id:        RandomString(16),
+		To:        jid,
+		Type:      self.messageType(jid),
+		Body:      retractFallbackBody,
+		Retract:   &Retract{Id: id},
+		Fallbacks: []*Fallback{{For: nsRetract}},
+		StoreHint: &StoreHint{},
+	}
+	return self.Send(msg)
+}
+
+// messageType returns groupchat for the jids of joined rooms, chat otherwise.
+func (self *XmppClient) messageType(jid string) string {
+	if !strings.Contains(jid, "/") && self.muc.room(jid) != nil {
+		return "groupchat"
+	}
+	return "chat"
+}
+
+// Correction handler
+type CorrectionHandler struct {
+	DefaultHandler
+}
+
+func NewCorrectionHandler() Handler {
+	h := &CorrectionHandler{}
+	h.EventCh = make(chan *Event)
+	return h
+}
+
+func (self *CorrectionHandler) Filter(event *Event) bool {
+	if event.Type == Stanza {
+		if msg, ok := event.Stanza.(*Message); ok {
+			return msg.Replace != nil && msg.Retract == nil
+		}
+	}
+	return false
+}
+
+func (self *CorrectionHandler) IsOneTime() bool {
+	return false
+}
+
+// Retraction handler
+type RetractionHandler struct {
+	DefaultHandler
+}
+
+func NewRetractionHandler() Handler {
+	h := &RetractionHandler{}
+	h.EventCh = make(chan *Event)
+	return h
+}
+
+func (self *RetractionHandler) Filter(event *Event) bool {
+	if event.Type == Stanza {
+		if msg, ok := event.Stanza.(*Message); ok {
+			return msg.Retract != nil
+		}
+	}
+	return false
+}
+
+func (self *RetractionHandler) IsOneTime() bool {
+	return false
+}
+
+const maxTrackedSenders = 1000
+
+type sentMessage struct {
+	sender string
+	id     string
+}
+
+// messageSenders remembers the ids of the latest received messages by sender,
+// different senders may use the same id.
+type messageSenders struct {
+	mutex    sync.Mutex
+	senders  map[string][]string // id to senders
+	received []sentMessage
+	next     int
+}
+
+func (self *messageSenders) init() {
+	self.senders = make(map[string][]string)
+	self.received = make([]sentMessage, maxTrackedSenders)
+}
+
+// senderKey identifies the sender of msg: the occupant jid room@service/nick
+// in groupchat, the bare jid otherwise.
+func senderKey(msg *Message) string {
+	if msg.Type == "groupchat" {
+		return strings.ToLower(msg.From)
+	}
+	return strings.ToLower(ToBareJID(msg.From))
+}
+
+func (self *messageSenders) add(id, sender string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, s := range self.senders[id] {
+		if s == sender {
+			return
+		}
+	}
+	if old := self.received[self.next]; old.id != "" {
+		self.remove(old)
+	}
+	self.received[self.next] = sentMessage{sender, id}
+	self.next = (self.next + 1) % maxTrackedSenders
+	self.senders[id] = append(self.senders[id], sender)
+}
+
+func (self *messageSenders) remove(m sentMessage) {
+	senders := self.senders[m.id]
+	for i, s := range senders {
+		if s == m.sender {
+			senders = append(senders[:i:i], senders[i+1:]...)
+			break
+		}
+	}
+	if len(senders) == 0 {
+		delete(self.senders, m.id)
+	} else {
+		self.senders[m.id] = senders
+	}
+}
+
+// check reports whether the message id was received from sender, and whether
+// it was received at all.
+func (self *messageSenders) check(id, sender string) (sent, known bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, s := range self.senders[id] {
+		if s == sender {
+			return true, true
+		}
+	}
+	return false, len(self.senders[id]) > 0
+}
+
+// processCorrections drops the corrections and retractions of messages received
+// from somebody else, and marks the ones of unknown messages Unverified.
+func (self *XmppClient) processCorrections(event *Event) bool {
+	msg, ok := event.Stanza.(*Message)
+	if !ok || msg.Type == "error" || msg.Carbon == "sent" {
+		return true
+	}
+	if msg.Replace == nil && msg.Retract == nil {
+		if msg.Id != "" && msg.Body != "" && msg.Reactions == nil {
+			self.senders.add(msg.Id, senderKey(msg))
+			if ref := msg.ReferenceId(); ref != "" && ref != msg.Id {
+				// rooms may reference the message by its stanza-id
+				self.senders.add(ref, senderKey(msg))
+			}
+		}
+		return true
+	}
+	id := ""
+	if msg.Retract != nil {
+		id = msg.Retract.Id
+	} else {
+		id = msg.Replace.Id
+	}
+	sent, known := self.senders.check(id, senderKey(msg))
+	if !sent && known {
+		return false
+	}
+	msg.Unverified = !sent
+	return true
+}
@@ -0,0 +1,54 @@
+package xmpp
+
+import (
+	"testing"
+)
+
+func TestCorrectionSenderCheck(t *testing.T) {
+	xmppClient := NewXmppClient(ClientConfig{})
+	original := &Message{Id: "bad1", From: "juliet@capulet.net/balcony", Type: "chat", Body: "But soft, what light through yonder airlock breaks?"}
+	xmppClient.processStanza(&Event{Stanza, original, nil, ""})
+
+	correction := &Message{From: "juliet@capulet.net/chamber", Type: "chat",
+		Body: "But soft, what light through yonder window breaks?", Replace: &Replace{Id: "bad1"}}
+	event := &Event{Stanza, correction, nil, ""}
+	if !xmppClient.processStanza(event) {
+		t.Fatal("correction from the sender dropped")
+	}
+	if !NewCorrectionHandler().Filter(event) || !NewChatHandler().Filter(event) || !correction.IsEdit() {
+		t.Fatal("correction must reach the correction and chat handlers")
+	}
+
+	forged := &Message{From: "mallory@evil.net/x", Type: "chat", Retract: &Retract{Id: "bad1"}}
+	if xmppClient.processStanza(&Event{Stanza, forged, nil, ""}) {
+		t.Fatal("retraction from another sender not dropped")
+	}
+
+	groupOriginal := &Message{Id: "g1", From: "room@muc.example/alice", Type: "groupchat", Body: "hi"}
+	xmppClient.processStanza(&Event{Stanza, groupOriginal, nil, ""})
+	groupRetract := &Message{From: "room@muc.example/bob", Type: "groupchat", Retract: &Retract{Id: "g1"}}
+	if xmppClient.processStanza(&Event{Stanza, groupRetract, nil, ""}) {
+		t.Fatal("retraction by another occupant not dropped")
+	}
+	groupRetract.From = "room@muc.example/alice"
+	event = &Event{Stanza, groupRetract, nil, ""}
+	if !xmppClient.processStanza(event) || !NewRetractionHandler().Filter(event) || groupRetract.Unverified {
+		t.Fatal("retraction by the occupant not surfaced")
+	}
+
+	// another sender using the same id
+	other := &Message{Id: "bad1", From: "romeo@montague.net/orchard", Type: "chat", Body: "Hi"}
+	xmppClient.processStanza(&Event{Stanza, other, nil, ""})
+	otherCorrection := &Message{From: "romeo@montague.net/orchard", Type: "chat", Body: "Hello", Replace: &Replace{Id: "bad1"}}
+	if !xmppClient.processStanza(&Event{Stanza, otherCorrection, nil, ""}) || otherCorrection.Unverified {
+		t.Fatal("correction of a reused id dropped")
+	}
+	if !xmppClient.processStanza(&Event{Stanza, correction, nil, ""}) || correction.Unverified {
+		t.Fatal("correction from the first sender dropped")
+	}
+
+	unknown := &Message{From: "mallory@evil.net/x", Type: "chat", Body: "gotcha", Replace: &Replace{Id: "never-received"}}
+	if !xmppClient.processStanza(&Event{Stanza, unknown, nil, ""}) || !unknown.Unverified {
+		t.Fatal("correction of an unknown message not marked unverified")
+	}
+}
@@ -0,0 +1,381 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"regexp"
+	"strconv"
+)
+
+// XEP-0004 Data Forms
+
+const nsDataForm = "jabber:x:data"
+
+// form types
+const (
+	FormTypeForm   = "form"
+	FormTypeSubmit = "submit"
+	FormTypeCancel = "cancel"
+	FormTypeResult = "result"
+)
+
+// field types
+const (
+	FieldBoolean     = "boolean"
+	FieldFixed       = "fixed"
+	FieldHidden      = "hidden"
+	FieldJidMulti    = "jid-multi"
+	FieldJidSingle   = "jid-single"
+	FieldListMulti   = "list-multi"
+	FieldListSingle  = "list-single"
+	FieldTextMulti   = "text-multi"
+	FieldTextPrivate = "text-private"
+	FieldTextSingle  = "text-single"
+)
+
+type DataForm struct {
+	XMLName      xml.Name      `xml:"jabber:x:data x"`
+	Type         string        `xml:"type,attr"` // cancel, form, result, submit
+	Title        string        `xml:"title,omitempty"`
+	Instructions []string      `xml:"instructions,omitempty"`
+	Fields       []*FormField  `xml:"field,omitempty"`
+	Reported     *FormReported `xml:"reported,omitempty"`
+	Items        []*FormItem   `xml:"item,omitempty"`
+}
+
+// FormReported describes the columns of a multi-item result.
+type FormReported struct {
+	Fields []*FormField `xml:"field"`
+}
+
+// FormItem is one row of a multi-item result.
+type FormItem struct {
+	Fields []*FormField `xml:"field"`
+}
+
+type FormField struct {
+	Var      string        `xml:"var,attr,omitempty"`
+	Type     string        `xml:"type,attr,omitempty"`
+	Label    string        `xml:"label,attr,omitempty"`
+	Desc     string        `xml:"desc,omitempty"`
+	Required *struct{}     `xml:"required,omitempty"`
+	Values   []string      `xml:"value,omitempty"`
+	Options  []FormOption  `xml:"option,omitempty"`
+	Validate *FormValidate `xml:"validate,omitempty"`
+	Media    *FormMedia    `xml:"media,omitempty"`
+}
+
+type FormOption struct {
+	Label string `xml:"label,attr,omitempty"`
+	Value string `xml:"value"`
+}
+
+// XEP-0122 Data Forms Validation
+type FormValidate struct {
+	XMLName   xml.Name       `xml:"http://jabber.org/protocol/xdata-validate validate"`
+	Datatype  string         `xml:"datatype,attr,omitempty"` // default xs:string
+	Basic     *struct{}      `xml:"basic,omitempty"`
+	Open      *struct{}      `xml:"open,omitempty"`
+	Range     *FormRange     `xml:"range,omitempty"`
+	Regex     string         `xml:"regex,omitempty"`
+	ListRange *FormListRange `xml:"list-range,omitempty"`
+}
+
+type FormRange struct {
+	Min string `xml:"min,attr,omitempty"`
+	Max string `xml:"max,attr,omitempty"`
+}
+
+type FormListRange struct {
+	Min string `xml:"min,attr,omitempty"`
+	Max string `xml:"max,attr,omitempty"`
+}
+
+// Limits returns the minimum and maximum number of values, 0 if unlimited or invalid.
+func (self *FormListRange) Limits() (min, max int) {
+	min, _ = strconv.Atoi(self.Min)
+	max, _ = strconv.Atoi(self.Max)
+	return min, max
+}
+
+// XEP-0221 Data Forms Media Element
+type FormMedia struct {
+	XMLName xml.Name       `xml:"urn:xmpp:media-element media"`
+	Height  string         `xml:"height,attr,omitempty"`
+	Width   string         `xml:"width,attr,omitempty"`
+	URIs    []FormMediaURI `xml:"uri"`
+}
+
+// Size returns the display size of the media, 0 if unknown.
+func (self *FormMedia) Size() (width, height int) {
+	width, _ = strconv.Atoi(self.Width)
+	height, _ = strconv.Atoi(self.Height)
+	return width, height
+}
+
+type FormMediaURI struct {
+	Type string `xml:"type,attr"`
+	URI  string `xml:",chardata"`
+}
+
+// NewDataForm creates a form of formType (form, submit, result), formNs is
+// added as the hidden FORM_TYPE field unless empty.
+func NewDataForm(formType, formNs string) *DataForm {
+	form := &DataForm{Type: formType}
+	if formNs != "" {
+		form.AddField("FORM_TYPE", FieldHidden, "", formNs)
+	}
+	return form
+}
+
+// CancelForm returns the form cancelling a form workflow.
+func CancelForm() *DataForm {
+	return &DataForm{Type: FormTypeCancel}
+}
+
+// AddField appends a field and returns it for further settings.
+func (self *DataForm) AddField(name, fieldType, label string, values ...string) *FormField {
+	f := &FormField{Var: name, Type: fieldType, Label: label, Values: values}
+	self.Fields = append(self.Fields, f)
+	return f
+}
+
+// Field returns the field named name, or nil.
+func (self *DataForm) Field(name string) *FormField {
+	return findField(self.Fields, name)
+}
+
+// FormType returns the value of the FORM_TYPE field (XEP-0068).
+func (self *DataForm) FormType() string {
+	return self.Value("FORM_TYPE")
+}
+
+// Value returns the first value of the field name.
+func (self *DataForm) Value(name string) string {
+	f := self.Field(name)
+	if f == nil {
+		return ""
+	}
+	return f.Value()
+}
+
+func (self *DataForm) Values(name string) []string {
+	f := self.Field(name)
+	if f == nil {
+		return nil
+	}
+	return f.Values
+}
+
+func (self *DataForm) Bool(name string) (bool, error) {
+	f := self.Field(name)
+	if f == nil {
+		return false, errors.New("No field " + name)
+	}
+	return f.Bool()
+}
+
+func (self *DataForm) Int(name string) (int, error) {
+	f := self.Field(name)
+	if f == nil {
+		return 0, errors.New("No field " + name)
+	}
+	return strconv.Atoi(f.Value())
+}
+
+// Set replaces the values of the field name, adding the field if needed.
+func (self *DataForm) Set(name string, values ...string) {
+	f := self.Field(name)
+	if f == nil {
+		f = self.AddField(name, "", "")
+	}
+	f.Values = values
+}
+
+func (self *DataForm) SetBool(name string, b bool) {
+	if b {
+		self.Set(name, "1")
+	} else {
+		self.Set(name, "0")
+	}
+}
+
+func (self *DataForm) SetInt(name string, i int) {
+	self.Set(name, strconv.Itoa(i))
+}
+
+// Submit returns a form of type submit carrying the values of the form.
+func (self *DataForm) Submit() *DataForm {
+	submit := &DataForm{Type: FormTypeSubmit}
+	for _, f := range self.Fields {
+		if f.Var == "" || f.Type == FieldFixed {
+			continue
+		}
+		submit.Fields = append(submit.Fields, &FormField{Var: f.Var, Values: f.Values})
+	}
+	return submit
+}
+
+// Validate checks the values against the field types, required flags and
+// XEP-0122 validation rules of the form.
+func (self *DataForm) Validate() error {
+	for _, f := range self.Fields {
+		if err := f.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *FormItem) Field(name string) *FormField {
+	return findField(self.Fields, name)
+}
+
+func (self *FormItem) Value(name string) string {
+	f := self.Field(name)
+	if f == nil {
+		return ""
+	}
+	return f.Value()
+}
+
+func findField(fields []*FormField, name string) *FormField {
+	for _, f := range fields {
+		if f.Var == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func (self *FormField) Value() string {
+	if len(self.Values) == 0 {
+		return ""
+	}
+	return self.Values[0]
+}
+
+func (self *FormField) Bool() (bool, error) {
+	switch self.Value() {
+	case "1", "true":
+		return true, nil
+	case "0", "false", "":
+		return false, nil
+	}
+	return false, errors.New("Invalid boolean value of field " + self.Var)
+}
+
+func (self *FormField) IsRequired() bool {
+	return self.Required != nil
+}
+
+func (self *FormField) SetRequired(required bool) *FormField {
+	if required {
+		self.Required = &struct{}{}
+	} else {
+		self.Required = nil
+	}
+	return self
+}
+
+func (self *FormField) AddOption(label, value string) *FormField {
+	self.Options = append(self.Options, FormOption{Label: label, Value: value})
+	return self
+}
+
+func (self *FormField) validate() error {
+	if self.IsRequired() && (len(self.Values) == 0 || self.Values[0] == "") {
+		return errors.New("Field " + self.Var + " is required")
+	}
+	switch self.Type {
+	case FieldBoolean, FieldFixed, FieldHidden, FieldJidSingle, FieldListSingle, FieldTextPrivate, FieldTextSingle:
+		if len(self.Values) > 1 {
+			return errors.New("Field " + self.Var + " has more than one value")
+		}
+	}
+	if self.Type == FieldBoolean {
+		if _, err := self.Bool(); err != nil {
+			return err
+		}
+	}
+	open := self.Validate != nil && self.Validate.Open != nil
+	if (self.Type == FieldListSingle || self.Type == FieldListMulti) && len(self.Options) > 0 && !open {
+		for _, v := range self.Values {
+			found := false
+			for _, o := range self.Options {
+				if o.Value == v {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return errors.New("Value " + v + " is not an option of field " + self.Var)
+			}
+		}
+	}
+	if self.Validate != nil {
+		return self.Validate.check(self.Var, self.Values)
+	}
+	return nil
+}
+
+func (self *FormValidate) check(name string, values []string) error {
+	if self.ListRange != nil {
+		min, max := self.ListRange.Limits()
+		if (min > 0 && len(values) < min) || (max > 0 && len(values) > max) {
+			return errors.New("Number of values of field " + name + " is out of range")
+		}
+	}
+	var re *regexp.Regexp
+	if self.Regex != "" {
+		var err error
+		if re, err = regexp.Compile("^(?:" + self.Regex + ")$"); err != nil {
+			return err
+		}
+	}
+	for _, v := range values {
+		if re != nil && !re.MatchString(v) {
+			return errors.New("Value " + v + " of field " + name + " doesn't match " + self.Regex)
+		}
+		if err := self.checkRange(name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *FormValidate) checkRange(name, v string) error {
+	switch self.Datatype {
+	case "xs:integer", "xs:int", "xs:long", "xs:short", "xs:byte":
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errors.New("Value " + v + " of field " + name + " is not an integer")
+		}
+		if self.Range != nil {
+			if min, err := strconv.ParseInt(self.Range.Min, 10, 64); err == nil && i < min {
+				return errors.New("Value " + v + " of field " + name + " is out of range")
+			}
+			if max, err := strconv.ParseInt(self.Range.Max, 10, 64); err == nil && i > max {
+				return errors.New("Value " + v + " of field " + name + " is out of range")
+			}
+		}
+	case "xs:decimal", "xs:double":
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return errors.New("Value " + v + " of field " + name + " is not a number")
+		}
+		if self.Range != nil {
+			if min, err := strconv.ParseFloat(self.Range.Min, 64); err == nil && f < min {
+				return errors.New("Value " + v + " of field " + name + " is out of range")
+			}
+			if max, err := strconv.ParseFloat(self.Range.Max, 64); err == nil && f > max {
+				return errors.New("Value " + v + " of field " + name + " is out of range")
+			}
+		}
+	case "xs:boolean":
+		if v != "0" && v != "1" && v != "true" && v != "false" {
+			return errors.New("Value " + v + " of field " + name + " is not a boolean")
+		}
+	}
+	return nil
+}
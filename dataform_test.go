@@ -0,0 +1,75 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestDataFormResultItems(t *testing.T) {
+	var form DataForm
+	err := xml.Unmarshal([]byte(`<x xmlns="jabber:x:data" type="result">
+		<title>Bot Configuration</title>
+		<reported><field var="name" label="Name"/><field var="url" label="URL"/></reported>
+		<item><field var="name"><value>Comment Bot</value></field><field var="url"><value>http://example.com/comment</value></field></item>
+		<item><field var="name"><value>News Bot</value></field><field var="url"><value>http://example.com/news</value></field></item>
+		</x>`), &form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.Reported == nil || len(form.Reported.Fields) != 2 {
+		t.Fatalf("reported fields not parsed: %+v", form.Reported)
+	}
+	if len(form.Items) != 2 || form.Items[1].Value("name") != "News Bot" {
+		t.Fatalf("items not parsed: %+v", form.Items)
+	}
+}
+
+func TestDataFormBuildAndValidate(t *testing.T) {
+	form := NewDataForm(FormTypeForm, "urn:example:bot")
+	form.AddField("public", FieldBoolean, "Public bot?").SetRequired(true)
+	form.AddField("features", FieldListMulti, "Features").
+		AddOption("Contests", "contests").
+		AddOption("News", "news")
+	age := form.AddField("maxsubs", FieldTextSingle, "Maximum subscribers", "20")
+	age.Validate = &FormValidate{Datatype: "xs:integer", Range: &FormRange{Min: "1", Max: "100"}}
+
+	if err := form.Validate(); err == nil {
+		t.Fatal("missing required field not detected")
+	}
+	form.SetBool("public", true)
+	form.Set("features", "news", "contests")
+	if err := form.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	form.Set("features", "weather")
+	if err := form.Validate(); err == nil {
+		t.Fatal("value outside options not detected")
+	}
+	form.Set("features", "news")
+	form.SetInt("maxsubs", 500)
+	if err := form.Validate(); err == nil {
+		t.Fatal("value out of range not detected")
+	}
+
+	form.Field("features").Validate = &FormValidate{ListRange: &FormListRange{Max: "1"}}
+	form.Set("features", "news", "contests")
+	if err := form.Validate(); err == nil {
+		t.Fatal("too many values not detected")
+	}
+	form.Set("features", "news")
+
+	form.SetInt("maxsubs", 50)
+	submit := form.Submit()
+	if submit.FormType() != "urn:example:bot" {
+		t.Fatal("FORM_TYPE not submitted")
+	}
+	if b, _ := submit.Bool("public"); !b {
+		t.Fatal("boolean value not submitted")
+	}
+	if i, _ := submit.Int("maxsubs"); i != 50 {
+		t.Fatalf("unexpected int value %d", i)
+	}
+	if CancelForm().Type != FormTypeCancel {
+		t.Fatal("unexpected cancel form")
+	}
+}
@@ -0,0 +1,124 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// XEP-0203 Delayed Delivery
+type Delay struct {
+	XMLName xml.Name `xml:"urn:xmpp:delay delay"`
+	From    string   `xml:"from,attr,omitempty"`
+	Stamp   string   `xml:"stamp,attr"` // XEP-0082 date time, see Time
+	Reason  string   `xml:",chardata"`
+}
+
+// Time parses the stamp, ok is false if it isn't a valid date time.
+func (self *Delay) Time() (stamp time.Time, ok bool) {
+	stamp, err := time.Parse(time.RFC3339, self.Stamp)
+	if err != nil {
+		// the time zone is mandatory, but UTC is meant when missing
+		if stamp, err = time.ParseInLocation("2006-01-02T15:04:05", self.Stamp, time.UTC); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return stamp, true
+}
+
+// XEP-0091 Legacy Delayed Delivery, still sent by some servers
+type LegacyDelay struct {
+	XMLName xml.Name `xml:"jabber:x:delay x"`
+	From    string   `xml:"from,attr,omitempty"`
+	Stamp   string   `xml:"stamp,attr"` // CCYYMMDDThh:mm:ss in UTC
+	Reason  string   `xml:",chardata"`
+}
+
+const legacyDelayLayout = "20060102T15:04:05"
+
+// delayInfo returns the delay of a stanza, invalid stamps are ignored.
+func delayInfo(delay *Delay, legacy *LegacyDelay) (time.Time, string, bool) {
+	if delay != nil {
+		if stamp, ok := delay.Time(); ok {
+			return stamp, delay.From, true
+		}
+	}
+	if legacy != nil {
+		stamp, err := time.ParseInLocation(legacyDelayLayout, legacy.Stamp, time.UTC)
+		if err == nil {
+			return stamp, legacy.From, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// Delayed returns when and by whom (usually our server for offline messages)
+// the message was originally received, ok is false for live messages.
+func (self *Message) Delayed() (stamp time.Time, from string, ok bool) {
+	return delayInfo(self.Delay, self.LegacyDelay)
+}
+
+// Delayed returns when the presence was originally sent, ok is false for live presences.
+func (self *Presence) Delayed() (stamp time.Time, from string, ok bool) {
+	return delayInfo(self.Delay, self.LegacyDelay)
+}
+
+// Timestamp returns the delay stamp of the message, or the current time for live messages.
+func (self *Message) Timestamp() time.Time {
+	if stamp, _, ok := self.Delayed(); ok {
+		return stamp
+	}
+	return time.Now()
+}
+
+func isDelayedChat(event *Event) (bool, bool) {
+	if event.Type != Stanza {
+		return false, false
+	}
+	msg, ok := event.Stanza.(*Message)
+	if !ok || msg.Type != "chat" || len(msg.Body) == 0 || msg.Carbon == "sent" {
+		return false, false
+	}
+	_, _, delayed := msg.Delayed()
+	return true, delayed
+}
+
+// Live chat handler, it receives the chat messages delivered as they are sent.
+type LiveChatHandler struct {
+	DefaultHandler
+}
+
+func NewLiveChatHandler() Handler {
+	h := &LiveChatHandler{}
+	h.EventCh = make(chan *Event)
+	return h
+}
+
+func (self *LiveChatHandler) Filter(event *Event) bool {
+	chat, delayed := isDelayedChat(event)
+	return chat && !delayed
+}
+
+func (self *LiveChatHandler) IsOneTime() bool {
+	return false
+}
+
+// Offline message handler, it receives the delayed chat messages,
+// e.g. the ones stored by the server while we were offline.
+type OfflineMessageHandler struct {
+	DefaultHandler
+}
+
+func NewOfflineMessageHandler() Handler {
+	h := &OfflineMessageHandler{}
+	h.EventCh = make(chan *Event)
+	return h
+}
+
+func (self *OfflineMessageHandler) Filter(event *Event) bool {
+	chat, delayed := isDelayedChat(event)
+	return chat && delayed
+}
+
+func (self *OfflineMessageHandler) IsOneTime() bool {
+	return false
+}
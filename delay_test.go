@@ -0,0 +1,52 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestDelayedMessage(t *testing.T) {
+	var msg Message
+	err := xml.Unmarshal([]byte(`<message xmlns="jabber:client" from="romeo@montague.net/orchard" to="juliet@capulet.com" type="chat">
+		<body>O blessed, blessed night!</body>
+		<delay xmlns="urn:xmpp:delay" from="capulet.com" stamp="2002-09-10T23:08:25.123Z">Offline Storage</delay>
+		</message>`), &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp, from, ok := msg.Delayed()
+	if !ok || from != "capulet.com" || !stamp.Equal(time.Date(2002, 9, 10, 23, 8, 25, 123000000, time.UTC)) {
+		t.Fatalf("unexpected delay: %v %s %v", stamp, from, ok)
+	}
+	event := &Event{Stanza, &msg, nil, ""}
+	if !NewOfflineMessageHandler().Filter(event) || NewLiveChatHandler().Filter(event) {
+		t.Fatal("delayed message must only reach the offline message handler")
+	}
+
+	var presence Presence
+	err = xml.Unmarshal([]byte(`<presence xmlns="jabber:client" from="juliet@capulet.com/balcony">
+		<x xmlns="jabber:x:delay" from="juliet@capulet.com/balcony" stamp="20020910T23:41:07"/></presence>`), &presence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp, _, ok = presence.Delayed()
+	if !ok || !stamp.Equal(time.Date(2002, 9, 10, 23, 41, 7, 0, time.UTC)) {
+		t.Fatalf("unexpected legacy delay: %v %v", stamp, ok)
+	}
+
+	var bad Message
+	err = xml.Unmarshal([]byte(`<message xmlns="jabber:client" from="romeo@montague.net/orchard" type="chat">
+		<body>hi</body><delay xmlns="urn:xmpp:delay" stamp="yesterday"/></message>`), &bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := bad.Delayed(); ok {
+		t.Fatal("invalid stamp treated as delay")
+	}
+
+	live := &Message{Type: "chat", Body: "hi"}
+	if _, _, ok := live.Delayed(); ok || !NewLiveChatHandler().Filter(&Event{Stanza, live, nil, ""}) {
+		t.Fatal("live message must reach the live chat handler")
+	}
+}
@@ -0,0 +1,302 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"sync"
+)
+
+// XEP-0030 Service Discovery
+
+const (
+	nsDiscoInfo  = "http://jabber.org/protocol/disco#info"
+	nsDiscoItems = "http://jabber.org/protocol/disco#items"
+)
+
+type DiscoInfoQuery struct {
+	XMLName    xml.Name        `xml:"http://jabber.org/protocol/disco#info query"`
+	Node       string          `xml:"node,attr,omitempty"`
+	Identities []DiscoIdentity `xml:"identity"`
+	Features   []DiscoFeature  `xml:"feature"`
+	Forms      []*DataForm     `xml:"jabber:x:data x"` // XEP-0128 extended information
+}
+
+type DiscoIdentity struct {
+	Category string `xml:"category,attr"`
+	Type     string `xml:"type,attr"`
+	Name     string `xml:"name,attr,omitempty"`
+	Lang     string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+}
+
+type DiscoFeature struct {
+	Var string `xml:"var,attr"`
+}
+
+type DiscoItemsQuery struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/disco#items query"`
+	Node    string      `xml:"node,attr,omitempty"`
+	Items   []DiscoItem `xml:"item"`
+	Set     *RSMSet
+}
+
+type DiscoItem struct {
+	Jid  string `xml:"jid,attr"`
+	Node string `xml:"node,attr,omitempty"`
+	Name string `xml:"name,attr,omitempty"`
+}
+
+func (self *DiscoInfoQuery) HasFeature(feature string) bool {
+	for _, f := range self.Features {
+		if f.Var == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *DiscoInfoQuery) HasIdentity(category, identityType string) bool {
+	for _, id := range self.Identities {
+		if id.Category == category && (identityType == "" || id.Type == identityType) {
+			return true
+		}
+	}
+	return false
+}
+
+// DiscoNodeHandler answers the disco queries about a node of ours.
+// Returning a nil result answers with item-not-found.
+type DiscoNodeHandler interface {
+	DiscoInfo(from, node string) *DiscoInfoQuery
+	DiscoItems(from, node string) []DiscoItem
+}
+
+type discoState struct {
+	mutex      sync.Mutex
+	identities []DiscoIdentity
+	features   []string
+	forms      []*DataForm
+	items      []DiscoItem
+	nodes      map[string]DiscoNodeHandler
+}
+
+func (self *discoState) init() {
+	self.identities = []DiscoIdentity{{Category: "client", Type: "bot", Name: "go-xmpp"}}
+	self.features = []string{nsDiscoInfo, nsDiscoItems}
+	self.nodes = make(map[string]DiscoNodeHandler)
+}
+
+func (self *discoState) info() *DiscoInfoQuery {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	info := &DiscoInfoQuery{}
+	info.Identities = append(info.Identities, self.identities...)
+	for _, f := range self.features {
+		info.Features = append(info.Features, DiscoFeature{f})
+	}
+	info.Forms = append(info.Forms, self.forms...)
+	return info
+}
+
+// SetIdentity replaces the identities we advertise, by default client/bot.
+func (self *XmppClient) SetIdentity(category, identityType, name string) {
+	self.disco.mutex.Lock()
+	self.disco.identities = []DiscoIdentity{{Category: category, Type: identityType, Name: name}}
+	self.disco.mutex.Unlock()
+	self.discoChanged()
+}
+
+// AddIdentity advertises an additional identity, e.g. one per language.
+func (self *XmppClient) AddIdentity(identity DiscoIdentity) {
+	self.disco.mutex.Lock()
+	self.disco.identities = append(self.disco.identities, identity)
+	self.disco.mutex.Unlock()
+	self.discoChanged()
+}
+
+// AddFeature advertises the features (namespaces) supported by our code.
+func (self *XmppClient) AddFeature(features ...string) {
+	self.disco.mutex.Lock()
+	changed := false
+	for _, feature := range features {
+		found := false
+		for _, f := range self.disco.features {
+			if f == feature {
+				found = true
+				break
+			}
+		}
+		if !found {
+			self.disco.features = append(self.disco.features, feature)
+			changed = true
+		}
+	}
+	self.disco.mutex.Unlock()
+	if changed {
+		self.discoChanged()
+	}
+}
+
+func (self *XmppClient) RemoveFeature(feature string) {
+	self.disco.mutex.Lock()
+	changed := false
+	for i, f := range self.disco.features {
+		if f == feature {
+			self.disco.features = append(self.disco.features[0:i], self.disco.features[i+1:]...)
+			changed = true
+			break
+		}
+	}
+	self.disco.mutex.Unlock()
+	if changed {
+		self.discoChanged()
+	}
+}
+
+// AddDiscoForm advertises extended information (XEP-0128), form must carry a FORM_TYPE.
+func (self *XmppClient) AddDiscoForm(form *DataForm) {
+	self.disco.mutex.Lock()
+	self.disco.forms = append(self.disco.forms, form)
+	self.disco.mutex.Unlock()
+	self.discoChanged()
+}
+
+// AddDiscoItem adds an item answered to disco#items queries without node.
+func (self *XmppClient) AddDiscoItem(item DiscoItem) {
+	self.disco.mutex.Lock()
+	defer self.disco.mutex.Unlock()
+	self.disco.items = append(self.disco.items, item)
+}
+
+// SetDiscoNode lets handler answer the queries about node, a nil handler removes the node.
+func (self *XmppClient) SetDiscoNode(node string, handler DiscoNodeHandler) {
+	self.disco.mutex.Lock()
+	defer self.disco.mutex.Unlock()
+	if handler == nil {
+		delete(self.disco.nodes, node)
+	} else {
+		self.disco.nodes[node] = handler
+	}
+}
+
+// DiscoInfo queries the identities and features of jid, node may be empty.
+func (self *XmppClient) DiscoInfo(jid, node string) (*DiscoInfoQuery, error) {
+	iq := &IQ{
+		To:        jid,
+		Type:      "get",
+		DiscoInfo: &DiscoInfoQuery{Node: node},
+	}
+	resp, err := self.sendIQ(iq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.DiscoInfo == nil {
+		return nil, errors.New("No disco#info from " + jid)
+	}
+	return resp.DiscoInfo, nil
+}
+
+// DiscoItems queries the items of jid, node may be empty.
+func (self *XmppClient) DiscoItems(jid, node string) (*DiscoItemsQuery, error) {
+	iq := &IQ{
+		To:         jid,
+		Type:       "get",
+		DiscoItems: &DiscoItemsQuery{Node: node},
+	}
+	resp, err := self.sendIQ(iq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.DiscoItems == nil {
+		return &DiscoItemsQuery{Node: node}, nil
+	}
+	return resp.DiscoItems, nil
+}
+
+// AllDiscoItems queries the items of jid, following the result set paging of large lists.
+func (self *XmppClient) AllDiscoItems(jid, node string) ([]DiscoItem, error) {
+	pager := self.NewRSMPager(0, func(set *RSMSet) *IQ {
+		query := &DiscoItemsQuery{Node: node}
+		if set.After != "" {
+			query.Set = set
+		}
+		return &IQ{To: jid, Type: "get", DiscoItems: query}
+	}, func(resp *IQ) (*RSMSet, bool) {
+		if resp.DiscoItems == nil {
+			return nil, true
+		}
+		return resp.DiscoItems.Set, false
+	})
+	items := []DiscoItem{}
+	err := pager.ForEach(func(resp *IQ) error {
+		if resp.DiscoItems != nil {
+			items = append(items, resp.DiscoItems.Items...)
+		}
+		return nil
+	})
+	return items, err
+}
+
+func (self *XmppClient) processDisco(event *Event) bool {
+	iq, ok := event.Stanza.(*IQ)
+	if !ok || iq.Type != "get" {
+		return true
+	}
+	switch {
+	case iq.DiscoInfo != nil:
+		node := iq.DiscoInfo.Node
+		if node == "" || self.isCapsNode(node) {
+			info := self.disco.info()
+			info.Node = node
+			self.Send(&IQ{Id: iq.Id, To: iq.From, Type: "result", DiscoInfo: info})
+			return false
+		}
+		go self.answerDiscoNode(iq, func(h DiscoNodeHandler) *IQ {
+			info := h.DiscoInfo(iq.From, node)
+			if info == nil {
+				return nil
+			}
+			info.Node = node
+			return &IQ{Id: iq.Id, To: iq.From, Type: "result", DiscoInfo: info}
+		})
+		return false
+	case iq.DiscoItems != nil:
+		node := iq.DiscoItems.Node
+		if node == "" {
+			self.disco.mutex.Lock()
+			items := append([]DiscoItem{}, self.disco.items...)
+			self.disco.mutex.Unlock()
+			self.Send(&IQ{Id: iq.Id, To: iq.From, Type: "result", DiscoItems: &DiscoItemsQuery{Items: items}})
+			return false
+		}
+		go self.answerDiscoNode(iq, func(h DiscoNodeHandler) *IQ {
+			items := h.DiscoItems(iq.From, node)
+			if items == nil {
+				return nil
+			}
+			return &IQ{Id: iq.Id, To: iq.From, Type: "result", DiscoItems: &DiscoItemsQuery{Node: node, Items: items}}
+		})
+		return false
+	}
+	return true
+}
+
+func (self *XmppClient) answerDiscoNode(iq *IQ, answer func(DiscoNodeHandler) *IQ) {
+	node := ""
+	if iq.DiscoInfo != nil {
+		node = iq.DiscoInfo.Node
+	} else {
+		node = iq.DiscoItems.Node
+	}
+	self.disco.mutex.Lock()
+	handler := self.disco.nodes[node]
+	self.disco.mutex.Unlock()
+	var resp *IQ
+	if handler != nil {
+		resp = answer(handler)
+	}
+	if resp == nil {
+		self.replyIQError(iq, "cancel", "item-not-found")
+		return
+	}
+	self.Send(resp)
+}
@@ -0,0 +1,48 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestDiscoInfoResult(t *testing.T) {
+	var iq IQ
+	err := xml.Unmarshal([]byte(`<iq xmlns="jabber:client" type="result" from="example.com" id="d1">
+		<query xmlns="http://jabber.org/protocol/disco#info">
+		<identity category="server" type="im" name="Prosody"/>
+		<identity category="pubsub" type="pep"/>
+		<feature var="http://jabber.org/protocol/disco#info"/>
+		<feature var="urn:xmpp:carbons:2"/>
+		<x xmlns="jabber:x:data" type="result"><field var="FORM_TYPE" type="hidden"><value>http://jabber.org/network/serverinfo</value></field></x>
+		</query></iq>`), &iq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := iq.DiscoInfo
+	if info == nil {
+		t.Fatal("disco#info not parsed")
+	}
+	if !info.HasIdentity("pubsub", "pep") || !info.HasFeature("urn:xmpp:carbons:2") {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+	if len(info.Forms) != 1 || info.Forms[0].FormType() != "http://jabber.org/network/serverinfo" {
+		t.Fatalf("extended info not parsed: %+v", info.Forms)
+	}
+}
+
+func TestDiscoRegistry(t *testing.T) {
+	xmppClient := NewXmppClient(ClientConfig{})
+	xmppClient.SetIdentity("client", "bot", "opsbot")
+	xmppClient.AddFeature("urn:xmpp:ping", "urn:xmpp:ping")
+	info := xmppClient.disco.info()
+	if !info.HasIdentity("client", "bot") || !info.HasFeature(nsDiscoInfo) || !info.HasFeature("urn:xmpp:ping") {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+	if len(info.Features) != 12 {
+		t.Fatalf("features are not unique: %+v", info.Features)
+	}
+	xmppClient.RemoveFeature("urn:xmpp:ping")
+	if xmppClient.disco.info().HasFeature("urn:xmpp:ping") {
+		t.Fatal("feature not removed")
+	}
+}
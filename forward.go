@@ -0,0 +1,12 @@
+package xmpp
+
+import (
+	"encoding/xml"
+)
+
+// XEP-0297 Stanza Forwarding
+type Forwarded struct {
+	XMLName xml.Name `xml:"urn:xmpp:forward:0 forwarded"`
+	Delay   *Delay
+	Message *Message
+}
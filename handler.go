@@ -51,7 +51,8 @@ func (self *ChatHandler) Filter(event *Event) bool {
 		if stanza != nil {
 			switch stanza := stanza.(type) {
 			case *Message:
-				return stanza.Type == "chat" && len(stanza.Body) > 0
+				// sent carbons are our own messages
+				return stanza.Type == "chat" && len(stanza.Body) > 0 && stanza.Carbon != "sent"
 			}
 		}
 	}
@@ -97,7 +98,8 @@ type IqIDHandler struct {
 
 func NewIqIDHandler(iqId string) Handler {
 	iqH := &IqIDHandler{}
-	iqH.EventCh = make(chan *Event)
+	// buffered, so that a response arriving after GetEvent timed out doesn't block the receiver
+	iqH.EventCh = make(chan *Event, 1)
 	iqH.iqId = iqId
 	return iqH
 }
@@ -0,0 +1,63 @@
+package xmpp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"hash"
+	"io"
+)
+
+// XEP-0300 Use of Cryptographic Hash Functions in XMPP
+
+const nsHashes = "urn:xmpp:hashes:2"
+
+type Hash struct {
+	XMLName xml.Name `xml:"urn:xmpp:hashes:2 hash"`
+	Algo    string   `xml:"algo,attr"`
+	Value   string   `xml:",chardata"` // base64
+}
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha-1":   sha1.New, // only to verify legacy hashes
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// hash algorithms we prefer, strongest first
+var preferredHashes = []string{"sha-512", "sha-256", "sha-1"}
+
+// ComputeHash hashes all the data of r with algo, e.g. "sha-256".
+func ComputeHash(algo string, r io.Reader) (*Hash, error) {
+	newHash, ok := hashAlgorithms[algo]
+	if !ok {
+		return nil, errors.New("Unsupported hash algorithm " + algo)
+	}
+	h := newHash()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return &Hash{Algo: algo, Value: base64.StdEncoding.EncodeToString(h.Sum(nil))}, nil
+}
+
+// Matches reports whether sum, computed with the algorithm of the hash, equals its value.
+func (self *Hash) Matches(sum []byte) bool {
+	value, err := base64.StdEncoding.DecodeString(self.Value)
+	return err == nil && bytes.Equal(value, sum)
+}
+
+// strongestHash returns the hash of hashes with the best supported algorithm, or nil.
+func strongestHash(hashes []Hash) *Hash {
+	for _, algo := range preferredHashes {
+		for i := range hashes {
+			if hashes[i].Algo == algo {
+				return &hashes[i]
+			}
+		}
+	}
+	return nil
+}
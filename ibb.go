@@ -0,0 +1,517 @@
+package xmpp
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// XEP-0047 In-Band Bytestreams
+
+const nsIBB = "http://jabber.org/protocol/ibb"
+
+const (
+	DefaultIBBBlockSize = 4096
+	MaxIBBBlockSize     = 65535
+	minIBBBlockSize     = 256
+	// received bytes buffered before the acks are held back
+	ibbWindow = 64 * 1024
+)
+
+type IBBOpen struct {
+	XMLName   xml.Name `xml:"http://jabber.org/protocol/ibb open"`
+	BlockSize string   `xml:"block-size,attr"`
+	Sid       string   `xml:"sid,attr"`
+	Stanza    string   `xml:"stanza,attr,omitempty"` // iq by default, message is not supported
+}
+
+// Size returns the block size, ok is false if it is invalid.
+func (self *IBBOpen) Size() (int, bool) {
+	return parseBlockSize(self.BlockSize)
+}
+
+func parseBlockSize(s string) (int, bool) {
+	size, err := strconv.Atoi(s)
+	if err != nil || size <= 0 || size > MaxIBBBlockSize {
+		return 0, false
+	}
+	return size, true
+}
+
+type IBBData struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/ibb data"`
+	Seq     string   `xml:"seq,attr"`
+	Sid     string   `xml:"sid,attr"`
+	Data    string   `xml:",chardata"`
+}
+
+// Sequence returns the sequence number, ok is false if it is invalid.
+func (self *IBBData) Sequence() (uint16, bool) {
+	seq, err := strconv.ParseUint(self.Seq, 10, 16)
+	return uint16(seq), err == nil
+}
+
+type IBBClose struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/ibb close"`
+	Sid     string   `xml:"sid,attr"`
+}
+
+// BytestreamAddr is the address of an end of a bytestream.
+type BytestreamAddr struct {
+	Net string
+	Jid string
+	Sid string
+}
+
+func (self *BytestreamAddr) Network() string {
+	return self.Net
+}
+
+func (self *BytestreamAddr) String() string {
+	return self.Jid + "#" + self.Sid
+}
+
+// IBBConn is an in-band bytestream session with a peer.
+type IBBConn struct {
+	client    *XmppClient
+	peer      string
+	sid       string
+	blockSize int
+
+	mutex         sync.Mutex
+	cond          *sync.Cond
+	buf           []byte
+	recvSeq       uint16
+	pendingAck    *IQ
+	closed        bool
+	remoteClosed  bool
+	done          chan struct{} // closed when the session ends
+	readDeadline  time.Time
+	readTimer     *time.Timer
+	writeMutex    sync.Mutex
+	sendSeq       uint16
+	writeDeadline time.Time
+}
+
+func newIBBConn(client *XmppClient, peer, sid string, blockSize int) *IBBConn {
+	conn := &IBBConn{client: client, peer: peer, sid: sid, blockSize: blockSize, done: make(chan struct{})}
+	conn.cond = sync.NewCond(&conn.mutex)
+	return conn
+}
+
+func (self *IBBConn) Sid() string {
+	return self.sid
+}
+
+func (self *IBBConn) BlockSize() int {
+	return self.blockSize
+}
+
+func (self *IBBConn) Read(b []byte) (int, error) {
+	self.mutex.Lock()
+	for len(self.buf) == 0 {
+		if self.closed {
+			self.mutex.Unlock()
+			return 0, net.ErrClosed
+		}
+		if self.remoteClosed {
+			self.mutex.Unlock()
+			return 0, io.EOF
+		}
+		if !self.readDeadline.IsZero() && !time.Now().Before(self.readDeadline) {
+			self.mutex.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		self.cond.Wait()
+	}
+	n := copy(b, self.buf)
+	self.buf = self.buf[n:]
+	var ack *IQ
+	if self.pendingAck != nil && len(self.buf) < ibbWindow {
+		ack, self.pendingAck = self.pendingAck, nil
+	}
+	self.mutex.Unlock()
+	if ack != nil {
+		self.client.Send(ack)
+	}
+	return n, nil
+}
+
+// Write sends b in blocks, each block waits for the ack of the peer until the
+// write deadline or the end of the session. A block which fails closes the session.
+func (self *IBBConn) Write(b []byte) (int, error) {
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+	written := 0
+	for written < len(b) {
+		self.mutex.Lock()
+		closed, remoteClosed, deadline := self.closed, self.remoteClosed, self.writeDeadline
+		self.mutex.Unlock()
+		if closed {
+			return written, net.ErrClosed
+		}
+		if remoteClosed {
+			return written, io.ErrClosedPipe
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+		end := written + self.blockSize
+		if end > len(b) {
+			end = len(b)
+		}
+		iq := &IQ{
+			To:   self.peer,
+			Type: "set",
+			IBBData: &IBBData{
+				Seq:  strconv.Itoa(int(self.sendSeq)),
+				Sid:  self.sid,
+				Data: base64.StdEncoding.EncodeToString(b[written:end]),
+			},
+		}
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		_, err := self.client.sendIQUntil(iq, timeout, self.done)
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			self.mutex.Lock()
+			closed, remoteClosed := self.closed, self.remoteClosed
+			self.mutex.Unlock()
+			switch {
+			case closed:
+				return written, net.ErrClosed
+			case remoteClosed:
+				return written, io.ErrClosedPipe
+			}
+			self.fail()
+			if _, ok := err.(*Error); !ok && !deadline.IsZero() && !time.Now().Before(deadline) {
+				err = os.ErrDeadlineExceeded
+			}
+			return written, err
+		}
+		self.sendSeq++
+		written = end
+	}
+	return written, nil
+}
+
+// Close closes the session, telling the peer unless it closed it first.
+func (self *IBBConn) Close() error {
+	if notify, ok := self.shutdown(); ok && notify {
+		_, err := self.client.sendIQ(&IQ{To: self.peer, Type: "set", IBBClose: &IBBClose{Sid: self.sid}})
+		if xmppErr, ok := err.(*Error); ok && xmppErr.Condition() == "item-not-found" {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// shutdown marks the session closed by us, ok is false if it already was and
+// notify is false if the peer closed it first.
+func (self *IBBConn) shutdown() (notify, ok bool) {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return false, false
+	}
+	notify = !self.remoteClosed
+	if notify {
+		close(self.done)
+	}
+	self.closed = true
+	if self.readTimer != nil {
+		self.readTimer.Stop()
+	}
+	self.cond.Broadcast()
+	self.mutex.Unlock()
+	self.client.ibb.remove(self)
+	return notify, true
+}
+
+// fail closes the session after a failed block, telling the peer without waiting for its answer.
+func (self *IBBConn) fail() {
+	if notify, ok := self.shutdown(); ok && notify {
+		self.client.Send(&IQ{Id: RandomString(10), To: self.peer, Type: "set", IBBClose: &IBBClose{Sid: self.sid}})
+	}
+}
+
+// abort ends the session closed by the peer.
+func (self *IBBConn) abort() {
+	self.mutex.Lock()
+	if !self.closed && !self.remoteClosed {
+		close(self.done)
+	}
+	self.remoteClosed = true
+	self.cond.Broadcast()
+	self.mutex.Unlock()
+	self.client.ibb.remove(self)
+}
+
+func (self *IBBConn) LocalAddr() net.Addr {
+	return &BytestreamAddr{"xmpp-ibb", self.client.jid, self.sid}
+}
+
+func (self *IBBConn) RemoteAddr() net.Addr {
+	return &BytestreamAddr{"xmpp-ibb", self.peer, self.sid}
+}
+
+func (self *IBBConn) SetDeadline(t time.Time) error {
+	self.SetReadDeadline(t)
+	return self.SetWriteDeadline(t)
+}
+
+func (self *IBBConn) SetReadDeadline(t time.Time) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.readDeadline = t
+	if self.readTimer != nil {
+		self.readTimer.Stop()
+		self.readTimer = nil
+	}
+	if !t.IsZero() {
+		self.readTimer = time.AfterFunc(time.Until(t), func() {
+			self.mutex.Lock()
+			self.cond.Broadcast()
+			self.mutex.Unlock()
+		})
+	}
+	self.cond.Broadcast()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of Write, a block in flight keeps the deadline it was sent with.
+func (self *IBBConn) SetWriteDeadline(t time.Time) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.writeDeadline = t
+	return nil
+}
+
+// receive queues the data of iq, it returns the ack or nil if it's held back.
+func (self *IBBConn) receive(iq *IQ, data []byte) *IQ {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.buf = append(self.buf, data...)
+	self.recvSeq++
+	self.cond.Broadcast()
+	ack := &IQ{Id: iq.Id, To: iq.From, Type: "result"}
+	if len(self.buf) >= ibbWindow {
+		self.pendingAck = ack
+		return nil
+	}
+	return ack
+}
+
+type ibbState struct {
+	mutex        sync.Mutex
+	sessions     map[string]*IBBConn
+	expected     map[string]chan *IBBConn
+	accept       func(from, sid string) bool
+	maxBlockSize int
+}
+
+func (self *ibbState) init() {
+	self.sessions = make(map[string]*IBBConn)
+	self.expected = make(map[string]chan *IBBConn)
+	self.maxBlockSize = MaxIBBBlockSize
+}
+
+func ibbKey(peer, sid string) string {
+	return strings.ToLower(peer) + " " + sid
+}
+
+func (self *ibbState) session(peer, sid string) *IBBConn {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.sessions[ibbKey(peer, sid)]
+}
+
+func (self *ibbState) remove(conn *IBBConn) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	key := ibbKey(conn.peer, conn.sid)
+	if self.sessions[key] == conn {
+		delete(self.sessions, key)
+	}
+}
+
+// expect reserves the session sid opened by peer, e.g. negotiated by another
+// protocol, it's delivered on the returned channel instead of the handlers.
+func (self *ibbState) expect(peer, sid string) chan *IBBConn {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	ch := make(chan *IBBConn, 1)
+	self.expected[ibbKey(peer, sid)] = ch
+	return ch
+}
+
+func (self *ibbState) unexpect(peer, sid string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.expected, ibbKey(peer, sid))
+}
+
+// AcceptIBB sets which sessions opened by peers are accepted, they are delivered
+// to the bytestream handlers. By default the sessions are refused.
+func (self *XmppClient) AcceptIBB(accept func(from, sid string) bool) {
+	self.ibb.mutex.Lock()
+	defer self.ibb.mutex.Unlock()
+	self.ibb.accept = accept
+}
+
+// SetIBBMaxBlockSize sets the largest block size accepted from peers.
+func (self *XmppClient) SetIBBMaxBlockSize(size int) {
+	self.ibb.mutex.Lock()
+	defer self.ibb.mutex.Unlock()
+	self.ibb.maxBlockSize = size
+}
+
+// OpenIBB opens an in-band bytestream with the full jid, an empty sid is generated.
+// If the peer wants smaller blocks, blockSize is halved until it's accepted.
+func (self *XmppClient) OpenIBB(jid, sid string, blockSize int) (*IBBConn, error) {
+	if sid == "" {
+		sid = RandomString(16)
+	}
+	if blockSize <= 0 {
+		blockSize = DefaultIBBBlockSize
+	}
+	key := ibbKey(jid, sid)
+	for {
+		conn := newIBBConn(self, jid, sid, blockSize)
+		self.ibb.mutex.Lock()
+		if _, exists := self.ibb.sessions[key]; exists {
+			self.ibb.mutex.Unlock()
+			return nil, errors.New("IBB session already open: " + sid)
+		}
+		self.ibb.sessions[key] = conn
+		self.ibb.mutex.Unlock()
+
+		_, err := self.sendIQ(&IQ{To: jid, Type: "set", IBBOpen: &IBBOpen{BlockSize: strconv.Itoa(blockSize), Sid: sid, Stanza: "iq"}})
+		if err == nil {
+			return conn, nil
+		}
+		self.ibb.remove(conn)
+		if xmppErr, ok := err.(*Error); ok && xmppErr.Condition() == "resource-constraint" && blockSize/2 >= minIBBBlockSize {
+			blockSize /= 2
+			continue
+		}
+		return nil, err
+	}
+}
+
+func (self *XmppClient) processIBB(event *Event) bool {
+	iq, ok := event.Stanza.(*IQ)
+	if !ok || iq.Type != "set" {
+		return true
+	}
+	switch {
+	case iq.IBBOpen != nil:
+		self.openIBB(iq)
+	case iq.IBBData != nil:
+		conn := self.ibb.session(iq.From, iq.IBBData.Sid)
+		if conn == nil {
+			self.replyIQError(iq, "cancel", "item-not-found")
+			return false
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(iq.IBBData.Data))
+		seq, validSeq := iq.IBBData.Sequence()
+		if err != nil || len(data) > conn.blockSize || !validSeq {
+			self.replyIQError(iq, "modify", "bad-request")
+			go conn.Close()
+			return false
+		}
+		conn.mutex.Lock()
+		expected := conn.recvSeq
+		conn.mutex.Unlock()
+		if seq != expected {
+			self.replyIQError(iq, "cancel", "unexpected-request")
+			go conn.Close()
+			return false
+		}
+		if ack := conn.receive(iq, data); ack != nil {
+			self.Send(ack)
+		}
+	case iq.IBBClose != nil:
+		conn := self.ibb.session(iq.From, iq.IBBClose.Sid)
+		if conn == nil {
+			self.replyIQError(iq, "cancel", "item-not-found")
+			return false
+		}
+		conn.abort()
+		self.Send(&IQ{Id: iq.Id, To: iq.From, Type: "result"})
+	default:
+		return true
+	}
+	return false
+}
+
+func (self *XmppClient) openIBB(iq *IQ) {
+	open := iq.IBBOpen
+	key := ibbKey(iq.From, open.Sid)
+	self.ibb.mutex.Lock()
+	expected, isExpected := self.ibb.expected[key]
+	_, exists := self.ibb.sessions[key]
+	accept, maxBlockSize := self.ibb.accept, self.ibb.maxBlockSize
+	self.ibb.mutex.Unlock()
+	blockSize, validSize := open.Size()
+
+	switch {
+	case open.Stanza != "" && open.Stanza != "iq":
+		self.replyIQError(iq, "cancel", "feature-not-implemented")
+		return
+	case open.Sid == "" || !validSize || exists:
+		self.replyIQError(iq, "modify", "bad-request")
+		return
+	case blockSize > maxBlockSize:
+		self.replyIQError(iq, "modify", "resource-constraint")
+		return
+	case !isExpected && (accept == nil || !accept(iq.From, open.Sid)):
+		self.replyIQError(iq, "cancel", "not-acceptable")
+		return
+	}
+
+	conn := newIBBConn(self, iq.From, open.Sid, blockSize)
+	self.ibb.mutex.Lock()
+	self.ibb.sessions[key] = conn
+	delete(self.ibb.expected, key)
+	self.ibb.mutex.Unlock()
+	self.Send(&IQ{Id: iq.Id, To: iq.From, Type: "result"})
+	if isExpected {
+		expected <- conn
+	} else {
+		go self.fireHandler(&Event{Bytestream, conn, nil, ""})
+	}
+}
+
+// Bytestream handler, it receives the accepted incoming bytestreams.
+type BytestreamHandler struct {
+	DefaultHandler
+}
+
+func NewBytestreamHandler() Handler {
+	h := &BytestreamHandler{}
+	h.EventCh = make(chan *Event)
+	return h
+}
+
+func (self *BytestreamHandler) Filter(event *Event) bool {
+	return event.Type == Bytestream
+}
+
+func (self *BytestreamHandler) IsOneTime() bool {
+	return false
+}
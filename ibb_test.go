@@ -0,0 +1,158 @@
+package xmpp
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIBBSession(t *testing.T) {
+	server := newTestServer("example.com")
+	alice := server.connect("alice@example.com/a")
+	defer alice.Disconnect()
+	bob := server.connect("bob@example.com/b")
+	defer bob.Disconnect()
+
+	if _, err := alice.OpenIBB("bob@example.com/b", "", 0); err == nil {
+		t.Fatal("session opened without acceptor")
+	}
+
+	bob.SetIBBMaxBlockSize(2048)
+	bob.AcceptIBB(func(from, sid string) bool {
+		return from == "alice@example.com/a"
+	})
+	streamHandler := NewBytestreamHandler()
+	bob.AddHandler(streamHandler)
+
+	conn, err := alice.OpenIBB("bob@example.com/b", "s1", 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.BlockSize() != 2048 {
+		t.Fatalf("block size not negotiated: %d", conn.BlockSize())
+	}
+	event := streamHandler.GetEvent(time.Second)
+	if event == nil {
+		t.Fatal("no incoming session")
+	}
+	incoming := event.Stanza.(*IBBConn)
+	if incoming.Sid() != "s1" || incoming.RemoteAddr().String() != "alice@example.com/a#s1" {
+		t.Fatalf("unexpected session %v", incoming.RemoteAddr())
+	}
+
+	// more than the window, the acks are held back until bob reads
+	data := make([]byte, ibbWindow+10000)
+	rand.Read(data)
+	go func() {
+		if _, err := conn.Write(data); err != nil {
+			t.Error(err)
+		}
+		conn.Close()
+	}()
+	received, err := io.ReadAll(incoming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("received %d bytes, sent %d", len(received), len(data))
+	}
+
+	incoming.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := incoming.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("closed session read: %v", err)
+	}
+}
+
+func TestIBBSequence(t *testing.T) {
+	server := newTestServer("example.com")
+	alice := server.connect("alice@example.com/a")
+	defer alice.Disconnect()
+	bob := server.connect("bob@example.com/b")
+	defer bob.Disconnect()
+	bob.AcceptIBB(func(from, sid string) bool { return true })
+
+	conn, err := alice.OpenIBB("bob@example.com/b", "s2", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.sendSeq = 5
+	if _, err := conn.Write([]byte("out of order")); err == nil {
+		t.Fatal("unexpected sequence accepted")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != net.ErrClosed && err != io.EOF {
+		t.Fatalf("failed session read: %v", err)
+	}
+}
+
+func TestIBBWriteWaitsForAcks(t *testing.T) {
+	server := newTestServer("example.com")
+	alice := server.connect("alice@example.com/a")
+	defer alice.Disconnect()
+	bob := server.connect("bob@example.com/b")
+	defer bob.Disconnect()
+	bob.AcceptIBB(func(from, sid string) bool { return true })
+	streamHandler := NewBytestreamHandler()
+	bob.AddHandler(streamHandler)
+
+	conn, err := alice.OpenIBB("bob@example.com/b", "s4", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := streamHandler.GetEvent(time.Second)
+	if event == nil {
+		t.Fatal("no incoming session")
+	}
+	incoming := event.Stanza.(*IBBConn)
+
+	// bob doesn't read, so the acks are held back once the window is full
+	data := make([]byte, 2*ibbWindow)
+	conn.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := conn.Write(data)
+	if err != os.ErrDeadlineExceeded || n < ibbWindow-DefaultIBBBlockSize || n == len(data) {
+		t.Fatalf("unexpected write result %d, %v", n, err)
+	}
+	received, err := io.ReadAll(incoming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) < n {
+		t.Fatalf("received %d bytes, %d acked", len(received), n)
+	}
+
+	// closing the session ends a write waiting without deadline
+	conn, err = alice.OpenIBB("bob@example.com/b", "s5", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamHandler.GetEvent(time.Second)
+	time.AfterFunc(100*time.Millisecond, func() { conn.Close() })
+	if _, err := conn.Write(data); err != net.ErrClosed {
+		t.Fatalf("write on closed session: %v", err)
+	}
+}
+
+func TestIBBInvalidAttributes(t *testing.T) {
+	server := newTestServer("example.com")
+	alice := server.connect("alice@example.com/a")
+	defer alice.Disconnect()
+	bob := server.connect("bob@example.com/b")
+	defer bob.Disconnect()
+	bob.AcceptIBB(func(from, sid string) bool { return true })
+
+	_, err := alice.sendIQ(&IQ{To: "bob@example.com/b", Type: "set", IBBOpen: &IBBOpen{BlockSize: "big", Sid: "s3"}})
+	if xmppErr, ok := err.(*Error); !ok || xmppErr.Condition() != "bad-request" {
+		t.Fatal("expected bad-request for an invalid block size, got", err)
+	}
+	if _, err := alice.OpenIBB("bob@example.com/b", "s3", 0); err != nil {
+		t.Fatal(err)
+	}
+	_, err = alice.sendIQ(&IQ{To: "bob@example.com/b", Type: "set", IBBData: &IBBData{Seq: "-1", Sid: "s3"}})
+	if xmppErr, ok := err.(*Error); !ok || xmppErr.Condition() != "bad-request" {
+		t.Fatal("expected bad-request for an invalid sequence, got", err)
+	}
+}
@@ -0,0 +1,319 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// XEP-0166 Jingle
+
+const nsJingle = "urn:xmpp:jingle:1"
+
+const (
+	JingleSessionInitiate  = "session-initiate"
+	JingleSessionAccept    = "session-accept"
+	JingleSessionInfo      = "session-info"
+	JingleSessionTerminate = "session-terminate"
+	JingleTransportInfo    = "transport-info"
+	JingleTransportReplace = "transport-replace"
+	JingleTransportAccept  = "transport-accept"
+	JingleTransportReject  = "transport-reject"
+)
+
+type JingleState int
+
+const (
+	JinglePending = JingleState(0)
+	JingleActive  = JingleState(1)
+	JingleEnded   = JingleState(2)
+)
+
+type Jingle struct {
+	XMLName   xml.Name        `xml:"urn:xmpp:jingle:1 jingle"`
+	Action    string          `xml:"action,attr"`
+	Initiator string          `xml:"initiator,attr,omitempty"`
+	Responder string          `xml:"responder,attr,omitempty"`
+	Sid       string          `xml:"sid,attr"`
+	Contents  []JingleContent `xml:"content"`
+	Reason    *JingleReason
+}
+
+type JingleContent struct {
+	Creator      string `xml:"creator,attr"`
+	Name         string `xml:"name,attr"`
+	Senders      string `xml:"senders,attr,omitempty"`
+	Description  *JingleFileDescription
+	IBBTransport *JingleIBBTransport
+	S5BTransport *JingleS5BTransport
+}
+
+type JingleReason struct {
+	XMLName xml.Name        `xml:"urn:xmpp:jingle:1 reason"`
+	Cond    JingleCondition `xml:",any"`
+	Text    string          `xml:"text,omitempty"`
+}
+
+type JingleCondition struct {
+	XMLName xml.Name
+}
+
+func NewJingleReason(condition, text string) *JingleReason {
+	return &JingleReason{Cond: JingleCondition{xml.Name{Space: nsJingle, Local: condition}}, Text: text}
+}
+
+// Condition returns the reason condition, e.g. "success" or "decline".
+func (self *JingleReason) Condition() string {
+	return self.Cond.XMLName.Local
+}
+
+// JingleSession is a Jingle session with a peer.
+type JingleSession struct {
+	client    *XmppClient
+	Sid       string
+	Initiator string
+	Responder string
+	Peer      string
+	Contents  []JingleContent // as initiated
+
+	mutex   sync.Mutex
+	state   JingleState
+	reason  *JingleReason
+	actions chan *Jingle
+	ended   chan int
+}
+
+func newJingleSession(client *XmppClient, sid, initiator, responder, peer string) *JingleSession {
+	return &JingleSession{
+		client:    client,
+		Sid:       sid,
+		Initiator: initiator,
+		Responder: responder,
+		Peer:      peer,
+		actions:   make(chan *Jingle, 16),
+		ended:     make(chan int),
+	}
+}
+
+func (self *JingleSession) State() JingleState {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.state
+}
+
+// Reason returns the reason the session was terminated with, nil while it's not ended.
+func (self *JingleSession) Reason() *JingleReason {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.reason
+}
+
+// Done is closed when the session is terminated.
+func (self *JingleSession) Done() <-chan int {
+	return self.ended
+}
+
+func (self *JingleSession) isInitiator() bool {
+	return self.Initiator == self.client.client.jid
+}
+
+// send sends a jingle action of the session and waits for its ack.
+func (self *JingleSession) send(action string, contents []JingleContent, reason *JingleReason) error {
+	jingle := &Jingle{Action: action, Sid: self.Sid, Contents: contents, Reason: reason}
+	switch action {
+	case JingleSessionInitiate:
+		jingle.Initiator = self.Initiator
+	case JingleSessionAccept:
+		jingle.Responder = self.Responder
+	}
+	_, err := self.client.sendIQ(&IQ{To: self.Peer, Type: "set", Jingle: jingle})
+	return err
+}
+
+// Accept accepts the session initiated by the peer with contents.
+func (self *JingleSession) Accept(contents []JingleContent) error {
+	self.mutex.Lock()
+	if self.state != JinglePending || self.isInitiator() {
+		self.mutex.Unlock()
+		return errors.New("Jingle session can't be accepted: " + self.Sid)
+	}
+	self.state = JingleActive
+	self.mutex.Unlock()
+	return self.send(JingleSessionAccept, contents, nil)
+}
+
+// Terminate ends the session with a reason condition, e.g. "success", "decline" or "cancel".
+func (self *JingleSession) Terminate(condition, text string) error {
+	reason := NewJingleReason(condition, text)
+	if !self.end(reason) {
+		return nil
+	}
+	return self.send(JingleSessionTerminate, nil, reason)
+}
+
+// end moves the session to the ended state, it returns false if it was already ended.
+func (self *JingleSession) end(reason *JingleReason) bool {
+	self.mutex.Lock()
+	if self.state == JingleEnded {
+		self.mutex.Unlock()
+		return false
+	}
+	self.state = JingleEnded
+	self.reason = reason
+	close(self.ended)
+	self.mutex.Unlock()
+	self.client.jingle.remove(self)
+	return true
+}
+
+// waitAction returns the next action of the peer matching accept, the other
+// actions are discarded.
+func (self *JingleSession) waitAction(timeout time.Duration, accept func(*Jingle) bool) (*Jingle, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case jingle := <-self.actions:
+			if accept(jingle) {
+				return jingle, nil
+			}
+		case <-self.ended:
+			reason := self.Reason()
+			if reason == nil {
+				return nil, errors.New("Jingle session terminated")
+			}
+			return nil, errors.New("Jingle session terminated: " + reason.Condition())
+		case <-timer.C:
+			return nil, errors.New("Jingle session timeout: " + self.Sid)
+		}
+	}
+}
+
+type jingleState struct {
+	mutex    sync.Mutex
+	sessions map[string]*JingleSession
+	// initiate handles the session-initiate of a new session, it returns the
+	// reason to terminate it with, or nil if the session is handled.
+	initiate func(session *JingleSession) *JingleReason
+}
+
+func (self *jingleState) init() {
+	self.sessions = make(map[string]*JingleSession)
+}
+
+func jingleKey(peer, sid string) string {
+	return strings.ToLower(peer) + " " + sid
+}
+
+func (self *jingleState) add(session *JingleSession) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	key := jingleKey(session.Peer, session.Sid)
+	if _, exists := self.sessions[key]; exists {
+		return false
+	}
+	self.sessions[key] = session
+	return true
+}
+
+func (self *jingleState) remove(session *JingleSession) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	key := jingleKey(session.Peer, session.Sid)
+	if self.sessions[key] == session {
+		delete(self.sessions, key)
+	}
+}
+
+// initiateJingle starts a session with the full jid, the peer's actions are
+// queued on the session.
+func (self *XmppClient) initiateJingle(jid string, contents []JingleContent) (*JingleSession, error) {
+	session := newJingleSession(self, RandomString(16), self.client.jid, jid, jid)
+	session.Contents = contents
+	if !self.jingle.add(session) {
+		return nil, errors.New("Jingle session already exists")
+	}
+	if err := session.send(JingleSessionInitiate, contents, nil); err != nil {
+		session.end(NewJingleReason("connectivity-error", err.Error()))
+		return nil, err
+	}
+	return session, nil
+}
+
+func (self *XmppClient) processJingle(event *Event) bool {
+	iq, ok := event.Stanza.(*IQ)
+	if !ok || iq.Type != "set" || iq.Jingle == nil {
+		return true
+	}
+	jingle := iq.Jingle
+	if jingle.Action == JingleSessionInitiate {
+		// the initiator can't initiate on behalf of another entity
+		if jingle.Initiator != "" && !strings.EqualFold(jingle.Initiator, iq.From) {
+			self.replyIQError(iq, "modify", "bad-request")
+			return false
+		}
+		session := newJingleSession(self, jingle.Sid, iq.From, self.client.jid, iq.From)
+		session.Contents = jingle.Contents
+		if jingle.Sid == "" || len(jingle.Contents) == 0 || !self.jingle.add(session) {
+			self.replyIQError(iq, "modify", "bad-request")
+			return false
+		}
+		self.Send(&IQ{Id: iq.Id, To: iq.From, Type: "result"})
+		self.jingle.mutex.Lock()
+		initiate := self.jingle.initiate
+		self.jingle.mutex.Unlock()
+		go func() {
+			reason := NewJingleReason("unsupported-applications", "")
+			if initiate != nil {
+				reason = initiate(session)
+			}
+			if reason != nil {
+				session.Terminate(reason.Condition(), reason.Text)
+			}
+		}()
+		return false
+	}
+
+	self.jingle.mutex.Lock()
+	session := self.jingle.sessions[jingleKey(iq.From, jingle.Sid)]
+	self.jingle.mutex.Unlock()
+	if session == nil {
+		self.replyIQError(iq, "cancel", "item-not-found")
+		return false
+	}
+	session.mutex.Lock()
+	state := session.state
+	valid := state != JingleEnded
+	if jingle.Action == JingleSessionAccept {
+		valid = state == JinglePending && session.isInitiator()
+		if valid {
+			session.state = JingleActive
+		}
+	}
+	session.mutex.Unlock()
+	if !valid {
+		self.replyIQError(iq, "cancel", "unexpected-request")
+		return false
+	}
+	self.Send(&IQ{Id: iq.Id, To: iq.From, Type: "result"})
+
+	switch jingle.Action {
+	case JingleSessionTerminate:
+		reason := jingle.Reason
+		if reason == nil {
+			reason = NewJingleReason("success", "")
+		}
+		session.end(reason)
+	case JingleSessionInfo:
+		// no payload we know of, the ack is enough
+	default:
+		select {
+		case session.actions <- jingle:
+		default:
+			go session.Terminate("general-error", "Too many pending actions")
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJingleReason(t *testing.T) {
+	data, err := xml.Marshal(&Jingle{Action: JingleSessionTerminate, Sid: "s1", Reason: NewJingleReason("decline", "busy")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jingle := &Jingle{}
+	if err := xml.Unmarshal(data, jingle); err != nil {
+		t.Fatal(err)
+	}
+	if jingle.Reason == nil || jingle.Reason.Condition() != "decline" || jingle.Reason.Text != "busy" {
+		t.Fatalf("reason not parsed back from %s", data)
+	}
+}
+
+// newFileTransferPeers returns alice and bob, bob receives the files offered.
+func newFileTransferPeers(t *testing.T, proxy *S5BProxy) (*XmppClient, *XmppClient, chan *FileOffer) {
+	server := newTestServer("example.com")
+	server.handle = func(from string, stanza interface{}) []interface{} {
+		if iq, ok := stanza.(*IQ); ok && proxy != nil && iq.To == "proxy.example.com" {
+			return []interface{}{proxy.HandleIQ(iq)}
+		}
+		return nil
+	}
+	alice := server.connect("alice@example.com/a")
+	bob := server.connect("bob@example.com/b")
+	t.Cleanup(func() {
+		alice.Disconnect()
+		bob.Disconnect()
+	})
+	alice.SetS5BProxies([]S5BStreamHost{})
+	bob.SetS5BProxies([]S5BStreamHost{})
+	offers := make(chan *FileOffer, 1)
+	bob.OnFileOffer(func(offer *FileOffer) {
+		offers <- offer
+	})
+	return alice, bob, offers
+}
+
+// transferFile sends a file from alice and returns the network of the bytestream used.
+func transferFile(t *testing.T, alice *XmppClient, offers chan *FileOffer) string {
+	content := []byte(strings.Repeat("jingle file transfer\n", 1000))
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sent, err := alice.SendFile("bob@example.com/b", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offer *FileOffer
+	select {
+	case offer = <-offers:
+	case <-time.After(time.Second):
+		t.Fatal("no file offer")
+	}
+	if offer.From != "alice@example.com/a" || offer.File.Name != "notes.txt" ||
+		offer.File.Size != strconv.Itoa(len(content)) || len(offer.File.Hashes) != 1 {
+		t.Fatalf("unexpected offer %+v", offer.File)
+	}
+	buf := &bytes.Buffer{}
+	received := offer.Accept(buf)
+	if err := received.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sent.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) || sent.Transferred() != int64(len(content)) {
+		t.Fatalf("received %d bytes, sent %d", buf.Len(), sent.Transferred())
+	}
+	if reason := received.session.Reason().Condition(); reason != "success" {
+		t.Fatalf("terminated with %s", reason)
+	}
+	return sent.conn.LocalAddr().Network()
+}
+
+func TestJingleFileIBB(t *testing.T) {
+	alice, _, offers := newFileTransferPeers(t, nil)
+	if network := transferFile(t, alice, offers); network != "xmpp-ibb" {
+		t.Fatalf("file sent over %s", network)
+	}
+}
+
+func TestJingleFileS5BDirect(t *testing.T) {
+	alice, _, offers := newFileTransferPeers(t, nil)
+	if err := alice.ListenS5B("127.0.0.1:0", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.CloseS5BListener()
+	if network := transferFile(t, alice, offers); network != "tcp" {
+		t.Fatalf("file sent over %s", network)
+	}
+}
+
+func TestJingleFileS5BProxy(t *testing.T) {
+	proxy, err := NewS5BProxy("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	alice, _, offers := newFileTransferPeers(t, proxy)
+	alice.SetS5BProxies([]S5BStreamHost{proxy.StreamHost("proxy.example.com")})
+	if network := transferFile(t, alice, offers); network != "tcp" {
+		t.Fatalf("file sent over %s", network)
+	}
+}
+
+func TestJingleFileTransportReplace(t *testing.T) {
+	alice, _, offers := newFileTransferPeers(t, nil)
+	// nothing listens there, the SOCKS5 negotiation fails
+	alice.SetS5BProxies([]S5BStreamHost{{Jid: "proxy.example.com", Host: "127.0.0.1", Port: "1"}})
+	if network := transferFile(t, alice, offers); network != "xmpp-ibb" {
+		t.Fatalf("file sent over %s", network)
+	}
+}
+
+func TestJingleFileProxyError(t *testing.T) {
+	proxy, err := NewS5BProxy("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	// the activation reaches another proxy, which doesn't know the connections
+	other, err := NewS5BProxy("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	alice, _, offers := newFileTransferPeers(t, other)
+	alice.SetS5BProxies([]S5BStreamHost{proxy.StreamHost("proxy.example.com")})
+	if network := transferFile(t, alice, offers); network != "xmpp-ibb" {
+		t.Fatalf("file sent over %s", network)
+	}
+}
+
+func TestJingleInvalidAttributes(t *testing.T) {
+	data := `<transport xmlns="urn:xmpp:jingle:transports:s5b:1" sid="s1">` +
+		`<candidate cid="c1" host="127.0.0.1" jid="a@example.com/a" port="x" priority="-"/></transport>`
+	transport := &JingleS5BTransport{}
+	if err := xml.Unmarshal([]byte(data), transport); err != nil {
+		t.Fatal(err)
+	}
+	if transport.Candidates[0].priority() != 0 {
+		t.Fatal("invalid priority not ignored")
+	}
+	ibb := &JingleIBBTransport{}
+	if err := xml.Unmarshal([]byte(`<transport xmlns="urn:xmpp:jingle:transports:ibb:1" block-size="huge" sid="s1"/>`), ibb); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ibb.Size(); ok {
+		t.Fatal("invalid block size accepted")
+	}
+	file := &JingleFile{Size: "-1"}
+	if _, ok := file.Length(); ok {
+		t.Fatal("invalid file size accepted")
+	}
+}
+
+func TestJingleForgedInitiator(t *testing.T) {
+	server := newTestServer("example.com")
+	alice := server.connect("alice@example.com/a")
+	defer alice.Disconnect()
+	bob := server.connect("bob@example.com/b")
+	defer bob.Disconnect()
+
+	jingle := &Jingle{Action: JingleSessionInitiate, Initiator: "mallory@example.com/m", Sid: "s1",
+		Contents: []JingleContent{{Creator: "initiator", Name: "file"}}}
+	_, err := alice.sendIQ(&IQ{To: "bob@example.com/b", Type: "set", Jingle: jingle})
+	if xmppErr, ok := err.(*Error); !ok || xmppErr.Condition() != "bad-request" {
+		t.Fatal("expected bad-request for a forged initiator, got", err)
+	}
+	bob.jingle.mutex.Lock()
+	sessions := len(bob.jingle.sessions)
+	bob.jingle.mutex.Unlock()
+	if sessions != 0 {
+		t.Fatal("session of a forged initiator registered")
+	}
+}
+
+func TestJingleFileRejected(t *testing.T) {
+	alice, _, offers := newFileTransferPeers(t, nil)
+	sent, err := alice.sendFile("bob@example.com/b", JingleFile{Name: "x", Size: "1"}, strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	(<-offers).Reject()
+	if err := sent.Wait(); err == nil || !strings.Contains(err.Error(), "decline") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestJingleFileHashMismatch(t *testing.T) {
+	alice, _, offers := newFileTransferPeers(t, nil)
+	sum, _ := ComputeHash("sha-256", strings.NewReader("expected"))
+	sent, err := alice.sendFile("bob@example.com/b", JingleFile{Name: "x", Hashes: []Hash{*sum}}, strings.NewReader("tampered"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := (<-offers).Accept(&bytes.Buffer{})
+	if err := received.Wait(); err == nil {
+		t.Fatal("hash mismatch not detected")
+	}
+	if err := sent.Wait(); err == nil {
+		t.Fatal("sender not told about the mismatch")
+	}
+}
@@ -0,0 +1,630 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// XEP-0234 Jingle File Transfer, over XEP-0261 Jingle In-Band Bytestreams
+// and XEP-0260 Jingle SOCKS5 Bytestreams transports
+
+const (
+	nsJingleFT  = "urn:xmpp:jingle:apps:file-transfer:5"
+	nsJingleIBB = "urn:xmpp:jingle:transports:ibb:1"
+	nsJingleS5B = "urn:xmpp:jingle:transports:s5b:1"
+)
+
+// how long the peer may take to answer during the negotiation
+const jingleTimeout = 30 * time.Second
+
+type JingleFileDescription struct {
+	XMLName xml.Name   `xml:"urn:xmpp:jingle:apps:file-transfer:5 description"`
+	File    JingleFile `xml:"file"`
+}
+
+type JingleFile struct {
+	MediaType string `xml:"media-type,omitempty"`
+	Name      string `xml:"name,omitempty"`
+	Size      string `xml:"size,omitempty"`
+	Date      string `xml:"date,omitempty"` // XEP-0082 DateTime
+	Desc      string `xml:"desc,omitempty"`
+	Hashes    []Hash `xml:"urn:xmpp:hashes:2 hash"`
+}
+
+// Length returns the size of the file in bytes, ok is false if it is unknown or invalid.
+func (self *JingleFile) Length() (size int64, ok bool) {
+	size, err := strconv.ParseInt(self.Size, 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+type JingleIBBTransport struct {
+	XMLName   xml.Name `xml:"urn:xmpp:jingle:transports:ibb:1 transport"`
+	BlockSize string   `xml:"block-size,attr"`
+	Sid       string   `xml:"sid,attr"`
+}
+
+func newJingleIBBTransport(blockSize int, sid string) *JingleIBBTransport {
+	return &JingleIBBTransport{BlockSize: strconv.Itoa(blockSize), Sid: sid}
+}
+
+// Size returns the block size, ok is false if it is invalid.
+func (self *JingleIBBTransport) Size() (int, bool) {
+	return parseBlockSize(self.BlockSize)
+}
+
+type JingleS5BTransport struct {
+	XMLName        xml.Name               `xml:"urn:xmpp:jingle:transports:s5b:1 transport"`
+	Sid            string                 `xml:"sid,attr"`
+	DstAddr        string                 `xml:"dstaddr,attr,omitempty"`
+	Mode           string                 `xml:"mode,attr,omitempty"`
+	Candidates     []JingleS5BCandidate   `xml:"candidate"`
+	CandidateUsed  *JingleS5BCandidateRef `xml:"candidate-used"`
+	CandidateError *struct{}              `xml:"candidate-error"`
+	Activated      *JingleS5BCandidateRef `xml:"activated"`
+	ProxyError     *struct{}              `xml:"proxy-error"`
+}
+
+type JingleS5BCandidate struct {
+	Cid      string `xml:"cid,attr"`
+	Host     string `xml:"host,attr"`
+	Jid      string `xml:"jid,attr"`
+	Port     string `xml:"port,attr,omitempty"`
+	Priority string `xml:"priority,attr"`
+	Type     string `xml:"type,attr,omitempty"` // direct by default, or proxy
+}
+
+// priority returns the priority of the candidate, 0 if it is invalid.
+func (self *JingleS5BCandidate) priority() int {
+	priority, err := strconv.Atoi(self.Priority)
+	if err != nil || priority < 0 {
+		return 0
+	}
+	return priority
+}
+
+type JingleS5BCandidateRef struct {
+	Cid string `xml:"cid,attr"`
+}
+
+// candidate type preferences of XEP-0260
+const (
+	s5bDirectPreference = 126
+	s5bProxyPreference  = 10
+)
+
+// FileOffer is a file offered by a peer, it must be accepted or rejected.
+type FileOffer struct {
+	From    string
+	File    JingleFile
+	session *JingleSession
+	content JingleContent
+}
+
+// FileTransfer is a file being sent or received.
+type FileTransfer struct {
+	File        JingleFile
+	session     *JingleSession
+	transferred int64
+	mutex       sync.Mutex
+	conn        net.Conn
+	done        chan int
+	err         error
+}
+
+func newFileTransfer(session *JingleSession, file JingleFile) *FileTransfer {
+	return &FileTransfer{File: file, session: session, done: make(chan int)}
+}
+
+func (self *FileTransfer) Session() *JingleSession {
+	return self.session
+}
+
+// Transferred returns the number of bytes sent or received so far.
+func (self *FileTransfer) Transferred() int64 {
+	return atomic.LoadInt64(&self.transferred)
+}
+
+// Wait blocks until the transfer is over and returns its error.
+func (self *FileTransfer) Wait() error {
+	<-self.done
+	return self.err
+}
+
+// Cancel stops the transfer and terminates the session.
+func (self *FileTransfer) Cancel() error {
+	self.mutex.Lock()
+	conn := self.conn
+	self.mutex.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	return self.session.Terminate("cancel", "")
+}
+
+func (self *FileTransfer) setConn(conn net.Conn) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.conn = conn
+}
+
+func (self *FileTransfer) finish(err error) {
+	self.err = err
+	close(self.done)
+}
+
+// progress counts the bytes written through it as transferred.
+type progress struct {
+	transfer *FileTransfer
+}
+
+func (self progress) Write(b []byte) (int, error) {
+	atomic.AddInt64(&self.transfer.transferred, int64(len(b)))
+	return len(b), nil
+}
+
+// OnFileOffer sets the function called with the files offered by peers, it
+// announces our support of Jingle file transfers.
+func (self *XmppClient) OnFileOffer(onOffer func(offer *FileOffer)) {
+	self.jingle.mutex.Lock()
+	self.jingle.initiate = func(session *JingleSession) *JingleReason {
+		content := session.Contents[0]
+		if content.Description == nil || len(session.Contents) != 1 ||
+			(content.Senders != "" && content.Senders != "initiator") {
+			return NewJingleReason("unsupported-applications", "")
+		}
+		if content.IBBTransport == nil && content.S5BTransport == nil {
+			return NewJingleReason("unsupported-transports", "")
+		}
+		onOffer(&FileOffer{From: session.Peer, File: content.Description.File, session: session, content: content})
+		return nil
+	}
+	self.jingle.mutex.Unlock()
+	self.AddFeature(nsJingle, nsJingleFT, nsJingleIBB, nsJingleS5B, nsHashes,
+		"urn:xmpp:hash-function-text-names:sha-256", "urn:xmpp:hash-function-text-names:sha-512")
+}
+
+// Reject declines the offer.
+func (self *FileOffer) Reject() error {
+	return self.session.Terminate("decline", "")
+}
+
+// Accept accepts the offer and receives the file into w in the background.
+func (self *FileOffer) Accept(w io.Writer) *FileTransfer {
+	return self.accept(w, nil)
+}
+
+// AcceptToFile accepts the offer and saves the file at path.
+func (self *FileOffer) AcceptToFile(path string) (*FileTransfer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		self.session.Terminate("cancel", err.Error())
+		return nil, err
+	}
+	return self.accept(f, f.Close), nil
+}
+
+func (self *FileOffer) accept(w io.Writer, closeWriter func() error) *FileTransfer {
+	transfer := newFileTransfer(self.session, self.File)
+	go func() {
+		err := self.receive(transfer, w)
+		if closeWriter != nil {
+			if closeErr := closeWriter(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			self.session.Terminate("failed-transport", err.Error())
+		}
+		transfer.finish(err)
+	}()
+	return transfer
+}
+
+func (self *FileOffer) receive(transfer *FileTransfer, w io.Writer) error {
+	session := self.session
+	client := session.client
+	accepted := JingleContent{Creator: self.content.Creator, Name: self.content.Name,
+		Senders: self.content.Senders, Description: self.content.Description}
+
+	var conn net.Conn
+	var err error
+	if t := self.content.S5BTransport; t != nil {
+		local, direct := client.jingleS5BTransport(t.Sid, session.Peer)
+		accepted.S5BTransport = local
+		if err := session.Accept([]JingleContent{accepted}); err != nil {
+			return err
+		}
+		var replace *Jingle
+		conn, replace, err = client.negotiateJingleS5B(session, local, t, direct)
+		if err != nil {
+			conn, err = self.replacedTransport(client, replace)
+		}
+	} else {
+		t := self.content.IBBTransport
+		client.ibb.mutex.Lock()
+		blockSize := client.ibb.maxBlockSize
+		client.ibb.mutex.Unlock()
+		if size, ok := t.Size(); ok && size < blockSize {
+			blockSize = size
+		}
+		ch := client.ibb.expect(session.Peer, t.Sid)
+		accepted.IBBTransport = newJingleIBBTransport(blockSize, t.Sid)
+		if err := session.Accept([]JingleContent{accepted}); err != nil {
+			client.ibb.unexpect(session.Peer, t.Sid)
+			return err
+		}
+		conn, err = waitIBB(session, ch, t.Sid)
+	}
+	if err != nil {
+		return err
+	}
+	transfer.setConn(conn)
+	defer conn.Close()
+
+	expected := strongestHash(self.File.Hashes)
+	writers := []io.Writer{w, progress{transfer}}
+	var h interface {
+		io.Writer
+		Sum([]byte) []byte
+	}
+	if expected != nil {
+		h = hashAlgorithms[expected.Algo]()
+		writers = append(writers, h)
+	}
+	n, err := io.Copy(io.MultiWriter(writers...), conn)
+	if err != nil {
+		return err
+	}
+	if size, ok := self.File.Length(); ok && size > 0 && n != size {
+		return errors.New("Incomplete file transfer")
+	}
+	if expected != nil && !expected.Matches(h.Sum(nil)) {
+		session.Terminate("media-error", "Hash mismatch")
+		return errors.New("File hash mismatch")
+	}
+	session.Terminate("success", "")
+	return nil
+}
+
+// replacedTransport waits for the initiator to fall back to in-band bytestreams,
+// unless its transport-replace was already received.
+func (self *FileOffer) replacedTransport(client *XmppClient, jingle *Jingle) (net.Conn, error) {
+	session := self.session
+	if jingle == nil {
+		var err error
+		jingle, err = session.waitAction(jingleTimeout, func(j *Jingle) bool {
+			return j.Action == JingleTransportReplace
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(jingle.Contents) != 1 || jingle.Contents[0].IBBTransport == nil {
+		session.send(JingleTransportReject, jingle.Contents, nil)
+		return nil, errors.New("Unsupported transport replacement")
+	}
+	t := jingle.Contents[0].IBBTransport
+	ch := client.ibb.expect(session.Peer, t.Sid)
+	if err := session.send(JingleTransportAccept, jingle.Contents, nil); err != nil {
+		client.ibb.unexpect(session.Peer, t.Sid)
+		return nil, err
+	}
+	return waitIBB(session, ch, t.Sid)
+}
+
+func waitIBB(session *JingleSession, ch chan *IBBConn, sid string) (net.Conn, error) {
+	defer session.client.ibb.unexpect(session.Peer, sid)
+	select {
+	case conn := <-ch:
+		return conn, nil
+	case <-session.Done():
+		return nil, errors.New("Jingle session terminated")
+	case <-time.After(jingleTimeout):
+		return nil, errors.New("No in-band bytestream opened")
+	}
+}
+
+// SendFile offers the file at path to the full jid and sends it in the background
+// once accepted. SOCKS5 bytestreams are used if we have streamhosts, falling back
+// to in-band bytestreams.
+func (self *XmppClient) SendFile(jid, path string) (*FileTransfer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err == nil && stat.IsDir() {
+		err = errors.New(path + " is a directory")
+	}
+	var sum *Hash
+	if err == nil {
+		sum, err = ComputeHash("sha-256", f)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	file := JingleFile{
+		MediaType: mime.TypeByExtension(filepath.Ext(path)),
+		Name:      filepath.Base(path),
+		Size:      strconv.FormatInt(stat.Size(), 10),
+		Date:      stat.ModTime().UTC().Format(time.RFC3339),
+		Hashes:    []Hash{*sum},
+	}
+	transfer, err := self.sendFile(jid, file, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	go func() {
+		transfer.Wait()
+		f.Close()
+	}()
+	return transfer, nil
+}
+
+func (self *XmppClient) sendFile(jid string, file JingleFile, r io.Reader) (*FileTransfer, error) {
+	content := JingleContent{Creator: "initiator", Name: "file", Senders: "initiator",
+		Description: &JingleFileDescription{File: file}}
+	var direct chan net.Conn
+	if len(self.streamHosts()) > 0 {
+		content.S5BTransport, direct = self.jingleS5BTransport(RandomString(16), jid)
+	} else {
+		content.IBBTransport = newJingleIBBTransport(DefaultIBBBlockSize, RandomString(16))
+	}
+	session, err := self.initiateJingle(jid, []JingleContent{content})
+	if err != nil {
+		return nil, err
+	}
+	transfer := newFileTransfer(session, file)
+	go func() {
+		err := self.runFileSend(session, transfer, content, direct, r)
+		if err != nil {
+			session.Terminate("failed-transport", err.Error())
+		}
+		transfer.finish(err)
+	}()
+	return transfer, nil
+}
+
+func (self *XmppClient) runFileSend(session *JingleSession, transfer *FileTransfer, content JingleContent, direct chan net.Conn, r io.Reader) error {
+	if content.S5BTransport != nil {
+		defer self.s5b.dropDirect(s5bDstAddr(content.S5BTransport.Sid, self.client.jid, session.Peer), direct)
+	}
+	accept, err := session.waitAction(jingleTimeout, func(j *Jingle) bool {
+		return j.Action == JingleSessionAccept
+	})
+	if err != nil {
+		return err
+	}
+	if len(accept.Contents) != 1 {
+		return errors.New("Unexpected contents in session-accept")
+	}
+	var conn net.Conn
+	if content.S5BTransport != nil && accept.Contents[0].S5BTransport != nil {
+		conn, _, err = self.negotiateJingleS5B(session, content.S5BTransport, accept.Contents[0].S5BTransport, direct)
+		if err != nil {
+			conn, err = self.replaceWithIBB(session, content)
+		}
+	} else if content.IBBTransport != nil && accept.Contents[0].IBBTransport != nil {
+		t := accept.Contents[0].IBBTransport
+		conn, err = self.openJingleIBB(session.Peer, t)
+	} else {
+		return errors.New("Unexpected transport in session-accept")
+	}
+	if err != nil {
+		return err
+	}
+	transfer.setConn(conn)
+	_, err = io.Copy(io.MultiWriter(conn, progress{transfer}), r)
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	// the receiver terminates the session once it has checked the file
+	select {
+	case <-session.Done():
+	case <-time.After(jingleTimeout):
+		session.Terminate("success", "")
+	}
+	if reason := session.Reason(); reason != nil && reason.Condition() != "success" {
+		return errors.New("File transfer failed: " + reason.Condition())
+	}
+	return nil
+}
+
+// replaceWithIBB falls back to in-band bytestreams, as the initiator.
+func (self *XmppClient) replaceWithIBB(session *JingleSession, content JingleContent) (net.Conn, error) {
+	replaced := JingleContent{Creator: content.Creator, Name: content.Name,
+		IBBTransport: newJingleIBBTransport(DefaultIBBBlockSize, RandomString(16))}
+	if err := session.send(JingleTransportReplace, []JingleContent{replaced}, nil); err != nil {
+		return nil, err
+	}
+	answer, err := session.waitAction(jingleTimeout, func(j *Jingle) bool {
+		return j.Action == JingleTransportAccept || j.Action == JingleTransportReject
+	})
+	if err != nil {
+		return nil, err
+	}
+	if answer.Action == JingleTransportReject {
+		return nil, errors.New("Transport replacement rejected")
+	}
+	t := replaced.IBBTransport
+	if len(answer.Contents) == 1 && answer.Contents[0].IBBTransport != nil {
+		t = answer.Contents[0].IBBTransport
+	}
+	return self.openJingleIBB(session.Peer, t)
+}
+
+// openJingleIBB opens the in-band bytestream of the transport t accepted by peer.
+func (self *XmppClient) openJingleIBB(peer string, t *JingleIBBTransport) (net.Conn, error) {
+	blockSize, ok := t.Size()
+	if !ok {
+		return nil, errors.New("Invalid in-band bytestream block size")
+	}
+	return self.OpenIBB(peer, t.Sid, blockSize)
+}
+
+// jingleS5BTransport returns our candidates for the transport sid with peer and
+// the channel receiving the peer's direct connection.
+func (self *XmppClient) jingleS5BTransport(sid, peer string) (*JingleS5BTransport, chan net.Conn) {
+	dstAddr := s5bDstAddr(sid, self.client.jid, peer)
+	transport := &JingleS5BTransport{Sid: sid, DstAddr: dstAddr, Mode: "tcp"}
+	var direct chan net.Conn
+	for i, host := range self.streamHosts() {
+		candidate := JingleS5BCandidate{Cid: RandomString(8), Host: host.Host, Jid: host.Jid, Port: host.Port}
+		if host.Jid == self.client.jid {
+			candidate.Priority = strconv.Itoa(s5bDirectPreference<<16 - i)
+			direct = self.s5b.expectDirect(dstAddr)
+		} else {
+			candidate.Type = "proxy"
+			candidate.Priority = strconv.Itoa(s5bProxyPreference<<16 - i)
+		}
+		transport.Candidates = append(transport.Candidates, candidate)
+	}
+	return transport, direct
+}
+
+// negotiateJingleS5B connects to the candidates of the peer, exchanges the
+// results and returns the connection of the nominated candidate. The
+// transport-replace of the peer is returned if it gives up on the candidates.
+func (self *XmppClient) negotiateJingleS5B(session *JingleSession, local, remote *JingleS5BTransport, direct chan net.Conn) (net.Conn, *Jingle, error) {
+	// the peer's direct connection isn't returned if a proxy or our candidate is used
+	defer self.s5b.dropDirect(s5bDstAddr(local.Sid, self.client.jid, session.Peer), direct)
+	content := func(t *JingleS5BTransport) []JingleContent {
+		c := session.Contents[0]
+		return []JingleContent{{Creator: c.Creator, Name: c.Name, S5BTransport: t}}
+	}
+
+	candidates := append([]JingleS5BCandidate{}, remote.Candidates...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].priority() > candidates[j].priority()
+	})
+	var used *JingleS5BCandidate
+	var usedConn net.Conn
+	dstAddr := s5bDstAddr(local.Sid, session.Peer, self.client.jid)
+	for i := range candidates {
+		addr := (&S5BStreamHost{Host: candidates[i].Host, Port: candidates[i].Port}).addr()
+		conn, err := socks5Connect(addr, dstAddr)
+		if err == nil {
+			used, usedConn = &candidates[i], conn
+			break
+		}
+	}
+	result := &JingleS5BTransport{Sid: local.Sid}
+	if used != nil {
+		result.CandidateUsed = &JingleS5BCandidateRef{used.Cid}
+	} else {
+		result.CandidateError = &struct{}{}
+	}
+	if err := session.send(JingleTransportInfo, content(result), nil); err != nil {
+		closeConn(usedConn)
+		return nil, nil, err
+	}
+
+	peerResult, err := session.waitAction(jingleTimeout, func(j *Jingle) bool {
+		if j.Action != JingleTransportInfo || len(j.Contents) != 1 || j.Contents[0].S5BTransport == nil {
+			return false
+		}
+		t := j.Contents[0].S5BTransport
+		return t.CandidateUsed != nil || t.CandidateError != nil
+	})
+	if err != nil {
+		closeConn(usedConn)
+		return nil, nil, err
+	}
+	var peerUsed *JingleS5BCandidate
+	if ref := peerResult.Contents[0].S5BTransport.CandidateUsed; ref != nil {
+		for i := range local.Candidates {
+			if local.Candidates[i].Cid == ref.Cid {
+				peerUsed = &local.Candidates[i]
+			}
+		}
+	}
+
+	// the candidate with the highest priority wins, the initiator's choice on a tie
+	ours := peerUsed != nil
+	if used != nil && peerUsed != nil {
+		ours = peerUsed.priority() > used.priority() ||
+			(peerUsed.priority() == used.priority() && !session.isInitiator())
+	}
+	switch {
+	case used == nil && peerUsed == nil:
+		return nil, nil, errors.New("No SOCKS5 candidate succeeded")
+	case !ours:
+		if used.Type == "proxy" {
+			// the peer activates the proxy, or gives up with a proxy-error or transport-replace
+			jingle, err := session.waitAction(jingleTimeout, func(j *Jingle) bool {
+				if j.Action == JingleTransportReplace {
+					return true
+				}
+				if j.Action != JingleTransportInfo || len(j.Contents) != 1 || j.Contents[0].S5BTransport == nil {
+					return false
+				}
+				t := j.Contents[0].S5BTransport
+				return t.Activated != nil || t.ProxyError != nil
+			})
+			if err != nil {
+				usedConn.Close()
+				return nil, nil, err
+			}
+			if jingle.Action == JingleTransportReplace {
+				usedConn.Close()
+				return nil, jingle, errors.New("SOCKS5 transport replaced")
+			}
+			if jingle.Contents[0].S5BTransport.ProxyError != nil {
+				usedConn.Close()
+				return nil, nil, errors.New("SOCKS5 proxy activation failed")
+			}
+		}
+		return usedConn, nil, nil
+	}
+
+	closeConn(usedConn)
+	if peerUsed.Type != "proxy" {
+		select {
+		case conn := <-direct:
+			return conn, nil, nil
+		case <-time.After(s5bTimeout):
+			return nil, nil, errors.New("No direct SOCKS5 connection")
+		}
+	}
+	host := &S5BStreamHost{Host: peerUsed.Host, Port: peerUsed.Port}
+	conn, err := socks5Connect(host.addr(), s5bDstAddr(local.Sid, self.client.jid, session.Peer))
+	if err == nil {
+		err = self.activateS5B(peerUsed.Jid, local.Sid, session.Peer)
+	}
+	if err != nil {
+		closeConn(conn)
+		session.send(JingleTransportInfo, content(&JingleS5BTransport{Sid: local.Sid, ProxyError: &struct{}{}}), nil)
+		return nil, nil, err
+	}
+	activated := &JingleS5BTransport{Sid: local.Sid, Activated: &JingleS5BCandidateRef{peerUsed.Cid}}
+	if err := session.send(JingleTransportInfo, content(activated), nil); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, nil, nil
+}
+
+func closeConn(conn net.Conn) {
+	if conn != nil {
+		conn.Close()
+	}
+}
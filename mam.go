@@ -0,0 +1,225 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"strings"
+	"time"
+)
+
+// XEP-0313 Message Archive Management
+
+const nsMAM = "urn:xmpp:mam:2"
+
+type MAMQuery struct {
+	XMLName xml.Name  `xml:"urn:xmpp:mam:2 query"`
+	QueryId string    `xml:"queryid,attr,omitempty"`
+	Node    string    `xml:"node,attr,omitempty"`
+	Form    *DataForm `xml:"jabber:x:data x,omitempty"`
+	Set     *RSMSet
+}
+
+// MAMResult is carried by the messages delivering the archived stanzas.
+type MAMResult struct {
+	XMLName   xml.Name `xml:"urn:xmpp:mam:2 result"`
+	QueryId   string   `xml:"queryid,attr,omitempty"`
+	Id        string   `xml:"id,attr"`
+	Forwarded *Forwarded
+}
+
+type MAMFin struct {
+	XMLName  xml.Name `xml:"urn:xmpp:mam:2 fin"`
+	Complete string   `xml:"complete,attr,omitempty"`
+	Stable   string   `xml:"stable,attr,omitempty"`
+	Set      *RSMSet
+}
+
+func (self *MAMFin) IsComplete() bool {
+	return self.Complete == "true" || self.Complete == "1"
+}
+
+// ArchiveFilter narrows an archive query, all fields are optional.
+type ArchiveFilter struct {
+	With   string
+	Start  time.Time
+	End    time.Time
+	After  string // archive id
+	Before string // archive id
+	Last   bool   // request the last page, i.e. the newest messages
+	Max    int
+}
+
+type ArchivedMessage struct {
+	Id      string // archive id, usable as After/Before
+	Stamp   time.Time
+	Message *Message
+}
+
+type ArchivePage struct {
+	Messages []*ArchivedMessage
+	Complete bool // the last page of the query
+	Stable   bool // false if the results may change if queried again
+	Set      *RSMSet
+}
+
+// mamResultHandler collects the result messages of an archive query, the
+// results of our own archive may come without from.
+type mamResultHandler struct {
+	from    string
+	own     string
+	queryId string
+	DefaultHandler
+}
+
+func newMAMResultHandler(from, own, queryId string) *mamResultHandler {
+	h := &mamResultHandler{}
+	h.EventCh = make(chan *Event)
+	h.from = from
+	h.own = own
+	h.queryId = queryId
+	return h
+}
+
+func (self *mamResultHandler) Filter(event *Event) bool {
+	if event.Type == Stanza {
+		if msg, ok := event.Stanza.(*Message); ok {
+			from := ToBareJID(msg.From)
+			if from == "" {
+				from = self.own
+			}
+			return msg.MAMResult != nil && msg.MAMResult.QueryId == self.queryId &&
+				strings.EqualFold(from, self.from)
+		}
+	}
+	return false
+}
+
+func (self *mamResultHandler) IsOneTime() bool {
+	return false
+}
+
+// QueryArchive fetches one page of the archive at archiveJid, which is a room
+// jid for MUC archives or empty for our own archive.
+func (self *XmppClient) QueryArchive(archiveJid string, filter *ArchiveFilter) (*ArchivePage, error) {
+	if filter == nil {
+		filter = &ArchiveFilter{}
+	}
+	set := &RSMSet{After: filter.After}
+	if filter.Max > 0 {
+		set.SetMax(filter.Max)
+	}
+	if filter.Before != "" || filter.Last {
+		set.Before = &filter.Before
+	}
+	resp, messages, err := self.sendArchiveQuery(archiveJid, archiveRequest(archiveJid, filter, set))
+	if err != nil {
+		return nil, err
+	}
+	page := &ArchivePage{
+		Messages: messages,
+		Complete: resp.MAMFin.IsComplete(),
+		Stable:   resp.MAMFin.Stable != "false",
+		Set:      resp.MAMFin.Set,
+	}
+	return page, nil
+}
+
+// IterateArchive pages forward through the archive from filter.After until the
+// query is complete or fn returns an error, which is returned.
+func (self *XmppClient) IterateArchive(archiveJid string, filter *ArchiveFilter, fn func(*ArchivedMessage) error) error {
+	if filter == nil {
+		filter = &ArchiveFilter{}
+	}
+	var messages []*ArchivedMessage
+	pager := self.NewRSMPager(filter.Max, func(set *RSMSet) *IQ {
+		if set.After == "" {
+			set.After = filter.After
+		}
+		return archiveRequest(archiveJid, filter, set)
+	}, func(resp *IQ) (*RSMSet, bool) {
+		return resp.MAMFin.Set, resp.MAMFin.IsComplete()
+	})
+	pager.send = func(iq *IQ) (*IQ, error) {
+		resp, page, err := self.sendArchiveQuery(archiveJid, iq)
+		messages = page
+		return resp, err
+	}
+	return pager.ForEach(func(resp *IQ) error {
+		for _, m := range messages {
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func archiveRequest(archiveJid string, filter *ArchiveFilter, set *RSMSet) *IQ {
+	query := &MAMQuery{QueryId: RandomString(10)}
+	form := NewDataForm(FormTypeSubmit, nsMAM)
+	if filter.With != "" {
+		form.Set("with", filter.With)
+	}
+	if !filter.Start.IsZero() {
+		form.Set("start", filter.Start.UTC().Format(time.RFC3339))
+	}
+	if !filter.End.IsZero() {
+		form.Set("end", filter.End.UTC().Format(time.RFC3339))
+	}
+	query.Form = form
+	if set.Max != "" || set.After != "" || set.Before != nil {
+		query.Set = set
+	}
+	return &IQ{To: archiveJid, Type: "set", MAMQuery: query}
+}
+
+// sendArchiveQuery sends the query iq and collects the archived messages delivered before the response.
+func (self *XmppClient) sendArchiveQuery(archiveJid string, iq *IQ) (*IQ, []*ArchivedMessage, error) {
+	from := archiveJid
+	if from == "" {
+		from = self.jid
+	}
+	resultHandler := newMAMResultHandler(ToBareJID(from), ToBareJID(self.jid), iq.MAMQuery.QueryId)
+	self.AddHandler(resultHandler)
+	stop := make(chan int)
+	done := make(chan []*ArchivedMessage)
+	go func() {
+		messages := []*ArchivedMessage{}
+		for {
+			select {
+			case event := <-resultHandler.EventCh:
+				if m := archivedMessage(event.Stanza.(*Message).MAMResult); m != nil {
+					messages = append(messages, m)
+				}
+			case <-stop:
+				done <- messages
+				return
+			}
+		}
+	}()
+
+	resp, err := self.sendIQ(iq)
+	// all results have been dispatched before the response
+	self.RemoveHandler(resultHandler)
+	close(stop)
+	messages := <-done
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.MAMFin == nil {
+		return nil, nil, errors.New("No <fin/> in archive response")
+	}
+	return resp, messages, nil
+}
+
+func archivedMessage(result *MAMResult) *ArchivedMessage {
+	if result.Forwarded == nil || result.Forwarded.Message == nil {
+		return nil
+	}
+	m := &ArchivedMessage{
+		Id:      result.Id,
+		Message: result.Forwarded.Message,
+	}
+	m.Stamp, _, _ = delayInfo(result.Forwarded.Delay, nil)
+	return m
+}
@@ -0,0 +1,67 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestArchiveResult(t *testing.T) {
+	var msg Message
+	err := xml.Unmarshal([]byte(`<message xmlns="jabber:client" id="aeb213" to="juliet@capulet.lit/chamber">
+		<result xmlns="urn:xmpp:mam:2" queryid="f27" id="28482-98726-73623">
+		<forwarded xmlns="urn:xmpp:forward:0">
+		<delay xmlns="urn:xmpp:delay" stamp="2010-07-10T23:08:25Z"/>
+		<message xmlns="jabber:client" from="witch@shakespeare.lit" to="macbeth@shakespeare.lit">
+		<body>Hail to thee</body></message></forwarded></result></message>`), &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newMAMResultHandler("juliet@capulet.lit", "juliet@capulet.lit", "f27")
+	if !h.Filter(&Event{Stanza, &msg, nil, ""}) {
+		t.Fatal("result without sender not collected for own archive")
+	}
+	room := newMAMResultHandler("garden@conference.capulet.lit", "juliet@capulet.lit", "f27")
+	if room.Filter(&Event{Stanza, &msg, nil, ""}) {
+		t.Fatal("result without sender accepted for a room archive")
+	}
+	msg.From = "juliet@capulet.lit"
+	if !h.Filter(&Event{Stanza, &msg, nil, ""}) {
+		t.Fatal("result of the query not collected")
+	}
+	m := archivedMessage(msg.MAMResult)
+	if m == nil || m.Id != "28482-98726-73623" || m.Message.Body != "Hail to thee" {
+		t.Fatalf("unexpected archived message: %+v", m)
+	}
+	if !m.Stamp.Equal(time.Date(2010, 7, 10, 23, 8, 25, 0, time.UTC)) {
+		t.Fatalf("unexpected stamp %v", m.Stamp)
+	}
+
+	var iq IQ
+	err = xml.Unmarshal([]byte(`<iq xmlns="jabber:client" type="result" id="juliet1">
+		<fin xmlns="urn:xmpp:mam:2" complete="true"><set xmlns="http://jabber.org/protocol/rsm">
+		<first index="0">28482-98726-73623</first><last>09af3-cc343-b409f</last><count>2</count></set></fin></iq>`), &iq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iq.MAMFin == nil || !iq.MAMFin.IsComplete() || iq.MAMFin.Set.Last != "09af3-cc343-b409f" {
+		t.Fatalf("unexpected fin: %+v", iq.MAMFin)
+	}
+	if count, ok := iq.MAMFin.Set.Total(); !ok || count != 2 {
+		t.Fatalf("unexpected count %d", count)
+	}
+	if index, ok := iq.MAMFin.Set.Offset(); !ok || index != 0 {
+		t.Fatalf("unexpected index %d", index)
+	}
+
+	iq = IQ{}
+	err = xml.Unmarshal([]byte(`<iq xmlns="jabber:client" type="result" id="juliet2">
+		<fin xmlns="urn:xmpp:mam:2" complete="yes"><set xmlns="http://jabber.org/protocol/rsm">
+		<count>many</count></set></fin></iq>`), &iq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := iq.MAMFin.Set.Total(); ok || iq.MAMFin.IsComplete() {
+		t.Fatalf("invalid values accepted: %+v", iq.MAMFin)
+	}
+}
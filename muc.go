@@ -0,0 +1,511 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// XEP-0045 Multi-User Chat
+
+const (
+	nsMUC      = "http://jabber.org/protocol/muc"
+	nsMUCUser  = "http://jabber.org/protocol/muc#user"
+	nsMUCAdmin = "http://jabber.org/protocol/muc#admin"
+)
+
+var ErrMUCNickConflict = errors.New("xmpp: nickname is already in use in the room")
+
+type MUCJoin struct {
+	XMLName  xml.Name    `xml:"http://jabber.org/protocol/muc x"`
+	Password string      `xml:"password,omitempty"`
+	History  *MUCHistory `xml:"history,omitempty"`
+}
+
+type MUCHistory struct {
+	MaxChars   string `xml:"maxchars,attr,omitempty"`
+	MaxStanzas string `xml:"maxstanzas,attr,omitempty"`
+	Seconds    string `xml:"seconds,attr,omitempty"`
+	Since      string `xml:"since,attr,omitempty"`
+}
+
+type MUCUser struct {
+	XMLName  xml.Name    `xml:"http://jabber.org/protocol/muc#user x"`
+	Items    []MUCItem   `xml:"item,omitempty"`
+	Status   []MUCStatus `xml:"status,omitempty"`
+	Password string      `xml:"password,omitempty"`
+	Destroy  *MUCDestroy `xml:"destroy,omitempty"`
+}
+
+// HasStatus reports whether the status codes contain code, e.g. 110 for self-presence.
+func (self *MUCUser) HasStatus(code int) bool {
+	for _, s := range self.Status {
+		if s.Code == strconv.Itoa(code) {
+			return true
+		}
+	}
+	return false
+}
+
+type MUCStatus struct {
+	Code string `xml:"code,attr"`
+}
+
+type MUCItem struct {
+	XMLName     xml.Name  `xml:"item"`
+	Affiliation string    `xml:"affiliation,attr,omitempty"` // owner, admin, member, outcast, none
+	Role        string    `xml:"role,attr,omitempty"`        // moderator, participant, visitor, none
+	Jid         string    `xml:"jid,attr,omitempty"`
+	Nick        string    `xml:"nick,attr,omitempty"`
+	Actor       *MUCActor `xml:"actor,omitempty"`
+	Reason      string    `xml:"reason,omitempty"`
+}
+
+type MUCActor struct {
+	Jid  string `xml:"jid,attr,omitempty"`
+	Nick string `xml:"nick,attr,omitempty"`
+}
+
+type MUCAdminQuery struct {
+	XMLName xml.Name  `xml:"http://jabber.org/protocol/muc#admin query"`
+	Items   []MUCItem `xml:"item"`
+}
+
+// MUCJoinOptions are the optional parameters of JoinRoom.
+type MUCJoinOptions struct {
+	Password string
+	// history limits, negative values mean no limit; all zero values request the server default
+	MaxChars   int
+	MaxStanzas int
+	Seconds    int
+	Since      time.Time
+	// on nickname conflict, retry this many times with "_" appended to the nickname
+	ConflictRetries int
+}
+
+func (self *MUCJoinOptions) history() *MUCHistory {
+	if self == nil {
+		return nil
+	}
+	h := &MUCHistory{}
+	empty := true
+	limit := func(v int) string {
+		if v < 0 {
+			return ""
+		}
+		empty = false
+		return strconv.Itoa(v)
+	}
+	if self.MaxChars != 0 {
+		h.MaxChars = limit(self.MaxChars)
+	}
+	if self.MaxStanzas != 0 {
+		h.MaxStanzas = limit(self.MaxStanzas)
+	}
+	if self.Seconds != 0 {
+		h.Seconds = limit(self.Seconds)
+	}
+	if !self.Since.IsZero() {
+		h.Since = self.Since.UTC().Format(time.RFC3339)
+		empty = false
+	}
+	if empty {
+		return nil
+	}
+	return h
+}
+
+type MUCOccupant struct {
+	Nick        string
+	Jid         string // real jid, only known in non-anonymous rooms or as moderator
+	Affiliation string
+	Role        string
+	Presence    *Presence
+}
+
+type MUCRoom struct {
+	Jid       string // bare jid of the room
+	Nick      string
+	Password  string
+	Subject   string
+	Joined    bool
+	Locked    bool // created by us and not configured yet
+	mutex     sync.Mutex
+	occupants map[string]*MUCOccupant
+	lastMsg   time.Time
+	options   *MUCJoinOptions
+}
+
+func (self *MUCRoom) Occupants() []MUCOccupant {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	occupants := make([]MUCOccupant, 0, len(self.occupants))
+	for _, o := range self.occupants {
+		occupants = append(occupants, *o)
+	}
+	return occupants
+}
+
+func (self *MUCRoom) Occupant(nick string) (MUCOccupant, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	o, ok := self.occupants[nick]
+	if !ok {
+		return MUCOccupant{}, false
+	}
+	return *o, true
+}
+
+type mucState struct {
+	mutex sync.Mutex
+	rooms map[string]*MUCRoom
+}
+
+func (self *mucState) init() {
+	self.rooms = make(map[string]*MUCRoom)
+}
+
+func (self *mucState) room(jid string) *MUCRoom {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.rooms[strings.ToLower(ToBareJID(jid))]
+}
+
+func (self *mucState) add(room *MUCRoom) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.rooms[strings.ToLower(room.Jid)] = room
+}
+
+func (self *mucState) remove(jid string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.rooms, strings.ToLower(ToBareJID(jid)))
+}
+
+// mucPresenceHandler waits for our own presence in a room, or the error of joining it.
+// The room may have changed our nick, so its self-presence is recognized by status 110.
+type mucPresenceHandler struct {
+	from string
+	DefaultHandler
+}
+
+func newMUCPresenceHandler(from string) Handler {
+	h := &mucPresenceHandler{}
+	h.EventCh = make(chan *Event, 1)
+	h.from = from
+	return h
+}
+
+func (self *mucPresenceHandler) Filter(event *Event) bool {
+	if event.Type == Stanza {
+		if presence, ok := event.Stanza.(*Presence); ok {
+			if presence.Type == "unavailable" || !strings.EqualFold(ToBareJID(presence.From), ToBareJID(self.from)) {
+				return false
+			}
+			return presence.Type == "error" || strings.EqualFold(presence.From, self.from) ||
+				(presence.MUCUser != nil && presence.MUCUser.HasStatus(110))
+		}
+	}
+	return false
+}
+
+func (self *mucPresenceHandler) IsOneTime() bool {
+	return true
+}
+
+// Groupchat handler
+type GroupChatHandler struct {
+	DefaultHandler
+}
+
+func NewGroupChatHandler() Handler {
+	h := &GroupChatHandler{}
+	h.EventCh = make(chan *Event)
+	return h
+}
+
+func (self *GroupChatHandler) Filter(event *Event) bool {
+	if event.Type == Stanza {
+		if msg, ok := event.Stanza.(*Message); ok {
+			return msg.Type == "groupchat" && len(msg.Body) > 0
+		}
+	}
+	return false
+}
+
+func (self *GroupChatHandler) IsOneTime() bool {
+	return false
+}
+
+// JoinRoom enters the room roomJid with nick and waits until the room
+// has sent our own presence. opts may be nil.
+func (self *XmppClient) JoinRoom(roomJid, nick string, opts *MUCJoinOptions) (*MUCRoom, error) {
+	room := &MUCRoom{
+		Jid:       ToBareJID(roomJid),
+		Nick:      nick,
+		occupants: make(map[string]*MUCOccupant),
+		options:   opts,
+	}
+	if opts != nil {
+		room.Password = opts.Password
+	}
+	if err := self.joinRoom(room, opts.history()); err != nil {
+		self.muc.remove(room.Jid)
+		return nil, err
+	}
+	return room, nil
+}
+
+func (self *XmppClient) joinRoom(room *MUCRoom, history *MUCHistory) error {
+	retries := 0
+	if room.options != nil {
+		retries = room.options.ConflictRetries
+	}
+	self.muc.add(room)
+	for {
+		err := self.sendJoin(room, history)
+		if err != ErrMUCNickConflict || retries <= 0 {
+			return err
+		}
+		retries--
+		room.mutex.Lock()
+		room.Nick += "_"
+		room.mutex.Unlock()
+	}
+}
+
+func (self *XmppClient) sendJoin(room *MUCRoom, history *MUCHistory) error {
+	room.mutex.Lock()
+	to := room.Jid + "/" + room.Nick
+	room.mutex.Unlock()
+	presence := &Presence{
+		To: to,
+		MUC: &MUCJoin{
+			Password: room.Password,
+			History:  history,
+		},
+	}
+	return self.sendRoomPresence(presence)
+}
+
+// sendRoomPresence sends presence to an occupant jid of ours and waits for the room to reflect it.
+func (self *XmppClient) sendRoomPresence(presence *Presence) error {
+	roomHandler := newMUCPresenceHandler(presence.To)
+	self.AddHandler(roomHandler)
+	if err := self.Send(presence); err != nil {
+		self.RemoveHandler(roomHandler)
+		return err
+	}
+	event := roomHandler.GetEvent(10 * time.Second)
+	if event == nil {
+		self.RemoveHandler(roomHandler)
+		return errors.New("No presence from room " + ToBareJID(presence.To))
+	}
+	resp := event.Stanza.(*Presence)
+	if resp.Type != "error" {
+		return nil
+	}
+	if resp.Error == nil {
+		return errors.New("Presence to room " + ToBareJID(presence.To) + " failed")
+	}
+	if resp.Error.Condition() == "conflict" {
+		return ErrMUCNickConflict
+	}
+	return resp.Error
+}
+
+// LeaveRoom exits the room; the room is not rejoined after reconnecting.
+func (self *XmppClient) LeaveRoom(roomJid string) error {
+	room := self.muc.room(roomJid)
+	if room == nil {
+		return errors.New("Not in room " + roomJid)
+	}
+	self.muc.remove(roomJid)
+	room.mutex.Lock()
+	to := room.Jid + "/" + room.Nick
+	room.Joined = false
+	room.mutex.Unlock()
+	return self.Send(&Presence{To: to, Type: "unavailable"})
+}
+
+// Room returns the joined room with jid roomJid, or nil.
+func (self *XmppClient) Room(roomJid string) *MUCRoom {
+	return self.muc.room(roomJid)
+}
+
+func (self *XmppClient) Rooms() []*MUCRoom {
+	self.muc.mutex.Lock()
+	defer self.muc.mutex.Unlock()
+	rooms := make([]*MUCRoom, 0, len(self.muc.rooms))
+	for _, r := range self.muc.rooms {
+		rooms = append(rooms, r)
+	}
+	return rooms
+}
+
+func (self *XmppClient) SendGroupChatMessage(roomJid, content string) error {
+	msg := &Message{
+		To:   ToBareJID(roomJid),
+		Type: "groupchat",
+		Body: content,
+	}
+	return self.Send(msg)
+}
+
+func (self *XmppClient) SetRoomSubject(roomJid, subject string) error {
+	msg := &Message{
+		To:      ToBareJID(roomJid),
+		Type:    "groupchat",
+		Subject: subject,
+	}
+	return self.Send(msg)
+}
+
+// ChangeNick changes our nickname in a joined room.
+func (self *XmppClient) ChangeNick(roomJid, nick string) error {
+	room := self.muc.room(roomJid)
+	if room == nil {
+		return errors.New("Not in room " + roomJid)
+	}
+	if err := self.sendRoomPresence(&Presence{To: room.Jid + "/" + nick}); err != nil {
+		return err
+	}
+	room.mutex.Lock()
+	room.Nick = nick
+	room.mutex.Unlock()
+	return nil
+}
+
+// SetRole changes the role of the occupant nick, e.g. "none" to kick, "participant" to grant voice.
+func (self *XmppClient) SetRole(roomJid, nick, role, reason string) error {
+	return self.mucAdmin(roomJid, MUCItem{Nick: nick, Role: role, Reason: reason})
+}
+
+// SetAffiliation changes the affiliation of jid, e.g. "outcast" to ban, "member" to grant membership.
+func (self *XmppClient) SetAffiliation(roomJid, jid, affiliation, reason string) error {
+	return self.mucAdmin(roomJid, MUCItem{Jid: ToBareJID(jid), Affiliation: affiliation, Reason: reason})
+}
+
+func (self *XmppClient) Kick(roomJid, nick, reason string) error {
+	return self.SetRole(roomJid, nick, "none", reason)
+}
+
+func (self *XmppClient) Ban(roomJid, jid, reason string) error {
+	return self.SetAffiliation(roomJid, jid, "outcast", reason)
+}
+
+func (self *XmppClient) GrantVoice(roomJid, nick string) error {
+	return self.SetRole(roomJid, nick, "participant", "")
+}
+
+func (self *XmppClient) RevokeVoice(roomJid, nick string) error {
+	return self.SetRole(roomJid, nick, "visitor", "")
+}
+
+func (self *XmppClient) mucAdmin(roomJid string, item MUCItem) error {
+	iq := &IQ{
+		To:       ToBareJID(roomJid),
+		Type:     "set",
+		MUCAdmin: &MUCAdminQuery{Items: []MUCItem{item}},
+	}
+	_, err := self.sendIQ(iq)
+	return err
+}
+
+// rejoinRooms enters the rooms again after reconnecting, asking only for the history we missed.
+// Rooms failing to join stay registered and are tried again on the next reconnect.
+func (self *XmppClient) rejoinRooms() {
+	for _, room := range self.Rooms() {
+		room.mutex.Lock()
+		room.Joined = false
+		room.occupants = make(map[string]*MUCOccupant)
+		history := room.options.history()
+		if !room.lastMsg.IsZero() {
+			history = &MUCHistory{Since: room.lastMsg.UTC().Format(time.RFC3339)}
+		}
+		room.mutex.Unlock()
+		if err := self.joinRoom(room, history); err != nil && Debug {
+			fmt.Printf("Rejoin room %s error: %v\n", room.Jid, err)
+		}
+	}
+}
+
+func (self *XmppClient) processMUC(event *Event) bool {
+	switch stanza := event.Stanza.(type) {
+	case *Presence:
+		room := self.muc.room(stanza.From)
+		if room == nil || stanza.Type == "error" {
+			return true
+		}
+		self.updateOccupant(room, stanza)
+	case *Message:
+		if stanza.Type != "groupchat" {
+			return true
+		}
+		room := self.muc.room(stanza.From)
+		if room == nil {
+			return true
+		}
+		room.mutex.Lock()
+		if stanza.Subject != "" && stanza.Body == "" {
+			room.Subject = stanza.Subject
+		}
+		if stanza.Body != "" {
+			room.lastMsg = time.Now()
+		}
+		room.mutex.Unlock()
+	}
+	return true
+}
+
+func (self *XmppClient) updateOccupant(room *MUCRoom, presence *Presence) {
+	i := strings.Index(presence.From, "/")
+	if i < 0 {
+		return
+	}
+	nick := presence.From[i+1:]
+	user := presence.MUCUser
+	if user == nil {
+		user = &MUCUser{}
+	}
+	var item MUCItem
+	if len(user.Items) > 0 {
+		item = user.Items[0]
+	}
+
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	self110 := user.HasStatus(110) || nick == room.Nick
+	if presence.Type == "unavailable" {
+		delete(room.occupants, nick)
+		if self110 {
+			if user.HasStatus(303) && item.Nick != "" {
+				// nickname changed, the presence of the new nickname follows
+				room.Nick = item.Nick
+				return
+			}
+			// kicked, banned or the room was destroyed
+			room.Joined = false
+			self.muc.remove(room.Jid)
+		}
+		return
+	}
+	room.occupants[nick] = &MUCOccupant{
+		Nick:        nick,
+		Jid:         item.Jid,
+		Affiliation: item.Affiliation,
+		Role:        item.Role,
+		Presence:    presence,
+	}
+	if user.HasStatus(110) {
+		// the server may have modified our nickname (status 210)
+		room.Nick = nick
+		room.Joined = true
+		room.Locked = user.HasStatus(201)
+	}
+}
@@ -0,0 +1,160 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMUCOccupants(t *testing.T) {
+	xmppClient := NewXmppClient(ClientConfig{false, 1, 10 * time.Second, false, 0})
+	room := &MUCRoom{Jid: "ops@conference.example.com", Nick: "bot", occupants: make(map[string]*MUCOccupant)}
+	xmppClient.muc.add(room)
+
+	var presence Presence
+	err := xml.Unmarshal([]byte(`<presence xmlns="jabber:client" from="ops@conference.example.com/alice">
+		<x xmlns="http://jabber.org/protocol/muc#user"><item affiliation="admin" role="moderator"/></x></presence>`), &presence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xmppClient.processStanza(&Event{Stanza, &presence, nil, ""})
+	self := &Presence{From: "ops@conference.example.com/bot2", MUCUser: &MUCUser{
+		Items:  []MUCItem{{Affiliation: "none", Role: "participant"}},
+		Status: []MUCStatus{{"110"}, {"210"}},
+	}}
+	xmppClient.processStanza(&Event{Stanza, self, nil, ""})
+
+	alice, ok := room.Occupant("alice")
+	if !ok || alice.Role != "moderator" || alice.Affiliation != "admin" {
+		t.Fatalf("unexpected occupant: %+v", alice)
+	}
+	if !room.Joined || room.Nick != "bot2" {
+		t.Fatalf("self-presence not applied: joined=%v nick=%s", room.Joined, room.Nick)
+	}
+
+	xmppClient.processStanza(&Event{Stanza, &Presence{From: "ops@conference.example.com/alice", Type: "unavailable"}, nil, ""})
+	if len(room.Occupants()) != 1 {
+		t.Fatalf("occupant not removed: %v", room.Occupants())
+	}
+}
+
+func TestStanzaErrorCondition(t *testing.T) {
+	var presence Presence
+	err := xml.Unmarshal([]byte(`<presence xmlns="jabber:client" type="error"><error type="cancel">
+		<conflict xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></presence>`), &presence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if presence.Error == nil || presence.Error.Condition() != "conflict" {
+		t.Fatalf("unexpected error: %+v", presence.Error)
+	}
+	b, err := xml.Marshal(presence.Error)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<error xmlns="jabber:client" type="cancel"><conflict xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></conflict></error>`
+	if string(b) != expected {
+		t.Fatalf("got %s", b)
+	}
+}
+
+func TestRoomConfigForm(t *testing.T) {
+	var iq IQ
+	err := xml.Unmarshal([]byte(`<iq xmlns="jabber:client" type="result" from="ops@conference.example.com" id="c1">
+		<query xmlns="http://jabber.org/protocol/muc#owner"><x xmlns="jabber:x:data" type="form">
+		<field type="hidden" var="FORM_TYPE"><value>http://jabber.org/protocol/muc#roomconfig</value></field>
+		<field type="fixed"><value>Room configuration</value></field>
+		<field type="boolean" var="muc#roomconfig_persistentroom" label="Make room persistent"><value>0</value></field>
+		</x></query></iq>`), &iq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iq.MUCOwner == nil || iq.MUCOwner.Form == nil {
+		t.Fatal("configuration form not parsed")
+	}
+	form := iq.MUCOwner.Form
+	form.Set("muc#roomconfig_persistentroom", "1")
+	submit := form.Submit()
+	if submit.Type != "submit" || len(submit.Fields) != 2 {
+		t.Fatalf("unexpected submit form: %+v", submit)
+	}
+	if submit.Value("muc#roomconfig_persistentroom") != "1" || submit.Value("FORM_TYPE") == "" {
+		t.Fatalf("unexpected values: %+v", submit.Fields)
+	}
+}
+
+func TestMUCRejoinFailure(t *testing.T) {
+	server := newTestServer("example.com")
+	var fail int32
+	server.handle = func(from string, stanza interface{}) []interface{} {
+		presence, ok := stanza.(*Presence)
+		if !ok || presence.MUC == nil {
+			return nil
+		}
+		if atomic.LoadInt32(&fail) == 1 {
+			return []interface{}{&Presence{From: presence.To, To: from, Type: "error",
+				Error: &Error{Type: "wait", Any: xml.Name{Space: nsStanzas, Local: "service-unavailable"}}}}
+		}
+		return []interface{}{&Presence{From: presence.To, To: from, MUCUser: &MUCUser{
+			Items:  []MUCItem{{Affiliation: "member", Role: "participant"}},
+			Status: []MUCStatus{{"110"}},
+		}}}
+	}
+	alice := server.connect("alice@example.com/a")
+	if _, err := alice.JoinRoom("ops@conference.example.com", "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	joined := func(room *MUCRoom) bool {
+		room.mutex.Lock()
+		defer room.mutex.Unlock()
+		return room.Joined
+	}
+	atomic.StoreInt32(&fail, 1)
+	alice.rejoinRooms()
+	room := alice.muc.room("ops@conference.example.com")
+	if room == nil || joined(room) {
+		t.Fatal("room should stay registered and not joined after a failed rejoin")
+	}
+	atomic.StoreInt32(&fail, 0)
+	alice.rejoinRooms()
+	if !joined(room) {
+		t.Fatal("room not joined on the next rejoin")
+	}
+
+	atomic.StoreInt32(&fail, 1)
+	if _, err := alice.JoinRoom("dev@conference.example.com", "alice", nil); err == nil {
+		t.Fatal("expected join error")
+	}
+	if alice.muc.room("dev@conference.example.com") != nil {
+		t.Fatal("room failing the first join should not be registered")
+	}
+}
+
+func TestMUCNickRewrite(t *testing.T) {
+	server := newTestServer("example.com")
+	server.handle = func(from string, stanza interface{}) []interface{} {
+		presence, ok := stanza.(*Presence)
+		if !ok || presence.MUC == nil {
+			return nil
+		}
+		// the room normalizes its jid and assigns another nick
+		return []interface{}{&Presence{From: "ops@conference.example.com/alice (2)", To: from, MUCUser: &MUCUser{
+			Items:  []MUCItem{{Affiliation: "member", Role: "participant"}},
+			Status: []MUCStatus{{"110"}, {"210"}, {"not-a-code"}},
+		}}}
+	}
+	alice := server.connect("alice@example.com/a")
+	defer alice.Disconnect()
+	room, err := alice.JoinRoom("Ops@Conference.example.com", "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.mutex.Lock()
+	nick, joined := room.Nick, room.Joined
+	room.mutex.Unlock()
+	if nick != "alice (2)" || !joined {
+		t.Fatalf("assigned nick not adopted: %q, joined %v", nick, joined)
+	}
+}
@@ -0,0 +1,152 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+)
+
+// XEP-0045 owner use cases: creating, configuring and destroying rooms
+
+const nsMUCOwner = "http://jabber.org/protocol/muc#owner"
+
+var ErrMUCRoomExists = errors.New("xmpp: room already exists")
+
+type MUCOwnerQuery struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/muc#owner query"`
+	Form    *DataForm
+	Destroy *MUCDestroy
+}
+
+type MUCDestroy struct {
+	XMLName  xml.Name `xml:"destroy"`
+	Jid      string   `xml:"jid,attr,omitempty"` // alternate venue
+	Password string   `xml:"password,omitempty"`
+	Reason   string   `xml:"reason,omitempty"`
+}
+
+// CreateInstantRoom creates a room with the default configuration of the service.
+// If the room already exists, it is joined and ErrMUCRoomExists is returned.
+func (self *XmppClient) CreateInstantRoom(roomJid, nick string) (*MUCRoom, error) {
+	room, err := self.createRoom(roomJid, nick)
+	if err != nil {
+		return room, err
+	}
+	if err := self.ConfigureRoom(roomJid, &DataForm{Type: "submit"}); err != nil {
+		return room, err
+	}
+	room.mutex.Lock()
+	room.Locked = false
+	room.mutex.Unlock()
+	return room, nil
+}
+
+// CreateReservedRoom creates a room and submits the configuration form after configure has filled it.
+// If configure returns an error, the configuration is cancelled and the room destroyed by the service.
+func (self *XmppClient) CreateReservedRoom(roomJid, nick string, configure func(form *DataForm) error) (*MUCRoom, error) {
+	room, err := self.createRoom(roomJid, nick)
+	if err != nil {
+		return room, err
+	}
+	form, err := self.RoomConfig(roomJid)
+	if err != nil {
+		return room, err
+	}
+	if err := configure(form); err != nil {
+		self.ConfigureRoom(roomJid, &DataForm{Type: "cancel"})
+		self.muc.remove(roomJid)
+		return nil, err
+	}
+	if err := self.ConfigureRoom(roomJid, form.Submit()); err != nil {
+		return room, err
+	}
+	room.mutex.Lock()
+	room.Locked = false
+	room.mutex.Unlock()
+	return room, nil
+}
+
+func (self *XmppClient) createRoom(roomJid, nick string) (*MUCRoom, error) {
+	room, err := self.JoinRoom(roomJid, nick, nil)
+	if err != nil {
+		return nil, err
+	}
+	room.mutex.Lock()
+	locked := room.Locked
+	room.mutex.Unlock()
+	if !locked {
+		return room, ErrMUCRoomExists
+	}
+	return room, nil
+}
+
+// RoomConfig fetches the muc#roomconfig form of the room.
+func (self *XmppClient) RoomConfig(roomJid string) (*DataForm, error) {
+	iq := &IQ{
+		To:       ToBareJID(roomJid),
+		Type:     "get",
+		MUCOwner: &MUCOwnerQuery{},
+	}
+	resp, err := self.sendIQ(iq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.MUCOwner == nil || resp.MUCOwner.Form == nil {
+		return nil, errors.New("No configuration form from room " + roomJid)
+	}
+	return resp.MUCOwner.Form, nil
+}
+
+// ConfigureRoom submits form, which must be of type submit or cancel.
+func (self *XmppClient) ConfigureRoom(roomJid string, form *DataForm) error {
+	iq := &IQ{
+		To:       ToBareJID(roomJid),
+		Type:     "set",
+		MUCOwner: &MUCOwnerQuery{Form: form},
+	}
+	_, err := self.sendIQ(iq)
+	return err
+}
+
+// DestroyRoom destroys the room, occupants may be pointed to the alternate room altJid.
+func (self *XmppClient) DestroyRoom(roomJid, reason, altJid string) error {
+	iq := &IQ{
+		To:   ToBareJID(roomJid),
+		Type: "set",
+		MUCOwner: &MUCOwnerQuery{
+			Destroy: &MUCDestroy{Jid: altJid, Reason: reason},
+		},
+	}
+	if _, err := self.sendIQ(iq); err != nil {
+		return err
+	}
+	self.muc.remove(roomJid)
+	return nil
+}
+
+// AffiliationList returns the users with affiliation, i.e. the member, admin, owner or outcast list.
+func (self *XmppClient) AffiliationList(roomJid, affiliation string) ([]MUCItem, error) {
+	iq := &IQ{
+		To:       ToBareJID(roomJid),
+		Type:     "get",
+		MUCAdmin: &MUCAdminQuery{Items: []MUCItem{{Affiliation: affiliation}}},
+	}
+	resp, err := self.sendIQ(iq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.MUCAdmin == nil {
+		return []MUCItem{}, nil
+	}
+	return resp.MUCAdmin.Items, nil
+}
+
+// SetAffiliations modifies the affiliation lists in one request, every item needs Jid and Affiliation.
+func (self *XmppClient) SetAffiliations(roomJid string, items []MUCItem) error {
+	iq := &IQ{
+		To:       ToBareJID(roomJid),
+		Type:     "set",
+		MUCAdmin: &MUCAdminQuery{Items: items},
+	}
+	_, err := self.sendIQ(iq)
+	return err
+}
@@ -0,0 +1,120 @@
+package xmpp
+
+import (
+	"encoding/xml"
+)
+
+// XEP-0163 Personal Eventing Protocol
+
+const (
+	NodeTune           = "http://jabber.org/protocol/tune"
+	NodeMood           = "http://jabber.org/protocol/mood"
+	NodeNick           = "http://jabber.org/protocol/nick"
+	NodeAvatarMetadata = "urn:xmpp:avatar:metadata"
+)
+
+// XEP-0118 User Tune
+type Tune struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/tune tune"`
+	Artist  string   `xml:"artist,omitempty"`
+	Length  int      `xml:"length,omitempty"` // seconds
+	Rating  int      `xml:"rating,omitempty"` // 1 to 10
+	Source  string   `xml:"source,omitempty"`
+	Title   string   `xml:"title,omitempty"`
+	Track   string   `xml:"track,omitempty"`
+	Uri     string   `xml:"uri,omitempty"`
+}
+
+// XEP-0107 User Mood
+type Mood struct {
+	XMLName xml.Name   `xml:"http://jabber.org/protocol/mood mood"`
+	Value   *MoodValue `xml:",any"`
+	Text    string     `xml:"text,omitempty"`
+}
+
+type MoodValue struct {
+	XMLName xml.Name
+}
+
+// Mood returns the mood, e.g. "happy", or "" if none.
+func (self *Mood) Mood() string {
+	if self.Value == nil {
+		return ""
+	}
+	return self.Value.XMLName.Local
+}
+
+// XEP-0172 User Nickname
+type Nick struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/nick nick"`
+	Nick    string   `xml:",chardata"`
+}
+
+// PublishPEP publishes the raw XML payload to node of our account, id is
+// usually "current" for the nodes holding a single state. options may be nil.
+func (self *XmppClient) PublishPEP(node, id string, payload []byte, options *DataForm) (string, error) {
+	return self.Publish("", node, id, payload, options)
+}
+
+// RetractPEP deletes the item id of node of our account, notifying our contacts.
+func (self *XmppClient) RetractPEP(node, id string) error {
+	return self.Retract("", node, id, true)
+}
+
+// PEPItems retrieves the items of node of the account jid, the last max ones if max > 0.
+func (self *XmppClient) PEPItems(jid, node string, max int) ([]PubSubItem, error) {
+	return self.Items(ToBareJID(jid), node, max)
+}
+
+// SupportsPEP reports whether our account is a PEP service.
+func (self *XmppClient) SupportsPEP() (bool, error) {
+	info, err := self.DiscoInfo(ToBareJID(self.client.jid), "")
+	if err != nil {
+		return false, err
+	}
+	return info.HasIdentity("pubsub", "pep"), nil
+}
+
+// AddPEPInterest advertises in our caps that we want the notifications of the
+// nodes of our contacts, they are delivered to the PubSub handlers.
+func (self *XmppClient) AddPEPInterest(nodes ...string) {
+	features := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		features = append(features, node+"+notify")
+	}
+	self.AddFeature(features...)
+}
+
+func (self *XmppClient) RemovePEPInterest(node string) {
+	self.RemoveFeature(node + "+notify")
+}
+
+func (self *XmppClient) publishPEP(node string, payload interface{}) error {
+	data, err := xml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = self.PublishPEP(node, "current", data, nil)
+	return err
+}
+
+// PublishTune publishes the tune we listen to, nil tells we stopped.
+func (self *XmppClient) PublishTune(tune *Tune) error {
+	if tune == nil {
+		tune = &Tune{}
+	}
+	return self.publishPEP(NodeTune, tune)
+}
+
+// PublishMood publishes our mood, e.g. "happy", an empty mood clears it.
+func (self *XmppClient) PublishMood(mood, text string) error {
+	m := &Mood{Text: text}
+	if mood != "" {
+		m.Value = &MoodValue{xml.Name{Space: NodeMood, Local: mood}}
+	}
+	return self.publishPEP(NodeMood, m)
+}
+
+func (self *XmppClient) PublishNick(nick string) error {
+	return self.publishPEP(NodeNick, &Nick{Nick: nick})
+}
@@ -0,0 +1,39 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestPEPInterest(t *testing.T) {
+	xmppClient := NewXmppClient(ClientConfig{})
+	ver := xmppClient.Caps().Ver
+	xmppClient.AddPEPInterest(NodeTune, NodeMood)
+	if !xmppClient.disco.info().HasFeature(NodeTune+"+notify") || xmppClient.Caps().Ver == ver {
+		t.Fatal("interest not advertised in caps")
+	}
+	xmppClient.RemovePEPInterest(NodeMood)
+	if xmppClient.disco.info().HasFeature(NodeMood + "+notify") {
+		t.Fatal("interest not removed")
+	}
+}
+
+func TestPEPPayloads(t *testing.T) {
+	data, err := xml.Marshal(&Mood{Value: &MoodValue{xml.Name{Space: NodeMood, Local: "happy"}}, Text: "Yay"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mood := &Mood{}
+	if err := xml.Unmarshal(data, mood); err != nil {
+		t.Fatal(err)
+	}
+	if mood.Mood() != "happy" || mood.Text != "Yay" {
+		t.Fatalf("mood not parsed back from %s", data)
+	}
+
+	item := PubSubItem{Payload: []byte(`<tune xmlns="http://jabber.org/protocol/tune"><artist>Yes</artist><length>686</length></tune>`)}
+	tune := &Tune{}
+	if err := item.Decode(tune); err != nil || tune.Artist != "Yes" || tune.Length != 686 {
+		t.Fatalf("tune not decoded: %+v %v", tune, err)
+	}
+}
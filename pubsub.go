@@ -0,0 +1,343 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"strconv"
+)
+
+// XEP-0060 Publish-Subscribe
+
+const (
+	nsPubSub               = "http://jabber.org/protocol/pubsub"
+	nsPubSubOwner          = "http://jabber.org/protocol/pubsub#owner"
+	nsPubSubEvent          = "http://jabber.org/protocol/pubsub#event"
+	nsPubSubPublishOptions = "http://jabber.org/protocol/pubsub#publish-options"
+	nsPubSubNodeConfig     = "http://jabber.org/protocol/pubsub#node_config"
+)
+
+type PubSub struct {
+	XMLName        xml.Name `xml:"http://jabber.org/protocol/pubsub pubsub"`
+	Create         *PubSubCreate
+	Configure      *PubSubConfigure
+	Publish        *PubSubPublish
+	PublishOptions *PubSubPublishOptions
+	Retract        *PubSubRetract
+	Subscribe      *PubSubSubscribe
+	Unsubscribe    *PubSubUnsubscribe
+	Subscription   *PubSubSubscription
+	Items          *PubSubItems
+}
+
+type PubSubCreate struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/pubsub create"`
+	Node    string   `xml:"node,attr,omitempty"`
+}
+
+type PubSubConfigure struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/pubsub configure"`
+	Form    *DataForm
+}
+
+type PubSubPublish struct {
+	XMLName xml.Name     `xml:"http://jabber.org/protocol/pubsub publish"`
+	Node    string       `xml:"node,attr"`
+	Items   []PubSubItem `xml:"item"`
+}
+
+type PubSubPublishOptions struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/pubsub publish-options"`
+	Form    *DataForm
+}
+
+type PubSubRetract struct {
+	XMLName xml.Name     `xml:"http://jabber.org/protocol/pubsub retract"`
+	Node    string       `xml:"node,attr"`
+	Notify  string       `xml:"notify,attr,omitempty"` // true or 1
+	Items   []PubSubItem `xml:"item"`
+}
+
+type PubSubSubscribe struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/pubsub subscribe"`
+	Node    string   `xml:"node,attr,omitempty"`
+	Jid     string   `xml:"jid,attr"`
+}
+
+type PubSubUnsubscribe struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/pubsub unsubscribe"`
+	Node    string   `xml:"node,attr,omitempty"`
+	Jid     string   `xml:"jid,attr"`
+	SubId   string   `xml:"subid,attr,omitempty"`
+}
+
+type PubSubSubscription struct {
+	XMLName      xml.Name `xml:"http://jabber.org/protocol/pubsub subscription"`
+	Node         string   `xml:"node,attr,omitempty"`
+	Jid          string   `xml:"jid,attr"`
+	SubId        string   `xml:"subid,attr,omitempty"`
+	Subscription string   `xml:"subscription,attr,omitempty"` // none, pending, subscribed, unconfigured
+}
+
+type PubSubItems struct {
+	XMLName  xml.Name     `xml:"http://jabber.org/protocol/pubsub items"`
+	Node     string       `xml:"node,attr"`
+	MaxItems string       `xml:"max_items,attr,omitempty"`
+	Items    []PubSubItem `xml:"item"`
+}
+
+// PubSubItem is a published item, Payload is its raw XML content.
+type PubSubItem struct {
+	Id        string `xml:"id,attr,omitempty"`
+	Publisher string `xml:"publisher,attr,omitempty"`
+	Payload   []byte `xml:",innerxml"`
+}
+
+// Decode unmarshals the payload of the item into v.
+func (self *PubSubItem) Decode(v interface{}) error {
+	return xml.Unmarshal(self.Payload, v)
+}
+
+type PubSubOwner struct {
+	XMLName   xml.Name `xml:"http://jabber.org/protocol/pubsub#owner pubsub"`
+	Configure *PubSubOwnerConfigure
+	Delete    *PubSubOwnerDelete
+}
+
+type PubSubOwnerConfigure struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/pubsub#owner configure"`
+	Node    string   `xml:"node,attr"`
+	Form    *DataForm
+}
+
+type PubSubOwnerDelete struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/pubsub#owner delete"`
+	Node    string   `xml:"node,attr"`
+}
+
+type PubSubEvent struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/pubsub#event event"`
+	Items   *PubSubEventItems
+	Delete  *PubSubEventNode `xml:"http://jabber.org/protocol/pubsub#event delete"`
+	Purge   *PubSubEventNode `xml:"http://jabber.org/protocol/pubsub#event purge"`
+}
+
+type PubSubEventItems struct {
+	XMLName  xml.Name     `xml:"http://jabber.org/protocol/pubsub#event items"`
+	Node     string       `xml:"node,attr"`
+	Items    []PubSubItem `xml:"item"`
+	Retracts []PubSubItem `xml:"retract"`
+}
+
+type PubSubEventNode struct {
+	Node string `xml:"node,attr"`
+}
+
+// PubSubNotification is the Stanza of the Notification events.
+type PubSubNotification struct {
+	From      string // the service, or the account of a PEP node
+	Node      string
+	Items     []PubSubItem
+	Retracted []string // ids of the retracted items
+	Deleted   bool
+	Purged    bool
+	Message   *Message
+}
+
+// NewPublishOptions returns the form of the preconditions of a publication,
+// e.g. pubsub#access_model.
+func NewPublishOptions() *DataForm {
+	return NewDataForm(FormTypeSubmit, nsPubSubPublishOptions)
+}
+
+// NewNodeConfig returns an empty node configuration form, e.g. for CreateNode.
+func NewNodeConfig() *DataForm {
+	return NewDataForm(FormTypeSubmit, nsPubSubNodeConfig)
+}
+
+// CreateNode creates node on the pubsub service, with the default configuration
+// if config is nil. An empty node creates an instant node, its name is returned.
+func (self *XmppClient) CreateNode(service, node string, config *DataForm) (string, error) {
+	pubsub := &PubSub{Create: &PubSubCreate{Node: node}}
+	if config != nil {
+		pubsub.Configure = &PubSubConfigure{Form: config}
+	}
+	resp, err := self.sendIQ(&IQ{To: service, Type: "set", PubSub: pubsub})
+	if err != nil {
+		return "", err
+	}
+	if resp.PubSub != nil && resp.PubSub.Create != nil && resp.PubSub.Create.Node != "" {
+		return resp.PubSub.Create.Node, nil
+	}
+	return node, nil
+}
+
+// NodeConfig returns the configuration form of node.
+func (self *XmppClient) NodeConfig(service, node string) (*DataForm, error) {
+	iq := &IQ{
+		To:          service,
+		Type:        "get",
+		PubSubOwner: &PubSubOwner{Configure: &PubSubOwnerConfigure{Node: node}},
+	}
+	resp, err := self.sendIQ(iq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.PubSubOwner == nil || resp.PubSubOwner.Configure == nil || resp.PubSubOwner.Configure.Form == nil {
+		return nil, errors.New("No configuration form of node " + node)
+	}
+	return resp.PubSubOwner.Configure.Form, nil
+}
+
+// ConfigureNode submits the configuration form of node.
+func (self *XmppClient) ConfigureNode(service, node string, form *DataForm) error {
+	iq := &IQ{
+		To:          service,
+		Type:        "set",
+		PubSubOwner: &PubSubOwner{Configure: &PubSubOwnerConfigure{Node: node, Form: form}},
+	}
+	_, err := self.sendIQ(iq)
+	return err
+}
+
+func (self *XmppClient) DeleteNode(service, node string) error {
+	iq := &IQ{
+		To:          service,
+		Type:        "set",
+		PubSubOwner: &PubSubOwner{Delete: &PubSubOwnerDelete{Node: node}},
+	}
+	_, err := self.sendIQ(iq)
+	return err
+}
+
+// Publish publishes the raw XML payload as the item id of node and returns the
+// item id, generated by the service if id is empty. options may be nil.
+func (self *XmppClient) Publish(service, node, id string, payload []byte, options *DataForm) (string, error) {
+	pubsub := &PubSub{Publish: &PubSubPublish{Node: node, Items: []PubSubItem{{Id: id, Payload: payload}}}}
+	if options != nil {
+		pubsub.PublishOptions = &PubSubPublishOptions{Form: options}
+	}
+	resp, err := self.sendIQ(&IQ{To: service, Type: "set", PubSub: pubsub})
+	if err != nil {
+		return "", err
+	}
+	if resp.PubSub != nil && resp.PubSub.Publish != nil && len(resp.PubSub.Publish.Items) > 0 {
+		return resp.PubSub.Publish.Items[0].Id, nil
+	}
+	return id, nil
+}
+
+// Retract deletes the item id of node, notify asks the service to tell the subscribers.
+func (self *XmppClient) Retract(service, node, id string, notify bool) error {
+	pubsub := &PubSub{Retract: &PubSubRetract{Node: node, Items: []PubSubItem{{Id: id}}}}
+	if notify {
+		pubsub.Retract.Notify = "true"
+	}
+	_, err := self.sendIQ(&IQ{To: service, Type: "set", PubSub: pubsub})
+	return err
+}
+
+// SubscribeNode subscribes our bare jid to node.
+func (self *XmppClient) SubscribeNode(service, node string) (*PubSubSubscription, error) {
+	pubsub := &PubSub{Subscribe: &PubSubSubscribe{Node: node, Jid: ToBareJID(self.client.jid)}}
+	resp, err := self.sendIQ(&IQ{To: service, Type: "set", PubSub: pubsub})
+	if err != nil {
+		return nil, err
+	}
+	if resp.PubSub == nil || resp.PubSub.Subscription == nil {
+		return &PubSubSubscription{Node: node, Jid: pubsub.Subscribe.Jid, Subscription: "subscribed"}, nil
+	}
+	return resp.PubSub.Subscription, nil
+}
+
+// UnsubscribeNode unsubscribes our bare jid from node, subId may be empty.
+func (self *XmppClient) UnsubscribeNode(service, node, subId string) error {
+	pubsub := &PubSub{Unsubscribe: &PubSubUnsubscribe{Node: node, Jid: ToBareJID(self.client.jid), SubId: subId}}
+	_, err := self.sendIQ(&IQ{To: service, Type: "set", PubSub: pubsub})
+	return err
+}
+
+// Items retrieves the items of node, the last max ones if max > 0.
+func (self *XmppClient) Items(service, node string, max int) ([]PubSubItem, error) {
+	query := &PubSubItems{Node: node}
+	if max > 0 {
+		query.MaxItems = strconv.Itoa(max)
+	}
+	return self.items(service, query)
+}
+
+// Item retrieves the item id of node.
+func (self *XmppClient) Item(service, node, id string) (*PubSubItem, error) {
+	items, err := self.items(service, &PubSubItems{Node: node, Items: []PubSubItem{{Id: id}}})
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		if items[i].Id == id {
+			return &items[i], nil
+		}
+	}
+	return nil, errors.New("No item " + id + " in node " + node)
+}
+
+func (self *XmppClient) items(service string, query *PubSubItems) ([]PubSubItem, error) {
+	resp, err := self.sendIQ(&IQ{To: service, Type: "get", PubSub: &PubSub{Items: query}})
+	if err != nil {
+		return nil, err
+	}
+	if resp.PubSub == nil || resp.PubSub.Items == nil {
+		return []PubSubItem{}, nil
+	}
+	return resp.PubSub.Items.Items, nil
+}
+
+// PubSub handler, it receives the notifications of node, or of all the nodes if empty.
+type PubSubHandler struct {
+	DefaultHandler
+	node string
+}
+
+func NewPubSubHandler(node string) Handler {
+	h := &PubSubHandler{node: node}
+	h.EventCh = make(chan *Event)
+	return h
+}
+
+func (self *PubSubHandler) Filter(event *Event) bool {
+	if event.Type != Notification {
+		return false
+	}
+	notification := event.Stanza.(*PubSubNotification)
+	return self.node == "" || self.node == notification.Node
+}
+
+func (self *PubSubHandler) IsOneTime() bool {
+	return false
+}
+
+// processPubSub turns the event messages into Notification events.
+func (self *XmppClient) processPubSub(event *Event) bool {
+	msg, ok := event.Stanza.(*Message)
+	if !ok || msg.PubSubEvent == nil || msg.Type == "error" {
+		return true
+	}
+	e := msg.PubSubEvent
+	notification := &PubSubNotification{From: msg.From, Message: msg}
+	switch {
+	case e.Items != nil:
+		notification.Node = e.Items.Node
+		notification.Items = e.Items.Items
+		for _, r := range e.Items.Retracts {
+			notification.Retracted = append(notification.Retracted, r.Id)
+		}
+	case e.Delete != nil:
+		notification.Node = e.Delete.Node
+		notification.Deleted = true
+	case e.Purge != nil:
+		notification.Node = e.Purge.Node
+		notification.Purged = true
+	default:
+		return true
+	}
+	self.fireHandler(&Event{Notification, notification, nil, ""})
+	return false
+}
@@ -0,0 +1,115 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+type testEntry struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2005/Atom entry"`
+	Title   string   `xml:"title"`
+}
+
+func TestPubSubNotification(t *testing.T) {
+	data := `<message xmlns="jabber:client" from="pubsub.shakespeare.lit" to="francisco@denmark.lit" id="foo">
+  <event xmlns="http://jabber.org/protocol/pubsub#event">
+    <items node="princely_musings">
+      <item id="ae890ac52d0df67ed7cfdf51b644e901">
+        <entry xmlns="http://www.w3.org/2005/Atom"><title>Soliloquy</title></entry>
+      </item>
+      <retract id="old"/>
+    </items>
+  </event>
+</message>`
+	msg := &Message{}
+	if err := xml.Unmarshal([]byte(data), msg); err != nil {
+		t.Fatal(err)
+	}
+	xmppClient := NewXmppClient(ClientConfig{})
+	handler := NewPubSubHandler("princely_musings")
+	xmppClient.AddHandler(handler)
+	go func() {
+		if xmppClient.processStanza(&Event{Stanza, msg, nil, ""}) {
+			t.Error("event message not consumed")
+		}
+	}()
+	event := handler.GetEvent(-1)
+	notification := event.Stanza.(*PubSubNotification)
+	if notification.From != "pubsub.shakespeare.lit" || len(notification.Items) != 1 ||
+		len(notification.Retracted) != 1 || notification.Retracted[0] != "old" {
+		t.Fatalf("unexpected notification %+v", notification)
+	}
+	entry := &testEntry{}
+	if err := notification.Items[0].Decode(entry); err != nil || entry.Title != "Soliloquy" {
+		t.Fatalf("payload not decoded: %v", err)
+	}
+	if NewPubSubHandler("other").Filter(event) {
+		t.Fatal("notification of another node accepted")
+	}
+}
+
+func TestPubSubPublish(t *testing.T) {
+	published := []PubSubItem{}
+	server := newTestServer("example.com")
+	server.handle = func(from string, stanza interface{}) []interface{} {
+		iq := stanza.(*IQ)
+		resp := &IQ{Id: iq.Id, To: from, From: iq.To, Type: "result"}
+		switch {
+		case iq.PubSub != nil && iq.PubSub.Publish != nil:
+			options := iq.PubSub.PublishOptions
+			if options == nil || options.Form.Value("pubsub#access_model") != "whitelist" {
+				resp.Type = "error"
+				resp.Error = &Error{Type: "cancel", Any: xml.Name{Space: nsStanzas, Local: "conflict"}}
+				break
+			}
+			item := iq.PubSub.Publish.Items[0]
+			item.Id = "generated"
+			published = append(published, item)
+			resp.PubSub = &PubSub{Publish: &PubSubPublish{Node: iq.PubSub.Publish.Node, Items: []PubSubItem{{Id: item.Id}}}}
+		case iq.PubSub != nil && iq.PubSub.Items != nil:
+			resp.PubSub = &PubSub{Items: &PubSubItems{Node: iq.PubSub.Items.Node, Items: published}}
+		}
+		return []interface{}{resp}
+	}
+	alice := server.connect("alice@example.com/a")
+	defer alice.Disconnect()
+
+	payload, _ := xml.Marshal(&testEntry{Title: "Hello"})
+	options := NewPublishOptions()
+	options.Set("pubsub#access_model", "whitelist")
+	id, err := alice.Publish("pubsub.example.com", "news", "", payload, options)
+	if err != nil || id != "generated" {
+		t.Fatalf("publish returned %q, %v", id, err)
+	}
+	if _, err := alice.Publish("pubsub.example.com", "news", "", payload, nil); err == nil {
+		t.Fatal("publish options not sent")
+	}
+	items, err := alice.Items("pubsub.example.com", "news", 0)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("items: %v, %v", items, err)
+	}
+	entry := &testEntry{}
+	if err := items[0].Decode(entry); err != nil || entry.Title != "Hello" {
+		t.Fatalf("item payload %s", strings.TrimSpace(string(items[0].Payload)))
+	}
+}
+
+func TestPubSubInvalidAttributes(t *testing.T) {
+	iq := &IQ{}
+	err := xml.Unmarshal([]byte(`<iq xmlns="jabber:client" type="set" id="r1"><pubsub xmlns="http://jabber.org/protocol/pubsub">
+		<retract node="news" notify="yes"><item id="1"/></retract></pubsub></iq>`), iq)
+	if err != nil || iq.PubSub.Retract.Notify != "yes" {
+		t.Fatalf("retract not decoded: %v", err)
+	}
+	iq = &IQ{}
+	err = xml.Unmarshal([]byte(`<iq xmlns="jabber:client" type="get" id="i1"><pubsub xmlns="http://jabber.org/protocol/pubsub">
+		<items node="news" max_items="all"/></pubsub></iq>`), iq)
+	if err != nil || iq.PubSub.Items.Node != "news" {
+		t.Fatalf("items not decoded: %v", err)
+	}
+	data, _ := xml.Marshal(&PubSubItems{Node: "news", MaxItems: "2"})
+	if !strings.Contains(string(data), `max_items="2"`) {
+		t.Fatalf("max_items not encoded: %s", data)
+	}
+}
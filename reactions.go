@@ -0,0 +1,51 @@
+package xmpp
+
+import (
+	"encoding/xml"
+)
+
+// XEP-0444 Message Reactions
+
+const nsReactions = "urn:xmpp:reactions:0"
+
+type Reactions struct {
+	XMLName   xml.Name `xml:"urn:xmpp:reactions:0 reactions"`
+	Id        string   `xml:"id,attr"`
+	Reactions []string `xml:"reaction"`
+}
+
+// SendReactions sets our reactions to the message referenced by id, see
+// Message.ReferenceId. The reactions replace the previous ones, none removes them all.
+func (self *XmppClient) SendReactions(jid, id string, reactions ...string) error {
+	msg := &Message{
+		To:        jid,
+		Type:      self.messageType(jid),
+		Reactions: &Reactions{Id: id, Reactions: reactions},
+		StoreHint: &StoreHint{},
+	}
+	return self.Send(msg)
+}
+
+// Reaction handler
+type ReactionHandler struct {
+	DefaultHandler
+}
+
+func NewReactionHandler() Handler {
+	h := &ReactionHandler{}
+	h.EventCh = make(chan *Event)
+	return h
+}
+
+func (self *ReactionHandler) Filter(event *Event) bool {
+	if event.Type == Stanza {
+		if msg, ok := event.Stanza.(*Message); ok {
+			return msg.Reactions != nil && msg.Type != "error"
+		}
+	}
+	return false
+}
+
+func (self *ReactionHandler) IsOneTime() bool {
+	return false
+}
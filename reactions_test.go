@@ -0,0 +1,83 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestReactionsAndStanzaIds(t *testing.T) {
+	data := `<message xmlns="jabber:client" from="room@muc.example/alice" to="bob@example.com/res" type="groupchat" id="o1">` +
+		`<reactions xmlns="urn:xmpp:reactions:0" id="sid-1"><reaction>👍</reaction><reaction>🐢</reaction></reactions>` +
+		`<stanza-id xmlns="urn:xmpp:sid:0" id="sid-2" by="room@muc.example"/>` +
+		`<stanza-id xmlns="urn:xmpp:sid:0" id="forged" by="bob@example.com"/>` +
+		`<origin-id xmlns="urn:xmpp:sid:0" id="o1"/></message>`
+	msg := &Message{}
+	if err := xml.Unmarshal([]byte(data), msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Reactions == nil || msg.Reactions.Id != "sid-1" || len(msg.Reactions.Reactions) != 2 {
+		t.Fatalf("reactions not parsed: %+v", msg.Reactions)
+	}
+	if msg.OriginId == nil || msg.OriginId.Id != "o1" || len(msg.StanzaIds) != 2 {
+		t.Fatal("ids not parsed")
+	}
+
+	xmppClient := NewXmppClient(ClientConfig{})
+	xmppClient.jid = "bob@example.com/res"
+	event := &Event{Stanza, msg, nil, ""}
+	if !xmppClient.processStanza(event) {
+		t.Fatal("reaction dropped")
+	}
+	if len(msg.StanzaIds) != 1 || msg.ReferenceId() != "sid-2" {
+		t.Fatalf("untrusted stanza-id kept: %+v", msg.StanzaIds)
+	}
+	if !NewReactionHandler().Filter(event) || NewGroupChatHandler().Filter(event) {
+		t.Fatal("reaction without fallback body must only reach the reaction handler")
+	}
+
+	// rooms without stanza-ids
+	noSid := &Message{From: "room@muc.example/alice", Type: "groupchat", Id: "m1", OriginId: &OriginId{Id: "o2"}}
+	if noSid.ReferenceId() != "o2" {
+		t.Fatalf("unexpected reference id %s", noSid.ReferenceId())
+	}
+	noSid.OriginId = nil
+	if noSid.ReferenceId() != "m1" {
+		t.Fatalf("unexpected reference id %s", noSid.ReferenceId())
+	}
+
+	out := &Message{To: "alice@example.com", Type: "chat"}
+	xmppClient.decorateOriginId(out)
+	if out.Id == "" || out.OriginId == nil || out.OriginId.Id != out.Id {
+		t.Fatal("origin-id not added")
+	}
+}
+
+func TestReplyBody(t *testing.T) {
+	data := `<message xmlns="jabber:client" from="alice@example.com/x" type="chat" id="r1">` +
+		`<body>&gt; Anna wrote:
+&gt; Hi, how are you?
+Great</body>` +
+		`<reply xmlns="urn:xmpp:reply:0" to="anna@example.com/laptop" id="message-id1"/>` +
+		`<fallback xmlns="urn:xmpp:fallback:0" for="urn:xmpp:reply:0"><body start="0" end="33"/></fallback></message>`
+	msg := &Message{}
+	if err := xml.Unmarshal([]byte(data), msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Reply == nil || msg.Reply.Id != "message-id1" {
+		t.Fatal("reply not parsed")
+	}
+	if body := msg.ReplyBody(); body != "Great" {
+		t.Fatalf("ReplyBody() = %q", body)
+	}
+
+	// invalid ranges are left in the body
+	data = strings.Replace(data, `start="0" end="33"`, `start="zero" end="-1"`, 1)
+	msg = &Message{}
+	if err := xml.Unmarshal([]byte(data), msg); err != nil {
+		t.Fatal(err)
+	}
+	if body := msg.ReplyBody(); body != msg.Body {
+		t.Fatalf("ReplyBody() = %q", body)
+	}
+}
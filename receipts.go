@@ -0,0 +1,221 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+	"sync"
+	"time"
+)
+
+// XEP-0184 Message Delivery Receipts
+
+const nsReceipts = "urn:xmpp:receipts"
+
+type ReceiptRequest struct {
+	XMLName xml.Name `xml:"urn:xmpp:receipts request"`
+}
+
+type ReceiptReceived struct {
+	XMLName xml.Name `xml:"urn:xmpp:receipts received"`
+	Id      string   `xml:"id,attr"`
+}
+
+type ReceiptStatus int
+
+const (
+	ReceiptUnknown   = ReceiptStatus(0)
+	ReceiptPending   = ReceiptStatus(1)
+	ReceiptDelivered = ReceiptStatus(2)
+	ReceiptTimeout   = ReceiptStatus(3)
+)
+
+// ReceiptReport is the Stanza of the Receipt events.
+type ReceiptReport struct {
+	Id     string
+	To     string
+	Status ReceiptStatus
+}
+
+type trackedMessage struct {
+	to     string
+	status ReceiptStatus
+	timer  *time.Timer
+	done   chan int
+}
+
+// ReceiptTracker follows the receipts of the messages we requested them for.
+type ReceiptTracker struct {
+	client   *XmppClient
+	mutex    sync.Mutex
+	request  bool
+	reply    bool
+	allow    func(jid string) bool
+	timeout  time.Duration
+	messages map[string]*trackedMessage
+}
+
+func (self *ReceiptTracker) init(client *XmppClient) {
+	self.client = client
+	self.reply = true
+	self.timeout = 30 * time.Second
+	self.messages = make(map[string]*trackedMessage)
+}
+
+func (self *ReceiptTracker) track(id, to string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	m := &trackedMessage{to: to, status: ReceiptPending, done: make(chan int)}
+	m.timer = time.AfterFunc(self.timeout, func() {
+		self.report(id, "", ReceiptTimeout)
+	})
+	self.messages[id] = m
+}
+
+// untrack drops the pending message id without reporting it.
+func (self *ReceiptTracker) untrack(id string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if m, ok := self.messages[id]; ok {
+		m.timer.Stop()
+		delete(self.messages, id)
+	}
+}
+
+// report settles a pending message, from is checked against the recipient if not empty.
+func (self *ReceiptTracker) report(id, from string, status ReceiptStatus) {
+	self.mutex.Lock()
+	m, ok := self.messages[id]
+	if !ok || m.status != ReceiptPending ||
+		(from != "" && !strings.EqualFold(ToBareJID(from), ToBareJID(m.to))) {
+		self.mutex.Unlock()
+		return
+	}
+	m.status = status
+	m.timer.Stop()
+	close(m.done)
+	// keep the status for a while for Status and Wait, then forget it
+	m.timer = time.AfterFunc(self.timeout, func() {
+		self.Forget(id)
+	})
+	self.mutex.Unlock()
+	self.client.fireHandler(&Event{Receipt, &ReceiptReport{id, m.to, status}, nil, ""})
+}
+
+// Status returns the receipt status of the message id, settled messages are
+// forgotten after the receipt timeout.
+func (self *ReceiptTracker) Status(id string) ReceiptStatus {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if m, ok := self.messages[id]; ok {
+		return m.status
+	}
+	return ReceiptUnknown
+}
+
+// Wait blocks until the message id is delivered or timed out, and forgets it.
+func (self *ReceiptTracker) Wait(id string) ReceiptStatus {
+	self.mutex.Lock()
+	m, ok := self.messages[id]
+	self.mutex.Unlock()
+	if !ok {
+		return ReceiptUnknown
+	}
+	<-m.done
+	self.Forget(id)
+	return m.status
+}
+
+// Forget drops the status of the message id.
+func (self *ReceiptTracker) Forget(id string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if m, ok := self.messages[id]; ok && m.status != ReceiptPending {
+		m.timer.Stop()
+		delete(self.messages, id)
+	}
+}
+
+// SetRequestReceipts makes SendChatMessage request and track a receipt.
+func (self *XmppClient) SetRequestReceipts(request bool) {
+	self.receipts.mutex.Lock()
+	defer self.receipts.mutex.Unlock()
+	self.receipts.request = request
+}
+
+// SetReceiptTimeout sets how long a receipt is waited for, 30 seconds by default.
+func (self *XmppClient) SetReceiptTimeout(d time.Duration) {
+	self.receipts.mutex.Lock()
+	defer self.receipts.mutex.Unlock()
+	self.receipts.timeout = d
+}
+
+// SetAutoReceipts enables or disables answering receipt requests, enabled by default.
+func (self *XmppClient) SetAutoReceipts(reply bool) {
+	self.receipts.mutex.Lock()
+	self.receipts.reply = reply
+	self.receipts.mutex.Unlock()
+	if reply {
+		self.AddFeature(nsReceipts)
+	} else {
+		self.RemoveFeature(nsReceipts)
+	}
+}
+
+// SetReceiptPolicy sets the function deciding whether the receipt request of jid is
+// answered. By default only our own accounts and the contacts allowed to see our
+// presence get receipts, nil restores it.
+func (self *XmppClient) SetReceiptPolicy(allow func(jid string) bool) {
+	self.receipts.mutex.Lock()
+	defer self.receipts.mutex.Unlock()
+	self.receipts.allow = allow
+}
+
+func (self *XmppClient) Receipts() *ReceiptTracker {
+	return &self.receipts
+}
+
+// Receipt handler
+type ReceiptHandler struct {
+	DefaultHandler
+}
+
+func NewReceiptHandler() Handler {
+	h := &ReceiptHandler{}
+	h.EventCh = make(chan *Event)
+	return h
+}
+
+func (self *ReceiptHandler) Filter(event *Event) bool {
+	return event.Type == Receipt
+}
+
+func (self *ReceiptHandler) IsOneTime() bool {
+	return false
+}
+
+func (self *XmppClient) processReceipts(event *Event) bool {
+	msg, ok := event.Stanza.(*Message)
+	if !ok || msg.Type == "error" {
+		return true
+	}
+	if msg.ReceiptReceived != nil && msg.Carbon == "" {
+		// report outside the receiving goroutine, the receipt handlers may not be listening
+		go self.receipts.report(msg.ReceiptReceived.Id, msg.From, ReceiptDelivered)
+	}
+	if msg.ReceiptRequest != nil && msg.Id != "" && msg.Type != "groupchat" && msg.Carbon == "" {
+		self.receipts.mutex.Lock()
+		reply, allow := self.receipts.reply, self.receipts.allow
+		self.receipts.mutex.Unlock()
+		if allow == nil {
+			allow = self.presenceAuthorized
+		}
+		if reply && allow(msg.From) {
+			self.Send(&Message{
+				To:              msg.From,
+				Id:              RandomString(10),
+				ReceiptReceived: &ReceiptReceived{Id: msg.Id},
+			})
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReceiptTracker(t *testing.T) {
+	xmppClient := NewXmppClient(ClientConfig{})
+	xmppClient.SetReceiptTimeout(50 * time.Millisecond)
+	tracker := xmppClient.Receipts()
+	tracker.track("m1", "juliet@capulet.example/balcony")
+	tracker.track("m2", "juliet@capulet.example/balcony")
+
+	receipt := &Message{From: "mallory@evil.example/x", ReceiptReceived: &ReceiptReceived{Id: "m1"}}
+	tracker.report(receipt.ReceiptReceived.Id, receipt.From, ReceiptDelivered)
+	if tracker.Status("m1") != ReceiptPending {
+		t.Fatal("receipt from another jid accepted")
+	}
+	tracker.report("m1", "juliet@capulet.example/chamber", ReceiptDelivered)
+	if tracker.Wait("m1") != ReceiptDelivered {
+		t.Fatal("message not delivered")
+	}
+	if tracker.Status("m1") != ReceiptUnknown {
+		t.Fatal("message not forgotten after Wait")
+	}
+	if tracker.Wait("m2") != ReceiptTimeout {
+		t.Fatal("message without receipt not timed out")
+	}
+
+	// settled messages nobody waits for are forgotten
+	tracker.track("m3", "juliet@capulet.example/balcony")
+	tracker.report("m3", "juliet@capulet.example/balcony", ReceiptDelivered)
+	if tracker.Status("m3") != ReceiptDelivered {
+		t.Fatal("message not delivered")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if tracker.Status("m3") != ReceiptUnknown {
+		t.Fatal("settled message not forgotten")
+	}
+	tracker.mutex.Lock()
+	left := len(tracker.messages)
+	tracker.mutex.Unlock()
+	if left != 0 {
+		t.Fatalf("%d messages left in the tracker", left)
+	}
+}
+
+func TestSendChatMessageError(t *testing.T) {
+	xmppClient := NewXmppClient(ClientConfig{})
+	xmppClient.SetRequestReceipts(true)
+	id, err := xmppClient.SendChatMessage("juliet@capulet.example", "hello")
+	if err == nil {
+		t.Fatal("expected error when not connected")
+	}
+	if xmppClient.Receipts().Status(id) != ReceiptUnknown {
+		t.Fatal("unsent message tracked")
+	}
+}
+
+func TestAutoReceiptsAuthorization(t *testing.T) {
+	server := newTestServer("example.com")
+	alice := server.connect("alice@example.com/a")
+	defer alice.Disconnect()
+	bob := server.connect("bob@example.com/b")
+	defer bob.Disconnect()
+	alice.SetRequestReceipts(true)
+	alice.SetReceiptTimeout(200 * time.Millisecond)
+
+	// bob isn't allowed to see our presence
+	id, err := alice.SendChatMessage("bob@example.com/b", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.Receipts().Wait(id) != ReceiptTimeout {
+		t.Fatal("receipt sent to a contact not subscribed to our presence")
+	}
+
+	bob.subs.updateRoster(&IQRoster{Items: []RosterItem{{Jid: "Alice@example.com", Subscription: "from"}}})
+	id, _ = alice.SendChatMessage("bob@example.com/b", "hello again")
+	if alice.Receipts().Wait(id) != ReceiptDelivered {
+		t.Fatal("receipt not sent to a subscribed contact")
+	}
+
+	bob.SetReceiptPolicy(func(jid string) bool {
+		return false
+	})
+	id, _ = alice.SendChatMessage("bob@example.com/b", "and again")
+	if alice.Receipts().Wait(id) != ReceiptTimeout {
+		t.Fatal("receipt policy not applied")
+	}
+}
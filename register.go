@@ -0,0 +1,169 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"strings"
+)
+
+// XEP-0077 In-Band Registration
+
+const nsRegister = "jabber:iq:register"
+
+var ErrRegistrationNotOffered = errors.New("xmpp: in-band registration not offered by the server")
+
+type registerFeature struct {
+	XMLName xml.Name `xml:"http://jabber.org/features/iq-register register"`
+}
+
+// RegisterQuery is the registration form, the legacy fields requested by the
+// server are empty instead of nil. Servers may use a data form instead.
+type RegisterQuery struct {
+	XMLName      xml.Name  `xml:"jabber:iq:register query"`
+	Instructions string    `xml:"instructions,omitempty"`
+	Registered   *struct{} `xml:"registered"`
+	Username     *string   `xml:"username"`
+	Nick         *string   `xml:"nick"`
+	Password     *string   `xml:"password"`
+	Name         *string   `xml:"name"`
+	Email        *string   `xml:"email"`
+	Remove       *struct{} `xml:"remove"`
+	Form         *DataForm
+}
+
+// request sends iq on a stream without read loop and waits for its response.
+func (c *Client) request(iq *IQ) (*IQ, error) {
+	if iq.Id == "" {
+		iq.Id = RandomString(10)
+	}
+	if err := c.Send(iq); err != nil {
+		return nil, err
+	}
+	for {
+		stanza, err := c.Recv()
+		if err != nil {
+			return nil, err
+		}
+		resp, ok := stanza.(*IQ)
+		if !ok || resp.Id != iq.Id || (resp.Type != "result" && resp.Type != "error") {
+			continue
+		}
+		if resp.Type == "error" {
+			if resp.Error != nil {
+				return resp, resp.Error
+			}
+			return resp, errors.New("xmpp: error response of iq " + iq.Id)
+		}
+		return resp, nil
+	}
+}
+
+// RegisterAccount creates the account jid with password on the server at host,
+// host as for NewClient. fill completes the registration form when the server
+// asks for more than the username and password, it may be nil.
+func RegisterAccount(host, jid, password string, fill func(query *RegisterQuery) error) error {
+	client, err := dial(host, jid)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.register(jid, password, fill)
+}
+
+func (c *Client) register(jid, password string, fill func(query *RegisterQuery) error) error {
+	a := strings.SplitN(ToBareJID(jid), "@", 2)
+	if len(a) != 2 {
+		return errors.New("xmpp: invalid username (want user@domain): " + jid)
+	}
+	username := a[0]
+	features, err := c.startStream(a[1])
+	if err != nil {
+		return err
+	}
+	if features.Register == nil {
+		return ErrRegistrationNotOffered
+	}
+	resp, err := c.request(&IQ{Type: "get", Register: &RegisterQuery{}})
+	if err != nil {
+		return err
+	}
+	if resp.Register == nil {
+		return errors.New("No registration form from " + c.domain)
+	}
+	query := fillRegistration(resp.Register, username, password)
+	if fill != nil {
+		if err := fill(query); err != nil {
+			c.request(&IQ{Type: "set", Register: &RegisterQuery{Form: CancelForm()}})
+			return err
+		}
+	}
+	if query.Form != nil {
+		query = &RegisterQuery{Form: query.Form.Submit()}
+	}
+	_, err = c.request(&IQ{Type: "set", Register: query})
+	return err
+}
+
+// fillRegistration returns the answer to the registration form with the
+// username and password set, in the data form if the server sent one.
+func fillRegistration(form *RegisterQuery, username, password string) *RegisterQuery {
+	if form.Form != nil {
+		answer := &RegisterQuery{Instructions: form.Instructions, Form: form.Form}
+		for _, f := range form.Form.Fields {
+			switch f.Var {
+			case "username":
+				f.Values = []string{username}
+			case "password":
+				f.Values = []string{password}
+			}
+		}
+		return answer
+	}
+	empty := func(field *string) *string {
+		if field == nil {
+			return nil
+		}
+		return new(string)
+	}
+	return &RegisterQuery{
+		Instructions: form.Instructions,
+		Username:     &username,
+		Password:     &password,
+		Nick:         empty(form.Nick),
+		Name:         empty(form.Name),
+		Email:        empty(form.Email),
+	}
+}
+
+// ChangePassword changes the password of our account, the new password is
+// used when reconnecting.
+func (self *XmppClient) ChangePassword(password string) error {
+	username := strings.SplitN(ToBareJID(self.client.jid), "@", 2)[0]
+	query := &RegisterQuery{Username: &username, Password: &password}
+	resp, err := self.sendIQ(&IQ{To: self.domain, Type: "set", Register: query})
+	if xmppErr, ok := err.(*Error); ok && resp.Register != nil && resp.Register.Form != nil {
+		// the server wants the old password in its form
+		if xmppErr.Condition() != "not-authorized" && xmppErr.Condition() != "not-allowed" {
+			return err
+		}
+		form := resp.Register.Form
+		form.Set("username", username)
+		form.Set("old_password", self.password)
+		form.Set("password", password)
+		_, err = self.sendIQ(&IQ{To: self.domain, Type: "set", Register: &RegisterQuery{Form: form.Submit()}})
+	}
+	if err != nil {
+		return err
+	}
+	self.password = password
+	return nil
+}
+
+// CancelRegistration deletes our account on the server and disconnects.
+func (self *XmppClient) CancelRegistration() error {
+	if _, err := self.sendIQ(&IQ{To: self.domain, Type: "set", Register: &RegisterQuery{Remove: &struct{}{}}}); err != nil {
+		return err
+	}
+	self.Disconnect()
+	return nil
+}
@@ -0,0 +1,168 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"net"
+	"testing"
+)
+
+// registrationServer plays a server offering in-band registration with form
+// and checks the submitted registration with check.
+func registrationServer(conn net.Conn, form *RegisterQuery, check func(query *RegisterQuery) error) {
+	defer conn.Close()
+	p := xml.NewDecoder(conn)
+	if _, err := nextStart(p); err != nil {
+		return
+	}
+	conn.Write([]byte("<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' from='example.com' version='1.0'>" +
+		"<stream:features><register xmlns='http://jabber.org/features/iq-register'/></stream:features>"))
+	for {
+		_, stanza, err := next(p)
+		if err != nil {
+			return
+		}
+		iq, ok := stanza.(*IQ)
+		if !ok || iq.Register == nil {
+			continue
+		}
+		resp := &IQ{Id: iq.Id, Type: "result"}
+		if iq.Type == "get" {
+			resp.Register = form
+		} else if err := check(iq.Register); err != nil {
+			resp.Type = "error"
+			resp.Error = &Error{Type: "modify", Any: xml.Name{Space: nsStanzas, Local: "not-acceptable"}, Text: err.Error()}
+		}
+		data, _ := xml.Marshal(resp)
+		conn.Write(data)
+	}
+}
+
+func TestRegisterLegacy(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	empty := ""
+	form := &RegisterQuery{Instructions: "Choose a username", Username: &empty, Password: &empty, Email: &empty}
+	go registrationServer(serverSide, form, func(query *RegisterQuery) error {
+		if query.Username == nil || *query.Username != "alice" || query.Password == nil || *query.Password != "secret" {
+			return errors.New("missing credentials")
+		}
+		if query.Email == nil || *query.Email != "alice@example.org" {
+			return errors.New("missing email")
+		}
+		if query.Nick != nil {
+			return errors.New("unexpected nick")
+		}
+		return nil
+	})
+	client := &Client{conn: clientSide}
+	err := client.register("alice@example.com", "secret", func(query *RegisterQuery) error {
+		if query.Email == nil {
+			return errors.New("Email not requested")
+		}
+		*query.Email = "alice@example.org"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSide.Close()
+}
+
+func TestRegisterNotOffered(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	go func() {
+		defer serverSide.Close()
+		if _, err := nextStart(xml.NewDecoder(serverSide)); err != nil {
+			return
+		}
+		serverSide.Write([]byte("<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' from='example.com' version='1.0'>" +
+			"<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>"))
+	}()
+	client := &Client{conn: clientSide}
+	if err := client.register("alice@example.com", "secret", nil); err != ErrRegistrationNotOffered {
+		t.Fatal("expected ErrRegistrationNotOffered, got", err)
+	}
+	clientSide.Close()
+}
+
+func TestRegisterForm(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	dataForm := NewDataForm(FormTypeForm, nsRegister)
+	dataForm.AddField("username", FieldTextSingle, "Username").SetRequired(true)
+	dataForm.AddField("password", FieldTextPrivate, "Password").SetRequired(true)
+	dataForm.AddField("captcha", FieldTextSingle, "What is 2+2?").SetRequired(true)
+	go registrationServer(serverSide, &RegisterQuery{Form: dataForm}, func(query *RegisterQuery) error {
+		if query.Form == nil || query.Form.Type != FormTypeSubmit {
+			return errors.New("no form submitted")
+		}
+		if query.Form.Value("username") != "alice" || query.Form.Value("password") != "secret" || query.Form.Value("captcha") != "4" {
+			return errors.New("wrong values")
+		}
+		return nil
+	})
+	client := &Client{conn: clientSide}
+	err := client.register("alice@example.com", "secret", func(query *RegisterQuery) error {
+		query.Form.Set("captcha", "4")
+		return query.Form.Validate()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientSide, serverSide = net.Pipe()
+	go registrationServer(serverSide, &RegisterQuery{Form: dataForm}, func(query *RegisterQuery) error {
+		return errors.New("wrong captcha")
+	})
+	client = &Client{conn: clientSide}
+	err = client.register("alice@example.com", "secret", func(query *RegisterQuery) error {
+		query.Form.Set("captcha", "5")
+		return nil
+	})
+	if xmppErr, ok := err.(*Error); !ok || xmppErr.Condition() != "not-acceptable" {
+		t.Fatal("expected not-acceptable error, got", err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	removed := false
+	server := newTestServer("example.com")
+	server.handle = func(from string, stanza interface{}) []interface{} {
+		iq := stanza.(*IQ)
+		resp := &IQ{Id: iq.Id, To: from, From: iq.To, Type: "result"}
+		switch query := iq.Register; {
+		case query == nil:
+		case query.Remove != nil:
+			removed = true
+		case query.Form == nil:
+			// require the old password
+			form := NewDataForm(FormTypeForm, nsRegister)
+			form.AddField("username", FieldTextSingle, "Username")
+			form.AddField("old_password", FieldTextPrivate, "Old password")
+			form.AddField("password", FieldTextPrivate, "New password")
+			resp.Type = "error"
+			resp.Register = &RegisterQuery{Form: form}
+			resp.Error = &Error{Type: "modify", Any: xml.Name{Space: nsStanzas, Local: "not-authorized"}}
+		case query.Form.Value("old_password") != "secret" || query.Form.Value("username") != "alice":
+			resp.Type = "error"
+			resp.Error = &Error{Type: "modify", Any: xml.Name{Space: nsStanzas, Local: "not-acceptable"}}
+		}
+		return []interface{}{resp}
+	}
+	alice := server.connect("alice@example.com/a")
+	alice.password = "secret"
+	if err := alice.ChangePassword("newsecret"); err != nil {
+		t.Fatal(err)
+	}
+	if alice.password != "newsecret" {
+		t.Fatal("password not updated")
+	}
+	if err := alice.ChangePassword("other"); err == nil {
+		t.Fatal("expected error with wrong old password")
+	}
+	if err := alice.CancelRegistration(); err != nil {
+		t.Fatal(err)
+	}
+	if !removed {
+		t.Fatal("account not removed")
+	}
+}
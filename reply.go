@@ -0,0 +1,62 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// XEP-0461 Message Replies
+
+const nsReply = "urn:xmpp:reply:0"
+
+type Reply struct {
+	XMLName xml.Name `xml:"urn:xmpp:reply:0 reply"`
+	To      string   `xml:"to,attr,omitempty"`
+	Id      string   `xml:"id,attr"`
+}
+
+// SendReply answers the message original with content, quoting it for the
+// clients without reply support. It returns the id of the reply.
+func (self *XmppClient) SendReply(original *Message, content string) (string, error) {
+	jid := original.From
+	if original.Type == "groupchat" {
+		jid = ToBareJID(original.From)
+	}
+	quote := ""
+	if original.Body != "" {
+		quote = "> " + strings.Replace(strings.TrimRight(original.Body, "\n"), "\n", "\n> ", -1) + "\n"
+	}
+	msg := &Message{
+		Id:    RandomString(16),
+		To:    jid,
+		Type:  original.Type,
+		Body:  quote + content,
+		Reply: &Reply{To: original.From, Id: original.ReferenceId()},
+	}
+	if msg.Type == "" {
+		msg.Type = "chat"
+	}
+	if quote != "" {
+		msg.Fallbacks = []*Fallback{{For: nsReply, Bodies: []FallbackBody{NewFallbackBody(0, len([]rune(quote)))}}}
+	}
+	return msg.Id, self.Send(msg)
+}
+
+// ReplyBody returns the body of the message without the quote of the replied message.
+func (self *Message) ReplyBody() string {
+	body := []rune(self.Body)
+	for _, f := range self.Fallbacks {
+		if f.For != nsReply {
+			continue
+		}
+		// remove the ranges from the end so the offsets stay valid
+		for i := len(f.Bodies) - 1; i >= 0; i-- {
+			start, end, ok := f.Bodies[i].Range()
+			if !ok || end > len(body) {
+				continue
+			}
+			body = append(body[:start:start], body[end:]...)
+		}
+	}
+	return string(body)
+}
@@ -0,0 +1,123 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"strconv"
+)
+
+// XEP-0059 Result Set Management
+
+const nsRSM = "http://jabber.org/protocol/rsm"
+
+// RSMSet carries the numbers as strings, use SetMax, Limit, Total and Offset.
+type RSMSet struct {
+	XMLName xml.Name  `xml:"http://jabber.org/protocol/rsm set"`
+	Max     string    `xml:"max,omitempty"`
+	After   string    `xml:"after,omitempty"`
+	Before  *string   `xml:"before,omitempty"` // empty requests the last page
+	Index   string    `xml:"index,omitempty"`
+	Count   string    `xml:"count,omitempty"`
+	First   *RSMFirst `xml:"first,omitempty"`
+	Last    string    `xml:"last,omitempty"`
+}
+
+type RSMFirst struct {
+	Index string `xml:"index,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+func (self *RSMSet) SetMax(max int) {
+	self.Max = strconv.Itoa(max)
+}
+
+// Limit returns the requested page size, false if not set or invalid.
+func (self *RSMSet) Limit() (int, bool) {
+	return parseRSMInt(self.Max)
+}
+
+// Total returns the number of items of the whole result set, false if unknown.
+func (self *RSMSet) Total() (int, bool) {
+	return parseRSMInt(self.Count)
+}
+
+// Offset returns the index of the first item of the page, false if unknown.
+func (self *RSMSet) Offset() (int, bool) {
+	if self.First != nil && self.First.Index != "" {
+		return parseRSMInt(self.First.Index)
+	}
+	return parseRSMInt(self.Index)
+}
+
+func parseRSMInt(s string) (int, bool) {
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 {
+		return 0, false
+	}
+	return i, true
+}
+
+// RSMPager pages forward through a result set, issuing the request of each
+// page with the after cursor taken from the previous response.
+type RSMPager struct {
+	max    int
+	build  func(set *RSMSet) *IQ
+	result func(resp *IQ) (*RSMSet, bool)
+	send   func(iq *IQ) (*IQ, error)
+	after  string
+	done   bool
+}
+
+// NewRSMPager creates a pager requesting max items per page, max <= 0 leaves
+// the page size to the responder. build returns the request of a page carrying
+// set; result extracts the result set of a response and reports whether the
+// responder marked it complete.
+func (self *XmppClient) NewRSMPager(max int, build func(set *RSMSet) *IQ, result func(resp *IQ) (*RSMSet, bool)) *RSMPager {
+	return &RSMPager{
+		max:    max,
+		build:  build,
+		result: result,
+		send:   self.sendIQ,
+	}
+}
+
+// Next requests the next page and returns the response, or nil if the
+// result set is exhausted.
+func (self *RSMPager) Next() (*IQ, error) {
+	if self.done {
+		return nil, nil
+	}
+	set := &RSMSet{After: self.after}
+	if self.max > 0 {
+		set.SetMax(self.max)
+	}
+	resp, err := self.send(self.build(set))
+	if err != nil {
+		self.done = true
+		return nil, err
+	}
+	respSet, complete := self.result(resp)
+	if complete || respSet == nil || respSet.Last == "" || respSet.Last == self.after {
+		self.done = true
+	} else {
+		self.after = respSet.Last
+	}
+	return resp, nil
+}
+
+func (self *RSMPager) Done() bool {
+	return self.done
+}
+
+// ForEach calls fn with the response of every page until the result set is
+// exhausted or fn returns an error.
+func (self *RSMPager) ForEach(fn func(resp *IQ) error) error {
+	for {
+		resp, err := self.Next()
+		if err != nil || resp == nil {
+			return err
+		}
+		if err := fn(resp); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestRSMPager(t *testing.T) {
+	items := []string{"a", "b", "c", "d", "e"}
+	xmppClient := NewXmppClient(ClientConfig{})
+	pager := xmppClient.NewRSMPager(2, func(set *RSMSet) *IQ {
+		return &IQ{Type: "get", DiscoItems: &DiscoItemsQuery{Set: set}}
+	}, func(resp *IQ) (*RSMSet, bool) {
+		return resp.DiscoItems.Set, false
+	})
+	requests := 0
+	pager.send = func(iq *IQ) (*IQ, error) {
+		requests++
+		set := iq.DiscoItems.Set
+		start := 0
+		for i, item := range items {
+			if item == set.After {
+				start = i + 1
+			}
+		}
+		max, _ := set.Limit()
+		end := start + max
+		if end > len(items) {
+			end = len(items)
+		}
+		resp := &DiscoItemsQuery{Set: &RSMSet{}}
+		for _, item := range items[start:end] {
+			resp.Items = append(resp.Items, DiscoItem{Jid: item})
+		}
+		if start < end {
+			resp.Set.Last = items[end-1]
+		}
+		return &IQ{Type: "result", DiscoItems: resp}, nil
+	}
+
+	got := ""
+	err := pager.ForEach(func(resp *IQ) error {
+		for _, item := range resp.DiscoItems.Items {
+			got += item.Jid
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "abcde" {
+		t.Fatalf("unexpected items %s", got)
+	}
+	if requests != 4 || !pager.Done() {
+		t.Fatalf("unexpected number of requests: %d", requests)
+	}
+}
+
+func TestRSMSetInvalidNumbers(t *testing.T) {
+	set := &RSMSet{}
+	err := xml.Unmarshal([]byte(`<set xmlns="http://jabber.org/protocol/rsm"><max>ten</max>
+		<first index="-3">a</first><last>b</last><count>99999999999999999999</count></set>`), set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := set.Limit(); ok {
+		t.Fatal("invalid max accepted")
+	}
+	if _, ok := set.Offset(); ok {
+		t.Fatal("negative index accepted")
+	}
+	if _, ok := set.Total(); ok {
+		t.Fatal("overflowing count accepted")
+	}
+	set.SetMax(10)
+	if max, ok := set.Limit(); !ok || max != 10 {
+		t.Fatalf("unexpected max %d", max)
+	}
+}
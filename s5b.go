@@ -0,0 +1,458 @@
+package xmpp
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// XEP-0065 SOCKS5 Bytestreams
+
+const nsBytestreams = "http://jabber.org/protocol/bytestreams"
+
+// timeout of the connection and of the SOCKS5 handshake with a streamhost
+const s5bTimeout = 10 * time.Second
+
+type S5BQuery struct {
+	XMLName        xml.Name        `xml:"http://jabber.org/protocol/bytestreams query"`
+	Sid            string          `xml:"sid,attr,omitempty"`
+	Mode           string          `xml:"mode,attr,omitempty"`
+	DstAddr        string          `xml:"dstaddr,attr,omitempty"`
+	StreamHosts    []S5BStreamHost `xml:"streamhost"`
+	StreamHostUsed *S5BStreamHostUsed
+	Activate       string `xml:"activate,omitempty"`
+}
+
+type S5BStreamHost struct {
+	Jid  string `xml:"jid,attr"`
+	Host string `xml:"host,attr"`
+	Port string `xml:"port,attr,omitempty"`
+}
+
+func (self *S5BStreamHost) addr() string {
+	port := self.Port
+	if port == "" {
+		port = "1080"
+	}
+	return net.JoinHostPort(self.Host, port)
+}
+
+type S5BStreamHostUsed struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/bytestreams streamhost-used"`
+	Jid     string   `xml:"jid,attr"`
+}
+
+// S5BConn is a SOCKS5 bytestream with a peer, direct or through a proxy.
+type S5BConn struct {
+	net.Conn
+	local      string
+	peer       string
+	sid        string
+	streamHost string
+}
+
+func (self *S5BConn) Sid() string {
+	return self.sid
+}
+
+// StreamHost returns the jid of the streamhost used, the initiator for direct connections.
+func (self *S5BConn) StreamHost() string {
+	return self.streamHost
+}
+
+func (self *S5BConn) LocalAddr() net.Addr {
+	return &BytestreamAddr{"xmpp-s5b", self.local, self.sid}
+}
+
+func (self *S5BConn) RemoteAddr() net.Addr {
+	return &BytestreamAddr{"xmpp-s5b", self.peer, self.sid}
+}
+
+// s5bDstAddr returns the address requested from the streamhosts for a session.
+func s5bDstAddr(sid, initiator, target string) string {
+	h := sha1.Sum([]byte(sid + initiator + target))
+	return hex.EncodeToString(h[:])
+}
+
+// socks5Connect connects to the streamhost at addr, requesting dstAddr.
+func socks5Connect(addr, dstAddr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, s5bTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(s5bTimeout))
+	req := append([]byte{5, 1, 0, 3, byte(len(dstAddr))}, dstAddr...)
+	if _, err = conn.Write([]byte{5, 1, 0}); err == nil {
+		resp := make([]byte, 2)
+		if _, err = io.ReadFull(conn, resp); err == nil && resp[1] != 0 {
+			err = errors.New("SOCKS5 authentication refused by " + addr)
+		}
+	}
+	if err == nil {
+		_, err = conn.Write(append(req, 0, 0))
+	}
+	if err == nil {
+		// version, status, reserved, address type, address, port
+		resp := make([]byte, 4)
+		if _, err = io.ReadFull(conn, resp); err == nil && resp[1] != 0 {
+			err = errors.New("SOCKS5 connect refused by " + addr)
+		}
+		if err == nil {
+			err = skipSocks5Addr(conn, resp[3])
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func skipSocks5Addr(r io.Reader, addrType byte) error {
+	n := 0
+	switch addrType {
+	case 1:
+		n = 4
+	case 4:
+		n = 16
+	case 3:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return errors.New("Unknown SOCKS5 address type")
+	}
+	_, err := io.ReadFull(r, make([]byte, n+2))
+	return err
+}
+
+// socks5Accept answers the SOCKS5 handshake of conn and returns the requested address.
+// known tells whether the address is expected.
+func socks5Accept(conn net.Conn, known func(dstAddr string) bool) (string, error) {
+	conn.SetDeadline(time.Now().Add(s5bTimeout))
+	defer conn.SetDeadline(time.Time{})
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return "", err
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == 0
+	}
+	if head[0] != 5 || !noAuth {
+		conn.Write([]byte{5, 0xff})
+		return "", errors.New("Unsupported SOCKS5 client")
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+	req := make([]byte, 5)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", err
+	}
+	if req[0] != 5 || req[1] != 1 || req[3] != 3 {
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		return "", errors.New("Unsupported SOCKS5 request")
+	}
+	dst := make([]byte, int(req[4])+2)
+	if _, err := io.ReadFull(conn, dst); err != nil {
+		return "", err
+	}
+	dstAddr := string(dst[:len(dst)-2])
+	if !known(dstAddr) {
+		// host unreachable
+		conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+		return "", errors.New("Unknown SOCKS5 address " + dstAddr)
+	}
+	resp := append([]byte{5, 0, 0, 3, byte(len(dstAddr))}, dstAddr...)
+	_, err := conn.Write(append(resp, 0, 0))
+	return dstAddr, err
+}
+
+type s5bState struct {
+	mutex        sync.Mutex
+	accept       func(from, sid string) bool
+	listener     net.Listener
+	host         string
+	pending      map[string]chan net.Conn // by dstaddr
+	proxies      []S5BStreamHost
+	proxiesKnown bool
+}
+
+func (self *s5bState) init() {
+	self.pending = make(map[string]chan net.Conn)
+}
+
+// AcceptS5B sets which bytestreams offered by peers are accepted, they are
+// delivered to the bytestream handlers. By default the bytestreams are refused.
+func (self *XmppClient) AcceptS5B(accept func(from, sid string) bool) {
+	self.s5b.mutex.Lock()
+	defer self.s5b.mutex.Unlock()
+	self.s5b.accept = accept
+}
+
+// ListenS5B accepts direct connections of the peers on addr, e.g. ":0", and
+// offers host with the bound port as our streamhost. An empty host offers the
+// bound address.
+func (self *XmppClient) ListenS5B(addr, host string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	bound, port, _ := net.SplitHostPort(listener.Addr().String())
+	if host == "" {
+		host = bound
+	}
+	self.s5b.mutex.Lock()
+	if self.s5b.listener != nil {
+		self.s5b.mutex.Unlock()
+		listener.Close()
+		return errors.New("Already listening for SOCKS5 bytestreams")
+	}
+	self.s5b.listener = listener
+	self.s5b.host = net.JoinHostPort(host, port)
+	self.s5b.mutex.Unlock()
+	go self.acceptS5B(listener)
+	return nil
+}
+
+// CloseS5BListener stops accepting direct connections.
+func (self *XmppClient) CloseS5BListener() error {
+	self.s5b.mutex.Lock()
+	defer self.s5b.mutex.Unlock()
+	if self.s5b.listener == nil {
+		return nil
+	}
+	err := self.s5b.listener.Close()
+	self.s5b.listener = nil
+	self.s5b.host = ""
+	return err
+}
+
+func (self *XmppClient) acceptS5B(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			var ch chan net.Conn
+			_, err := socks5Accept(conn, func(dstAddr string) bool {
+				self.s5b.mutex.Lock()
+				defer self.s5b.mutex.Unlock()
+				ch = self.s5b.pending[dstAddr]
+				delete(self.s5b.pending, dstAddr)
+				return ch != nil
+			})
+			if err != nil {
+				conn.Close()
+				return
+			}
+			ch <- conn
+		}()
+	}
+}
+
+// expectDirect returns the channel receiving the direct connection requesting dstAddr.
+func (self *s5bState) expectDirect(dstAddr string) chan net.Conn {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	ch := make(chan net.Conn, 1)
+	self.pending[dstAddr] = ch
+	return ch
+}
+
+func (self *s5bState) unexpectDirect(dstAddr string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.pending, dstAddr)
+}
+
+// dropDirect stops expecting the direct connection requesting dstAddr and closes
+// the one delivered on direct if it isn't taken, even while its handshake ends.
+func (self *s5bState) dropDirect(dstAddr string, direct chan net.Conn) {
+	self.unexpectDirect(dstAddr)
+	if direct == nil {
+		return
+	}
+	go func() {
+		select {
+		case conn := <-direct:
+			conn.Close()
+		case <-time.After(s5bTimeout):
+		}
+	}()
+}
+
+// SetS5BProxies sets the proxies offered as streamhosts instead of discovering them.
+func (self *XmppClient) SetS5BProxies(proxies []S5BStreamHost) {
+	self.s5b.mutex.Lock()
+	defer self.s5b.mutex.Unlock()
+	self.s5b.proxies = proxies
+	self.s5b.proxiesKnown = true
+}
+
+// S5BProxies returns the bytestreams proxies of our server, they are discovered once.
+func (self *XmppClient) S5BProxies() ([]S5BStreamHost, error) {
+	self.s5b.mutex.Lock()
+	if self.s5b.proxiesKnown {
+		defer self.s5b.mutex.Unlock()
+		return self.s5b.proxies, nil
+	}
+	self.s5b.mutex.Unlock()
+
+	items, err := self.DiscoItems(self.domain, "")
+	if err != nil {
+		return nil, err
+	}
+	proxies := []S5BStreamHost{}
+	for _, item := range items.Items {
+		if item.Node != "" {
+			continue
+		}
+		info, err := self.DiscoInfo(item.Jid, "")
+		if err != nil || !info.HasIdentity("proxy", "bytestreams") {
+			continue
+		}
+		resp, err := self.sendIQ(&IQ{To: item.Jid, Type: "get", S5BQuery: &S5BQuery{}})
+		if err != nil || resp.S5BQuery == nil {
+			continue
+		}
+		proxies = append(proxies, resp.S5BQuery.StreamHosts...)
+	}
+	self.SetS5BProxies(proxies)
+	return proxies, nil
+}
+
+// streamHosts returns our streamhosts, the direct one first.
+func (self *XmppClient) streamHosts() []S5BStreamHost {
+	proxies, _ := self.S5BProxies()
+	hosts := []S5BStreamHost{}
+	self.s5b.mutex.Lock()
+	if self.s5b.host != "" {
+		host, port, _ := net.SplitHostPort(self.s5b.host)
+		hosts = append(hosts, S5BStreamHost{Jid: self.client.jid, Host: host, Port: port})
+	}
+	self.s5b.mutex.Unlock()
+	return append(hosts, proxies...)
+}
+
+// OpenS5B offers a SOCKS5 bytestream to the full jid, an empty sid is generated.
+func (self *XmppClient) OpenS5B(jid, sid string) (*S5BConn, error) {
+	if sid == "" {
+		sid = RandomString(16)
+	}
+	hosts := self.streamHosts()
+	if len(hosts) == 0 {
+		return nil, errors.New("No SOCKS5 streamhost to offer")
+	}
+	dstAddr := s5bDstAddr(sid, self.client.jid, jid)
+	direct := self.s5b.expectDirect(dstAddr)
+	defer self.s5b.dropDirect(dstAddr, direct)
+
+	// the target may wait for the connection and the handshake of every streamhost
+	timeout := time.After(time.Duration(2*len(hosts)) * s5bTimeout)
+	query := &S5BQuery{Sid: sid, Mode: "tcp", StreamHosts: hosts}
+	resp, err := self.sendIQUntil(&IQ{To: jid, Type: "set", S5BQuery: query}, timeout, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.S5BQuery == nil || resp.S5BQuery.StreamHostUsed == nil {
+		return nil, errors.New("No streamhost used by " + jid)
+	}
+	conn, err := self.connectStreamHost(resp.S5BQuery.StreamHostUsed.Jid, hosts, direct, dstAddr)
+	if err != nil {
+		return nil, err
+	}
+	if conn.streamHost != self.client.jid {
+		if err := self.activateS5B(conn.streamHost, sid, jid); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	conn.local, conn.peer, conn.sid = self.client.jid, jid, sid
+	return conn, nil
+}
+
+// connectStreamHost returns the initiator side of the bytestream through the
+// streamhost used, the direct connection if it's ours.
+func (self *XmppClient) connectStreamHost(used string, hosts []S5BStreamHost, direct chan net.Conn, dstAddr string) (*S5BConn, error) {
+	if used == self.client.jid {
+		select {
+		case conn := <-direct:
+			return &S5BConn{Conn: conn, streamHost: used}, nil
+		case <-time.After(s5bTimeout):
+			return nil, errors.New("No direct SOCKS5 connection")
+		}
+	}
+	for _, host := range hosts {
+		if host.Jid == used {
+			conn, err := socks5Connect(host.addr(), dstAddr)
+			if err != nil {
+				return nil, err
+			}
+			return &S5BConn{Conn: conn, streamHost: used}, nil
+		}
+	}
+	return nil, errors.New("Unknown streamhost used: " + used)
+}
+
+// activateS5B asks the proxy to start relaying the bytestream sid to target.
+func (self *XmppClient) activateS5B(proxy, sid, target string) error {
+	_, err := self.sendIQ(&IQ{To: proxy, Type: "set", S5BQuery: &S5BQuery{Sid: sid, Activate: target}})
+	return err
+}
+
+func (self *XmppClient) processS5B(event *Event) bool {
+	iq, ok := event.Stanza.(*IQ)
+	if !ok || iq.Type != "set" || iq.S5BQuery == nil || iq.S5BQuery.Activate != "" {
+		return true
+	}
+	query := iq.S5BQuery
+	self.s5b.mutex.Lock()
+	accept := self.s5b.accept
+	self.s5b.mutex.Unlock()
+	switch {
+	case query.Sid == "" || len(query.StreamHosts) == 0:
+		self.replyIQError(iq, "modify", "bad-request")
+	case query.Mode == "udp" || accept == nil || !accept(iq.From, query.Sid):
+		self.replyIQError(iq, "cancel", "not-acceptable")
+	default:
+		go self.connectS5B(iq)
+	}
+	return false
+}
+
+// connectS5B tries the streamhosts offered by iq in order, as the target.
+func (self *XmppClient) connectS5B(iq *IQ) {
+	query := iq.S5BQuery
+	dstAddr := s5bDstAddr(query.Sid, iq.From, self.client.jid)
+	for _, host := range query.StreamHosts {
+		conn, err := socks5Connect(host.addr(), dstAddr)
+		if err != nil {
+			continue
+		}
+		err = self.Send(&IQ{Id: iq.Id, To: iq.From, Type: "result",
+			S5BQuery: &S5BQuery{Sid: query.Sid, StreamHostUsed: &S5BStreamHostUsed{Jid: host.Jid}}})
+		if err != nil {
+			conn.Close()
+			return
+		}
+		s5bConn := &S5BConn{conn, self.client.jid, iq.From, query.Sid, host.Jid}
+		self.fireHandler(&Event{Bytestream, s5bConn, nil, ""})
+		return
+	}
+	self.replyIQError(iq, "cancel", "item-not-found")
+}
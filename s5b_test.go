@@ -0,0 +1,192 @@
+package xmpp
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// s5bProxyHandler answers the iqs of the test server as proxy.example.com.
+func s5bProxyHandler(proxy *S5BProxy) func(from string, stanza interface{}) []interface{} {
+	return func(from string, stanza interface{}) []interface{} {
+		iq, ok := stanza.(*IQ)
+		if !ok {
+			return nil
+		}
+		if iq.To == "proxy.example.com" && iq.S5BQuery != nil {
+			return []interface{}{proxy.HandleIQ(iq)}
+		}
+		resp := &IQ{Id: iq.Id, To: from, From: iq.To, Type: "result"}
+		switch {
+		case iq.DiscoItems != nil:
+			resp.DiscoItems = &DiscoItemsQuery{Items: []DiscoItem{{Jid: "proxy.example.com"}}}
+		case iq.DiscoInfo != nil && iq.To == "proxy.example.com":
+			resp.DiscoInfo = &DiscoInfoQuery{
+				Identities: []DiscoIdentity{{Category: "proxy", Type: "bytestreams"}},
+				Features:   []DiscoFeature{{nsBytestreams}},
+			}
+		}
+		return []interface{}{resp}
+	}
+}
+
+func TestS5B(t *testing.T) {
+	proxy, err := NewS5BProxy("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	server := newTestServer("example.com")
+	server.handle = s5bProxyHandler(proxy)
+	alice := server.connect("alice@example.com/a")
+	defer alice.Disconnect()
+	bob := server.connect("bob@example.com/b")
+	defer bob.Disconnect()
+	bob.AcceptS5B(func(from, sid string) bool { return true })
+	streamHandler := NewBytestreamHandler()
+	bob.AddHandler(streamHandler)
+
+	exchange := func(sid, streamHost string) {
+		conn, err := alice.OpenS5B("bob@example.com/b", sid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.StreamHost() != streamHost {
+			t.Fatalf("streamhost %s used instead of %s", conn.StreamHost(), streamHost)
+		}
+		event := streamHandler.GetEvent(time.Second)
+		if event == nil {
+			t.Fatal("no incoming bytestream")
+		}
+		incoming := event.Stanza.(*S5BConn)
+		if incoming.Sid() != sid || incoming.RemoteAddr().String() != "alice@example.com/a#"+sid {
+			t.Fatalf("unexpected bytestream %v", incoming.RemoteAddr())
+		}
+		go func() {
+			conn.Write([]byte("ping " + sid))
+			conn.Close()
+		}()
+		data, err := io.ReadAll(incoming)
+		if err != nil || string(data) != "ping "+sid {
+			t.Fatalf("received %q, %v", data, err)
+		}
+		incoming.Close()
+	}
+
+	if err := alice.ListenS5B("127.0.0.1:0", ""); err != nil {
+		t.Fatal(err)
+	}
+	exchange("direct", "alice@example.com/a")
+	alice.CloseS5BListener()
+	exchange("proxied", "proxy.example.com")
+
+	bob.AcceptS5B(nil)
+	if _, err := alice.OpenS5B("bob@example.com/b", ""); err == nil {
+		t.Fatal("refused bytestream opened")
+	}
+}
+
+func TestS5BUnreachableDirectHost(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the SOCKS5 handshake timeout")
+	}
+
+	proxy, err := NewS5BProxy("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	// accepts the connections but never answers the handshake
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	server := newTestServer("example.com")
+	server.handle = s5bProxyHandler(proxy)
+	alice := server.connect("alice@example.com/a")
+	defer alice.Disconnect()
+	bob := server.connect("bob@example.com/b")
+	defer bob.Disconnect()
+	bob.AcceptS5B(func(from, sid string) bool { return true })
+	streamHandler := NewBytestreamHandler()
+	bob.AddHandler(streamHandler)
+	alice.s5b.mutex.Lock()
+	alice.s5b.host = stalled.Addr().String()
+	alice.s5b.mutex.Unlock()
+
+	conn, err := alice.OpenS5B("bob@example.com/b", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.StreamHost() != "proxy.example.com" {
+		t.Fatalf("streamhost %s used instead of the proxy", conn.StreamHost())
+	}
+	if streamHandler.GetEvent(time.Second) == nil {
+		t.Fatal("no incoming bytestream")
+	}
+}
+
+func TestS5BProxyExpiry(t *testing.T) {
+	proxy, err := NewS5BProxy("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	proxy.mutex.Lock()
+	proxy.timeout = 50 * time.Millisecond
+	proxy.mutex.Unlock()
+
+	dstAddr := s5bDstAddr("s1", "alice@example.com/a", "bob@example.com/b")
+	conn, err := socks5Connect(proxy.Addr().String(), dstAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("waiting connection not closed", err)
+	}
+	proxy.mutex.Lock()
+	waiting := len(proxy.waiting)
+	proxy.mutex.Unlock()
+	if waiting != 0 {
+		t.Fatal("expired connection still waiting")
+	}
+	if err := proxy.Activate("s1", "alice@example.com/a", "bob@example.com/b"); err == nil {
+		t.Fatal("expired bytestream activated")
+	}
+}
+
+func TestS5BDropDirect(t *testing.T) {
+	var state s5bState
+	state.init()
+	direct := state.expectDirect("dst")
+	ours, peer := net.Pipe()
+	direct <- ours
+	state.dropDirect("dst", direct)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("unused direct connection not closed", err)
+	}
+	state.mutex.Lock()
+	pending := len(state.pending)
+	state.mutex.Unlock()
+	if pending != 0 {
+		t.Fatal("direct connection still expected")
+	}
+
+	// delivered after the negotiation ended
+	direct = state.expectDirect("dst")
+	state.dropDirect("dst", direct)
+	ours, peer = net.Pipe()
+	direct <- ours
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("late direct connection not closed", err)
+	}
+}
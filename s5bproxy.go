@@ -0,0 +1,164 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// connections not activated in time are closed
+const s5bProxyTimeout = 2 * time.Minute
+
+// S5BProxy is a SOCKS5 bytestreams proxy, it relays the pairs of connections
+// requesting the same address once they are activated. HandleIQ answers the
+// queries addressed to the proxy jid.
+type S5BProxy struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	waiting  map[string][]net.Conn // by dstaddr
+	timeout  time.Duration
+}
+
+// NewS5BProxy starts a proxy listening on addr, e.g. "127.0.0.1:0".
+func NewS5BProxy(addr string) (*S5BProxy, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &S5BProxy{listener: listener, waiting: make(map[string][]net.Conn), timeout: s5bProxyTimeout}
+	go proxy.serve()
+	return proxy, nil
+}
+
+func (self *S5BProxy) Addr() net.Addr {
+	return self.listener.Addr()
+}
+
+// StreamHost returns the streamhost of the proxy reachable as jid.
+func (self *S5BProxy) StreamHost(jid string) S5BStreamHost {
+	host, port, _ := net.SplitHostPort(self.listener.Addr().String())
+	return S5BStreamHost{Jid: jid, Host: host, Port: port}
+}
+
+func (self *S5BProxy) Close() error {
+	err := self.listener.Close()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, conns := range self.waiting {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	self.waiting = make(map[string][]net.Conn)
+	return err
+}
+
+func (self *S5BProxy) serve() {
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			self.mutex.Lock()
+			timeout := self.timeout
+			self.mutex.Unlock()
+			conn.SetDeadline(time.Now().Add(timeout))
+			dstAddr, err := socks5Accept(conn, func(dstAddr string) bool {
+				self.mutex.Lock()
+				defer self.mutex.Unlock()
+				return len(self.waiting[dstAddr]) < 2
+			})
+			if err != nil {
+				conn.Close()
+				return
+			}
+			conn.SetDeadline(time.Time{})
+			self.mutex.Lock()
+			self.waiting[dstAddr] = append(self.waiting[dstAddr], conn)
+			self.mutex.Unlock()
+			time.AfterFunc(timeout, func() {
+				self.expire(dstAddr, conn)
+			})
+		}()
+	}
+}
+
+// expire closes conn if it is still waiting for its activation.
+func (self *S5BProxy) expire(dstAddr string, conn net.Conn) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	conns := self.waiting[dstAddr]
+	for i, c := range conns {
+		if c == conn {
+			conns = append(conns[:i:i], conns[i+1:]...)
+			conn.Close()
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(self.waiting, dstAddr)
+	} else {
+		self.waiting[dstAddr] = conns
+	}
+}
+
+// Activate starts relaying the bytestream sid between initiator and target.
+func (self *S5BProxy) Activate(sid, initiator, target string) error {
+	dstAddr := s5bDstAddr(sid, initiator, target)
+	self.mutex.Lock()
+	conns := self.waiting[dstAddr]
+	if len(conns) != 2 {
+		self.mutex.Unlock()
+		return errors.New("Bytestream not connected: " + sid)
+	}
+	delete(self.waiting, dstAddr)
+	self.mutex.Unlock()
+	go relay(conns[0], conns[1])
+	return nil
+}
+
+// HandleIQ answers the streamhost queries and activations sent to the proxy.
+// It returns nil for the other iqs.
+func (self *S5BProxy) HandleIQ(iq *IQ) *IQ {
+	if iq.S5BQuery == nil {
+		return nil
+	}
+	resp := &IQ{Id: iq.Id, To: iq.From, From: iq.To, Type: "result"}
+	switch {
+	case iq.Type == "get":
+		resp.S5BQuery = &S5BQuery{StreamHosts: []S5BStreamHost{self.StreamHost(iq.To)}}
+	case iq.Type == "set" && iq.S5BQuery.Activate != "":
+		if err := self.Activate(iq.S5BQuery.Sid, iq.From, iq.S5BQuery.Activate); err != nil {
+			resp.Type = "error"
+			resp.Error = &Error{Type: "cancel", Any: xml.Name{Space: nsStanzas, Local: "item-not-found"}}
+		}
+	default:
+		resp.Type = "error"
+		resp.Error = &Error{Type: "modify", Any: xml.Name{Space: nsStanzas, Local: "bad-request"}}
+	}
+	return resp
+}
+
+// relay copies the data between a and b until both sides are done.
+func relay(a, b net.Conn) {
+	done := make(chan int, 2)
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- 1
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
@@ -0,0 +1,107 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"net"
+	"strings"
+	"sync"
+)
+
+// testServer plays the server side of in-process connections: it routes the
+// stanzas between its clients and lets handle answer the other ones, including
+// the iqs sent to bare jids.
+type testServer struct {
+	mutex   sync.Mutex
+	domain  string
+	clients map[string]*testConn
+	handle  func(from string, stanza interface{}) []interface{}
+}
+
+type testConn struct {
+	out  chan interface{}
+	conn net.Conn
+}
+
+func newTestServer(domain string) *testServer {
+	return &testServer{domain: domain, clients: make(map[string]*testConn)}
+}
+
+// connect returns a client connected as the full jid.
+func (self *testServer) connect(jid string) *XmppClient {
+	clientSide, serverSide := net.Pipe()
+	xmppClient := NewXmppClient(ClientConfig{})
+	xmppClient.client = &Client{conn: clientSide, jid: jid, domain: self.domain, p: xml.NewDecoder(clientSide)}
+	xmppClient.jid = jid
+	xmppClient.domain = self.domain
+	xmppClient.setConnected(true)
+	go xmppClient.startReadMessage()
+
+	c := &testConn{out: make(chan interface{}, 100), conn: serverSide}
+	self.mutex.Lock()
+	self.clients[jid] = c
+	self.mutex.Unlock()
+	go func() {
+		for stanza := range c.out {
+			data, _ := xml.Marshal(stanza)
+			if _, err := serverSide.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+	go self.serve(jid, serverSide)
+	return xmppClient
+}
+
+func (self *testServer) serve(jid string, conn net.Conn) {
+	p := xml.NewDecoder(conn)
+	for {
+		_, stanza, err := next(p)
+		if err != nil {
+			return
+		}
+		to := ""
+		switch s := stanza.(type) {
+		case *Message:
+			s.From, to = jid, s.To
+		case *Presence:
+			s.From, to = jid, s.To
+		case *IQ:
+			s.From, to = jid, s.To
+		}
+		self.route(jid, to, stanza)
+	}
+}
+
+func (self *testServer) route(from, to string, stanza interface{}) {
+	self.mutex.Lock()
+	dest, ok := self.clients[to]
+	_, isIQ := stanza.(*IQ)
+	if !ok && !isIQ {
+		for jid, c := range self.clients {
+			if to != "" && strings.EqualFold(ToBareJID(jid), to) {
+				dest, ok = c, true
+				break
+			}
+		}
+	}
+	sender := self.clients[from]
+	handle := self.handle
+	self.mutex.Unlock()
+	if ok {
+		dest.out <- stanza
+		return
+	}
+	if handle != nil {
+		for _, resp := range handle(from, stanza) {
+			sender.out <- resp
+		}
+	}
+}
+
+// send delivers a stanza of the server to the client connected as the full jid.
+func (self *testServer) send(to string, stanza interface{}) {
+	self.mutex.Lock()
+	c := self.clients[to]
+	self.mutex.Unlock()
+	c.out <- stanza
+}
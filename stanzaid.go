@@ -0,0 +1,82 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// XEP-0359 Unique and Stable Stanza IDs
+
+const nsSid = "urn:xmpp:sid:0"
+
+type OriginId struct {
+	XMLName xml.Name `xml:"urn:xmpp:sid:0 origin-id"`
+	Id      string   `xml:"id,attr"`
+}
+
+type StanzaId struct {
+	XMLName xml.Name `xml:"urn:xmpp:sid:0 stanza-id"`
+	Id      string   `xml:"id,attr"`
+	By      string   `xml:"by,attr"`
+}
+
+// StanzaIdBy returns the stanza-id assigned to the message by the entity by, or "".
+func (self *Message) StanzaIdBy(by string) string {
+	for _, sid := range self.StanzaIds {
+		if strings.EqualFold(sid.By, by) {
+			return sid.Id
+		}
+	}
+	return ""
+}
+
+// ReferenceId returns the id other messages use to reference this one:
+// the stanza-id assigned by the room in groupchats, the message id otherwise.
+// Rooms without stanza-ids fall back to the origin-id or the message id.
+func (self *Message) ReferenceId() string {
+	if self.Type == "groupchat" {
+		if id := self.StanzaIdBy(ToBareJID(self.From)); id != "" {
+			return id
+		}
+		if self.OriginId != nil && self.OriginId.Id != "" {
+			return self.OriginId.Id
+		}
+	}
+	if self.Id == "" && self.OriginId != nil {
+		return self.OriginId.Id
+	}
+	return self.Id
+}
+
+// decorateOriginId gives every outgoing message an id and the matching origin-id.
+func (self *XmppClient) decorateOriginId(stanza interface{}) {
+	msg, ok := stanza.(*Message)
+	if !ok || msg.OriginId != nil {
+		return
+	}
+	if msg.Id == "" {
+		msg.Id = RandomString(16)
+	}
+	msg.OriginId = &OriginId{Id: msg.Id}
+}
+
+// processStanzaIds drops the stanza-ids we can't trust, only our server
+// and the rooms may assign them.
+func (self *XmppClient) processStanzaIds(event *Event) bool {
+	msg, ok := event.Stanza.(*Message)
+	if !ok || len(msg.StanzaIds) == 0 {
+		return true
+	}
+	trusted := ToBareJID(self.jid)
+	if msg.Type == "groupchat" {
+		trusted = ToBareJID(msg.From)
+	}
+	ids := msg.StanzaIds[:0]
+	for _, sid := range msg.StanzaIds {
+		if strings.EqualFold(sid.By, trusted) {
+			ids = append(ids, sid)
+		}
+	}
+	msg.StanzaIds = ids
+	return true
+}
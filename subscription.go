@@ -0,0 +1,242 @@
+package xmpp
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+type SubscriptionMode int
+
+const (
+	// subscription requests are left to the user handlers
+	SubscriptionManual = SubscriptionMode(0)
+	// approve every subscription request
+	SubscriptionAcceptAll = SubscriptionMode(1)
+	// approve requests from the domains of SubscriptionPolicy.Domains, others are left to the user handlers
+	SubscriptionAcceptDomains = SubscriptionMode(2)
+	// deny every subscription request
+	SubscriptionRejectAll = SubscriptionMode(3)
+)
+
+// SubscriptionPolicy decides how incoming subscription requests are answered
+// without user code.
+type SubscriptionPolicy struct {
+	Mode    SubscriptionMode
+	Domains []string
+	// subscribe back to the contact after approving its request
+	Mutual bool
+}
+
+func (self SubscriptionPolicy) accepts(jid string) bool {
+	switch self.Mode {
+	case SubscriptionAcceptAll:
+		return true
+	case SubscriptionAcceptDomains:
+		domain, err := GetDomain(ToBareJID(jid))
+		if err != nil {
+			domain = ToBareJID(jid)
+		}
+		for _, d := range self.Domains {
+			if strings.EqualFold(d, domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type subscriptionState struct {
+	mutex   sync.Mutex
+	policy  SubscriptionPolicy
+	pending map[string]*Presence
+	roster  map[string]RosterItem
+}
+
+func (self *subscriptionState) init() {
+	self.pending = make(map[string]*Presence)
+	self.roster = make(map[string]RosterItem)
+}
+
+func (self *subscriptionState) setRoster(roster *IQRoster) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.roster = make(map[string]RosterItem)
+	if roster == nil {
+		return
+	}
+	for _, item := range roster.Items {
+		self.roster[ToBareJID(item.Jid)] = item
+	}
+}
+
+func (self *subscriptionState) updateRoster(roster *IQRoster) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, item := range roster.Items {
+		jid := ToBareJID(item.Jid)
+		if item.Subscription == "remove" {
+			delete(self.roster, jid)
+		} else {
+			self.roster[jid] = item
+		}
+	}
+}
+
+func (self *subscriptionState) removePending(jid string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.pending, ToBareJID(jid))
+}
+
+// presenceAuthorized reports whether jid may see our presence: our own accounts
+// and the contacts with a from or both subscription.
+func (self *XmppClient) presenceAuthorized(jid string) bool {
+	bare := ToBareJID(jid)
+	if strings.EqualFold(bare, ToBareJID(self.jid)) {
+		return true
+	}
+	self.subs.mutex.Lock()
+	defer self.subs.mutex.Unlock()
+	item, ok := self.subs.roster[bare]
+	if !ok {
+		for j, i := range self.subs.roster {
+			if strings.EqualFold(j, bare) {
+				item, ok = i, true
+				break
+			}
+		}
+	}
+	return ok && (item.Subscription == "from" || item.Subscription == "both")
+}
+
+// SetSubscriptionPolicy sets the policy applied to incoming subscription requests.
+func (self *XmppClient) SetSubscriptionPolicy(policy SubscriptionPolicy) {
+	self.subs.mutex.Lock()
+	defer self.subs.mutex.Unlock()
+	self.subs.policy = policy
+}
+
+func (self *XmppClient) GetSubscriptionPolicy() SubscriptionPolicy {
+	self.subs.mutex.Lock()
+	defer self.subs.mutex.Unlock()
+	return self.subs.policy
+}
+
+// Subscribe requests a subscription to the presence of jid.
+func (self *XmppClient) Subscribe(jid string) error {
+	return self.sendSubscriptionPresence(jid, "subscribe")
+}
+
+// Unsubscribe cancels our subscription to the presence of jid.
+func (self *XmppClient) Unsubscribe(jid string) error {
+	return self.sendSubscriptionPresence(jid, "unsubscribe")
+}
+
+// ApproveSubscription allows jid to see our presence.
+func (self *XmppClient) ApproveSubscription(jid string) error {
+	self.subs.removePending(jid)
+	return self.sendSubscriptionPresence(jid, "subscribed")
+}
+
+// DenySubscription refuses a subscription request, or cancels a subscription already approved.
+func (self *XmppClient) DenySubscription(jid string) error {
+	self.subs.removePending(jid)
+	return self.sendSubscriptionPresence(jid, "unsubscribed")
+}
+
+// PreApprove approves a subscription request of jid before it is sent (RFC 6121 3.4).
+func (self *XmppClient) PreApprove(jid string) error {
+	return self.sendSubscriptionPresence(jid, "subscribed")
+}
+
+func (self *XmppClient) sendSubscriptionPresence(jid, subType string) error {
+	presence := &Presence{
+		To:   ToBareJID(jid),
+		Type: subType,
+	}
+	return self.Send(presence)
+}
+
+// PendingSubscriptions returns the bare JIDs whose subscription requests are not answered yet.
+func (self *XmppClient) PendingSubscriptions() []string {
+	self.subs.mutex.Lock()
+	defer self.subs.mutex.Unlock()
+	jids := make([]string, 0, len(self.subs.pending))
+	for jid := range self.subs.pending {
+		jids = append(jids, jid)
+	}
+	sort.Strings(jids)
+	return jids
+}
+
+// OutgoingSubscriptions returns the roster contacts whose approval of our
+// subscription request is still pending (ask='subscribe').
+func (self *XmppClient) OutgoingSubscriptions() []string {
+	self.subs.mutex.Lock()
+	defer self.subs.mutex.Unlock()
+	jids := []string{}
+	for jid, item := range self.subs.roster {
+		if item.Ask == "subscribe" {
+			jids = append(jids, jid)
+		}
+	}
+	sort.Strings(jids)
+	return jids
+}
+
+func (self *XmppClient) processRosterPush(event *Event) bool {
+	iq, ok := event.Stanza.(*IQ)
+	if !ok || iq.Type != "set" || iq.Roster == nil {
+		return true
+	}
+	// only the server may push roster items (RFC 6121 2.1.6)
+	if iq.From != "" && ToBareJID(iq.From) != ToBareJID(self.jid) {
+		return true
+	}
+	self.subs.updateRoster(iq.Roster)
+	self.Send(&IQ{
+		Id:   iq.Id,
+		To:   iq.From,
+		Type: "result",
+	})
+	return true
+}
+
+func (self *XmppClient) processSubscription(event *Event) bool {
+	presence, ok := event.Stanza.(*Presence)
+	if !ok {
+		return true
+	}
+	jid := ToBareJID(presence.From)
+	switch presence.Type {
+	case "subscribe":
+	case "unsubscribe":
+		self.subs.removePending(jid)
+		return true
+	default:
+		return true
+	}
+
+	self.subs.mutex.Lock()
+	policy := self.subs.policy
+	item, inRoster := self.subs.roster[jid]
+	self.subs.pending[jid] = presence
+	self.subs.mutex.Unlock()
+
+	if policy.Mode == SubscriptionRejectAll {
+		self.DenySubscription(jid)
+		return false
+	}
+	if !policy.accepts(jid) {
+		return true
+	}
+	self.ApproveSubscription(jid)
+	if policy.Mutual {
+		subscribed := inRoster && (item.Subscription == "to" || item.Subscription == "both" || item.Ask == "subscribe")
+		if !subscribed {
+			self.Subscribe(jid)
+		}
+	}
+	return false
+}
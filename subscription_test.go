@@ -0,0 +1,35 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscriptionPolicyAccepts(t *testing.T) {
+	policy := SubscriptionPolicy{Mode: SubscriptionAcceptDomains, Domains: []string{"example.com"}}
+	if !policy.accepts("alice@Example.com/home") {
+		t.Error("allowlisted domain should be accepted")
+	}
+	if policy.accepts("mallory@evil.org") {
+		t.Error("unknown domain should not be accepted")
+	}
+	if (SubscriptionPolicy{}).accepts("alice@example.com") {
+		t.Error("manual mode should not accept")
+	}
+}
+
+func TestPendingSubscriptions(t *testing.T) {
+	xmppClient := NewXmppClient(ClientConfig{false, 1, 10 * time.Second, false, 0})
+	event := &Event{Stanza, &Presence{From: "alice@example.com/home", Type: "subscribe"}, nil, ""}
+	if !xmppClient.processStanza(event) {
+		t.Fatal("manual policy must pass the request to handlers")
+	}
+	pending := xmppClient.PendingSubscriptions()
+	if len(pending) != 1 || pending[0] != "alice@example.com" {
+		t.Fatalf("unexpected pending requests: %v", pending)
+	}
+	xmppClient.processStanza(&Event{Stanza, &Presence{From: "alice@example.com", Type: "unsubscribe"}, nil, ""})
+	if len(xmppClient.PendingSubscriptions()) != 0 {
+		t.Fatal("request withdrawn by the contact is still pending")
+	}
+}
@@ -0,0 +1,230 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// XEP-0363 HTTP File Upload and XEP-0066 Out of Band Data
+
+const (
+	nsUpload = "urn:xmpp:http:upload:0"
+	nsOOB    = "jabber:x:oob"
+)
+
+var ErrNoUploadService = errors.New("No HTTP upload service found")
+
+type UploadRequest struct {
+	XMLName     xml.Name `xml:"urn:xmpp:http:upload:0 request"`
+	Filename    string   `xml:"filename,attr"`
+	Size        string   `xml:"size,attr"`
+	ContentType string   `xml:"content-type,attr,omitempty"`
+}
+
+type UploadSlot struct {
+	XMLName xml.Name  `xml:"urn:xmpp:http:upload:0 slot"`
+	Put     UploadPut `xml:"put"`
+	Get     UploadGet `xml:"get"`
+}
+
+type UploadPut struct {
+	Url     string         `xml:"url,attr"`
+	Headers []UploadHeader `xml:"header"`
+}
+
+type UploadGet struct {
+	Url string `xml:"url,attr"`
+}
+
+type UploadHeader struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+type OOBData struct {
+	XMLName xml.Name `xml:"jabber:x:oob x"`
+	Url     string   `xml:"url"`
+	Desc    string   `xml:"desc,omitempty"`
+}
+
+// the only headers the upload service may ask us to send
+var uploadHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	"Expires":       true,
+}
+
+type uploadState struct {
+	mutex      sync.Mutex
+	service    string
+	maxSize    int64 // 0 if unlimited
+	httpClient *http.Client
+}
+
+// SetHTTPClient sets the client performing the uploads, http.DefaultClient by default.
+func (self *XmppClient) SetHTTPClient(client *http.Client) {
+	self.upload.mutex.Lock()
+	defer self.upload.mutex.Unlock()
+	self.upload.httpClient = client
+}
+
+// SetUploadService sets the upload service instead of discovering it on our server.
+func (self *XmppClient) SetUploadService(jid string, maxSize int64) {
+	self.upload.mutex.Lock()
+	defer self.upload.mutex.Unlock()
+	self.upload.service = jid
+	self.upload.maxSize = maxSize
+}
+
+// UploadService returns the upload service of our server and its maximum
+// file size, 0 if unlimited. The service is discovered once.
+func (self *XmppClient) UploadService() (string, int64, error) {
+	self.upload.mutex.Lock()
+	service, maxSize := self.upload.service, self.upload.maxSize
+	self.upload.mutex.Unlock()
+	if service != "" {
+		return service, maxSize, nil
+	}
+
+	candidates := []string{self.domain}
+	items, err := self.DiscoItems(self.domain, "")
+	if err != nil {
+		return "", 0, err
+	}
+	for _, item := range items.Items {
+		if item.Node == "" {
+			candidates = append(candidates, item.Jid)
+		}
+	}
+	for _, jid := range candidates {
+		info, err := self.DiscoInfo(jid, "")
+		if err != nil || !info.HasFeature(nsUpload) {
+			continue
+		}
+		maxSize = 0
+		for _, form := range info.Forms {
+			if form.FormType() == nsUpload {
+				maxSize, _ = strconv.ParseInt(form.Value("max-file-size"), 10, 64)
+			}
+		}
+		self.SetUploadService(jid, maxSize)
+		return jid, maxSize, nil
+	}
+	return "", 0, ErrNoUploadService
+}
+
+// RequestUploadSlot asks the upload service for the urls to upload a file to.
+func (self *XmppClient) RequestUploadSlot(filename string, size int64, contentType string) (*UploadSlot, error) {
+	service, maxSize, err := self.UploadService()
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && size > maxSize {
+		return nil, fmt.Errorf("File too large: %d bytes, the upload service accepts %d", size, maxSize)
+	}
+	iq := &IQ{
+		To:            service,
+		Type:          "get",
+		UploadRequest: &UploadRequest{Filename: filename, Size: strconv.FormatInt(size, 10), ContentType: contentType},
+	}
+	resp, err := self.sendIQ(iq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.UploadSlot == nil || resp.UploadSlot.Put.Url == "" || resp.UploadSlot.Get.Url == "" {
+		return nil, errors.New("No upload slot from " + service)
+	}
+	return resp.UploadSlot, nil
+}
+
+// Upload uploads size bytes of r and returns the url to download them from.
+func (self *XmppClient) Upload(filename string, size int64, contentType string, r io.Reader) (string, error) {
+	slot, err := self.RequestUploadSlot(filename, size, contentType)
+	if err != nil {
+		return "", err
+	}
+	if err := self.putUpload(slot, size, contentType, r); err != nil {
+		return "", err
+	}
+	return slot.Get.Url, nil
+}
+
+// UploadFile uploads the file at path, the content type is guessed from its extension.
+func (self *XmppClient) UploadFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return self.Upload(filepath.Base(path), stat.Size(), contentType, f)
+}
+
+func (self *XmppClient) putUpload(slot *UploadSlot, size int64, contentType string, r io.Reader) error {
+	req, err := http.NewRequest("PUT", slot.Put.Url, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for _, h := range slot.Put.Headers {
+		name := http.CanonicalHeaderKey(h.Name)
+		if uploadHeaders[name] {
+			req.Header.Set(name, h.Value)
+		}
+	}
+
+	self.upload.mutex.Lock()
+	client := self.upload.httpClient
+	self.upload.mutex.Unlock()
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return errors.New("Upload failed: " + resp.Status)
+	}
+	return nil
+}
+
+// SendURL sends url to jid as an out of band attachment and returns the message id.
+func (self *XmppClient) SendURL(jid, url, desc string) (string, error) {
+	msg := &Message{
+		Id:   RandomString(16),
+		To:   jid,
+		Type: self.messageType(jid),
+		Body: url,
+		OOB:  &OOBData{Url: url, Desc: desc},
+	}
+	return msg.Id, self.Send(msg)
+}
+
+// SendUpload uploads the file at path and sends its url to jid.
+func (self *XmppClient) SendUpload(jid, path string) (string, error) {
+	url, err := self.UploadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return self.SendURL(jid, url, "")
+}
@@ -0,0 +1,111 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpload(t *testing.T) {
+	uploaded := make(map[string][]byte)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Basic c2VjcmV0" || r.Header.Get("X-Evil") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		uploaded[r.URL.Path] = data
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer httpServer.Close()
+
+	server := newTestServer("example.com")
+	server.handle = func(from string, stanza interface{}) []interface{} {
+		iq, ok := stanza.(*IQ)
+		if !ok {
+			return nil
+		}
+		resp := &IQ{Id: iq.Id, To: from, From: iq.To, Type: "result"}
+		switch {
+		case iq.DiscoItems != nil:
+			resp.DiscoItems = &DiscoItemsQuery{Items: []DiscoItem{{Jid: "upload.example.com"}}}
+		case iq.DiscoInfo != nil && iq.To == "upload.example.com":
+			form := NewDataForm(FormTypeResult, nsUpload)
+			form.AddField("max-file-size", "", "", "1024")
+			resp.DiscoInfo = &DiscoInfoQuery{
+				Identities: []DiscoIdentity{{Category: "store", Type: "file"}},
+				Features:   []DiscoFeature{{nsUpload}},
+				Forms:      []*DataForm{form},
+			}
+		case iq.DiscoInfo != nil:
+			resp.DiscoInfo = &DiscoInfoQuery{Features: []DiscoFeature{{nsDiscoInfo}}}
+		case iq.UploadRequest != nil:
+			path := "/files/" + iq.UploadRequest.Filename
+			resp.UploadSlot = &UploadSlot{
+				Put: UploadPut{Url: httpServer.URL + path, Headers: []UploadHeader{
+					{Name: "authorization", Value: "Basic c2VjcmV0"},
+					{Name: "X-Evil", Value: "1"},
+				}},
+				Get: UploadGet{Url: httpServer.URL + path},
+			}
+		}
+		return []interface{}{resp}
+	}
+	alice := server.connect("alice@example.com/bot")
+	defer alice.Disconnect()
+	bob := server.connect("bob@example.com/phone")
+	defer bob.Disconnect()
+	chatHandler := NewChatHandler()
+	bob.AddHandler(chatHandler)
+
+	alice.SetHTTPClient(httpServer.Client())
+	path := filepath.Join(t.TempDir(), "log.txt")
+	if err := os.WriteFile(path, []byte("all good"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.SendUpload("bob@example.com", path); err != nil {
+		t.Fatal(err)
+	}
+	if string(uploaded["/files/log.txt"]) != "all good" {
+		t.Fatalf("unexpected upload %v", uploaded)
+	}
+	event := chatHandler.GetEvent(time.Second)
+	if event == nil {
+		t.Fatal("no message received")
+	}
+	msg := event.Stanza.(*Message)
+	if msg.OOB == nil || msg.OOB.Url != httpServer.URL+"/files/log.txt" || msg.Body != msg.OOB.Url {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	if _, maxSize, _ := alice.UploadService(); maxSize != 1024 {
+		t.Fatalf("max-file-size not discovered: %d", maxSize)
+	}
+	if _, err := alice.RequestUploadSlot("big.bin", 2048, ""); err == nil {
+		t.Fatal("too large file accepted")
+	}
+}
+
+func TestUploadRequestInvalidSize(t *testing.T) {
+	for _, data := range []string{
+		`<iq xmlns="jabber:client" type="get" id="u1"><request xmlns="urn:xmpp:http:upload:0" filename="a.txt" size="big"/></iq>`,
+		`<iq xmlns="jabber:client" type="get" id="u2"><request xmlns="urn:xmpp:http:upload:0" filename="a.txt"/></iq>`,
+	} {
+		iq := &IQ{}
+		if err := xml.Unmarshal([]byte(data), iq); err != nil {
+			t.Fatal(err)
+		}
+		if iq.UploadRequest == nil || iq.UploadRequest.Filename != "a.txt" {
+			t.Fatalf("request not decoded from %s", data)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package xmpp
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// XEP-0054 vcard-temp, XEP-0153 vCard-Based Avatars and XEP-0292 vCard4 Over XMPP
+
+const (
+	nsVCard       = "vcard-temp"
+	nsVCardUpdate = "vcard-temp:x:update"
+	NodeVCard4    = "urn:xmpp:vcard4"
+)
+
+type VCard struct {
+	XMLName  xml.Name     `xml:"vcard-temp vCard"`
+	FN       string       `xml:"FN,omitempty"`
+	N        *VCardName   `xml:"N"`
+	Nickname string       `xml:"NICKNAME,omitempty"`
+	Photo    *VCardPhoto  `xml:"PHOTO"`
+	Bday     string       `xml:"BDAY,omitempty"`
+	Adr      []VCardAdr   `xml:"ADR"`
+	Tel      []VCardTel   `xml:"TEL"`
+	Email    []VCardEmail `xml:"EMAIL"`
+	Jabberid string       `xml:"JABBERID,omitempty"`
+	Title    string       `xml:"TITLE,omitempty"`
+	Role     string       `xml:"ROLE,omitempty"`
+	Org      *VCardOrg    `xml:"ORG"`
+	Url      string       `xml:"URL,omitempty"`
+	Desc     string       `xml:"DESC,omitempty"`
+}
+
+type VCardName struct {
+	Family string `xml:"FAMILY,omitempty"`
+	Given  string `xml:"GIVEN,omitempty"`
+	Middle string `xml:"MIDDLE,omitempty"`
+	Prefix string `xml:"PREFIX,omitempty"`
+	Suffix string `xml:"SUFFIX,omitempty"`
+}
+
+type VCardPhoto struct {
+	Type   string `xml:"TYPE,omitempty"`
+	BinVal string `xml:"BINVAL,omitempty"` // base64
+	ExtVal string `xml:"EXTVAL,omitempty"`
+}
+
+type VCardAdr struct {
+	Home     *struct{} `xml:"HOME"`
+	Work     *struct{} `xml:"WORK"`
+	Street   string    `xml:"STREET,omitempty"`
+	Locality string    `xml:"LOCALITY,omitempty"`
+	Region   string    `xml:"REGION,omitempty"`
+	PCode    string    `xml:"PCODE,omitempty"`
+	Ctry     string    `xml:"CTRY,omitempty"`
+}
+
+type VCardTel struct {
+	Home   *struct{} `xml:"HOME"`
+	Work   *struct{} `xml:"WORK"`
+	Voice  *struct{} `xml:"VOICE"`
+	Cell   *struct{} `xml:"CELL"`
+	Number string    `xml:"NUMBER"`
+}
+
+type VCardEmail struct {
+	Home     *struct{} `xml:"HOME"`
+	Work     *struct{} `xml:"WORK"`
+	Internet *struct{} `xml:"INTERNET"`
+	Pref     *struct{} `xml:"PREF"`
+	UserId   string    `xml:"USERID"`
+}
+
+type VCardOrg struct {
+	OrgName string   `xml:"ORGNAME"`
+	OrgUnit []string `xml:"ORGUNIT,omitempty"`
+}
+
+// SetPhoto sets the embedded photo, nil data removes it.
+func (self *VCard) SetPhoto(mimeType string, data []byte) {
+	if data == nil {
+		self.Photo = nil
+		return
+	}
+	self.Photo = &VCardPhoto{Type: mimeType, BinVal: base64.StdEncoding.EncodeToString(data)}
+}
+
+// PhotoData returns the embedded photo, nil if none.
+func (self *VCard) PhotoData() ([]byte, error) {
+	if self.Photo == nil || self.Photo.BinVal == "" {
+		return nil, nil
+	}
+	// BINVAL is often wrapped in lines
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(self.Photo.BinVal), ""))
+}
+
+// PhotoHash returns the SHA-1 of the embedded photo advertised in presences, "" if none.
+func (self *VCard) PhotoHash() (string, error) {
+	data, err := self.PhotoData()
+	if err != nil || data == nil {
+		return "", err
+	}
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type VCardUpdate struct {
+	XMLName xml.Name `xml:"vcard-temp:x:update x"`
+	Photo   *string  `xml:"photo"` // nil while not ready, "" without avatar
+}
+
+// AvatarHash returns the hash of the vCard avatar advertised by the presence,
+// "" if the contact has no avatar. ok is false if nothing is advertised.
+func (self *Presence) AvatarHash() (hash string, ok bool) {
+	if self.VCardUpdate == nil || self.VCardUpdate.Photo == nil {
+		return "", false
+	}
+	return strings.TrimSpace(*self.VCardUpdate.Photo), true
+}
+
+// vCard4 of XEP-0292, the values are wrapped in an element telling their type.
+type VCard4 struct {
+	XMLName  xml.Name     `xml:"urn:ietf:params:xml:ns:vcard-4.0 vcard"`
+	FN       *VCard4Text  `xml:"fn"`
+	N        *VCard4Name  `xml:"n"`
+	Nickname []VCard4Text `xml:"nickname"`
+	Photo    []VCard4Uri  `xml:"photo"`
+	Bday     *VCard4Date  `xml:"bday"`
+	Email    []VCard4Text `xml:"email"`
+	Tel      []VCard4Uri  `xml:"tel"`
+	Impp     []VCard4Uri  `xml:"impp"`
+	Title    []VCard4Text `xml:"title"`
+	Role     []VCard4Text `xml:"role"`
+	Org      []VCard4Text `xml:"org"`
+	Url      []VCard4Uri  `xml:"url"`
+	Note     []VCard4Text `xml:"note"`
+}
+
+type VCard4Text struct {
+	Text string `xml:"text"`
+}
+
+type VCard4Uri struct {
+	Uri string `xml:"uri"`
+}
+
+type VCard4Date struct {
+	Date string `xml:"date"`
+}
+
+type VCard4Name struct {
+	Surname    string `xml:"surname,omitempty"`
+	Given      string `xml:"given,omitempty"`
+	Additional string `xml:"additional,omitempty"`
+	Prefix     string `xml:"prefix,omitempty"`
+	Suffix     string `xml:"suffix,omitempty"`
+}
+
+type vcardState struct {
+	mutex     sync.Mutex
+	known     bool
+	photoHash string
+}
+
+// VCard retrieves the vCard of the bare jid, ours if jid is empty.
+// Retrieving ours advertises its avatar hash in our presences.
+func (self *XmppClient) VCard(jid string) (*VCard, error) {
+	resp, err := self.sendIQ(&IQ{To: ToBareJID(jid), Type: "get", VCard: &VCard{}})
+	if err != nil {
+		// no vCard yet
+		if xmppErr, ok := err.(*Error); !ok || xmppErr.Condition() != "item-not-found" {
+			return nil, err
+		}
+	}
+	vcard := &VCard{}
+	if err == nil && resp.VCard != nil {
+		vcard = resp.VCard
+	}
+	if jid == "" && self.setPhotoHash(vcard) {
+		self.resendPresence()
+	}
+	return vcard, nil
+}
+
+// fetchVCard retrieves our vCard after connecting, unless it's already known.
+func (self *XmppClient) fetchVCard() {
+	self.vcard.mutex.Lock()
+	known := self.vcard.known
+	self.vcard.mutex.Unlock()
+	if !known {
+		self.VCard("")
+	}
+}
+
+// SetVCard replaces our vCard and advertises its avatar.
+func (self *XmppClient) SetVCard(vcard *VCard) error {
+	if _, err := self.sendIQ(&IQ{Type: "set", VCard: vcard}); err != nil {
+		return err
+	}
+	if self.setPhotoHash(vcard) {
+		self.resendPresence()
+	}
+	return nil
+}
+
+// setPhotoHash remembers the avatar hash of our vCard, it returns true if it changed.
+func (self *XmppClient) setPhotoHash(vcard *VCard) bool {
+	hash, err := vcard.PhotoHash()
+	if err != nil {
+		return false
+	}
+	self.vcard.mutex.Lock()
+	defer self.vcard.mutex.Unlock()
+	changed := !self.vcard.known || self.vcard.photoHash != hash
+	self.vcard.known = true
+	self.vcard.photoHash = hash
+	return changed
+}
+
+// decorateVCardUpdate advertises our avatar hash in our available presences,
+// an empty update while our vCard isn't known.
+func (self *XmppClient) decorateVCardUpdate(stanza interface{}) {
+	presence, ok := stanza.(*Presence)
+	if !ok || presence.Type != "" || presence.VCardUpdate != nil {
+		return
+	}
+	self.vcard.mutex.Lock()
+	defer self.vcard.mutex.Unlock()
+	presence.VCardUpdate = &VCardUpdate{}
+	if self.vcard.known {
+		hash := self.vcard.photoHash
+		presence.VCardUpdate.Photo = &hash
+	}
+}
+
+// VCard4 retrieves the vCard4 published by the account jid.
+func (self *XmppClient) VCard4(jid string) (*VCard4, error) {
+	items, err := self.PEPItems(jid, NodeVCard4, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, errors.New("No vCard4 published by " + jid)
+	}
+	vcard := &VCard4{}
+	if err := items[0].Decode(vcard); err != nil {
+		return nil, err
+	}
+	return vcard, nil
+}
+
+// PublishVCard4 publishes our vCard4.
+func (self *XmppClient) PublishVCard4(vcard *VCard4) error {
+	return self.publishPEP(NodeVCard4, vcard)
+}
@@ -0,0 +1,119 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestVCard(t *testing.T) {
+	data := `<vCard xmlns="vcard-temp">
+    <FN>Peter Saint-Andre</FN>
+    <N><FAMILY>Saint-Andre</FAMILY><GIVEN>Peter</GIVEN></N>
+    <ORG><ORGNAME>XMPP Standards Foundation</ORGNAME></ORG>
+    <EMAIL><INTERNET/><PREF/><USERID>stpeter@jabber.org</USERID></EMAIL>
+    <PHOTO><TYPE>image/png</TYPE><BINVAL>
+aGVs
+bG8=
+</BINVAL></PHOTO>
+  </vCard>`
+	vcard := &VCard{}
+	if err := xml.Unmarshal([]byte(data), vcard); err != nil {
+		t.Fatal(err)
+	}
+	if vcard.FN != "Peter Saint-Andre" || vcard.N.Given != "Peter" || vcard.Org.OrgName != "XMPP Standards Foundation" ||
+		len(vcard.Email) != 1 || vcard.Email[0].Pref == nil || vcard.Email[0].UserId != "stpeter@jabber.org" {
+		t.Fatalf("unexpected vCard %+v", vcard)
+	}
+	photo, err := vcard.PhotoData()
+	if err != nil || string(photo) != "hello" {
+		t.Fatalf("photo %q, %v", photo, err)
+	}
+	if hash, _ := vcard.PhotoHash(); hash != "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d" {
+		t.Fatalf("unexpected photo hash %s", hash)
+	}
+}
+
+func TestVCardUpdate(t *testing.T) {
+	xmppClient := NewXmppClient(ClientConfig{})
+	presence := &Presence{}
+	xmppClient.decorateVCardUpdate(presence)
+	if _, ok := presence.AvatarHash(); ok || presence.VCardUpdate == nil {
+		t.Fatal("expected an empty update before our vCard is known")
+	}
+	presence = &Presence{}
+
+	vcard := &VCard{}
+	if !xmppClient.setPhotoHash(vcard) {
+		t.Fatal("vCard not known")
+	}
+	xmppClient.decorateVCardUpdate(presence)
+	if hash, ok := presence.AvatarHash(); !ok || hash != "" {
+		t.Fatal("no avatar not advertised")
+	}
+
+	vcard.SetPhoto("image/png", []byte("hello"))
+	if !xmppClient.setPhotoHash(vcard) {
+		t.Fatal("photo change not detected")
+	}
+	presence = &Presence{}
+	xmppClient.decorateVCardUpdate(presence)
+	data, _ := xml.Marshal(presence)
+	parsed := &Presence{}
+	xml.Unmarshal(data, parsed)
+	if hash, ok := parsed.AvatarHash(); !ok || hash != "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d" {
+		t.Fatalf("avatar hash not advertised in %s", data)
+	}
+}
+
+func TestVCard4(t *testing.T) {
+	data := `<vcard xmlns="urn:ietf:params:xml:ns:vcard-4.0">
+  <fn><text>Peter Saint-Andre</text></fn>
+  <n><surname>Saint-Andre</surname><given>Peter</given></n>
+  <nickname><text>stpeter</text></nickname>
+  <impp><uri>xmpp:stpeter@jabber.org</uri></impp>
+</vcard>`
+	vcard := &VCard4{}
+	if err := xml.Unmarshal([]byte(data), vcard); err != nil {
+		t.Fatal(err)
+	}
+	if vcard.FN.Text != "Peter Saint-Andre" || vcard.N.Surname != "Saint-Andre" ||
+		vcard.Nickname[0].Text != "stpeter" || vcard.Impp[0].Uri != "xmpp:stpeter@jabber.org" {
+		t.Fatalf("unexpected vCard4 %+v", vcard)
+	}
+}
+
+func TestVCardFetchedAfterConnect(t *testing.T) {
+	server := newTestServer("example.com")
+	presences := make(chan *Presence, 4)
+	server.handle = func(from string, stanza interface{}) []interface{} {
+		switch stanza := stanza.(type) {
+		case *Presence:
+			presences <- stanza
+		case *IQ:
+			if stanza.VCard != nil && stanza.Type == "get" {
+				vcard := &VCard{}
+				vcard.SetPhoto("image/png", []byte("hello"))
+				return []interface{}{&IQ{Id: stanza.Id, To: from, Type: "result", VCard: vcard}}
+			}
+		}
+		return nil
+	}
+	alice := server.connect("alice@example.com/a")
+	defer alice.Disconnect()
+
+	alice.Send(&Presence{})
+	first := <-presences
+	if _, ok := first.AvatarHash(); ok || first.VCardUpdate == nil {
+		t.Fatal("expected an empty update before our vCard is known")
+	}
+	alice.fetchVCard()
+	select {
+	case presence := <-presences:
+		if hash, ok := presence.AvatarHash(); !ok || hash != "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d" {
+			t.Fatalf("avatar hash not advertised: %+v", presence.VCardUpdate)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("presence not sent again after fetching our vCard")
+	}
+}
@@ -34,6 +34,7 @@ const (
 	nsBind    = "urn:ietf:params:xml:ns:xmpp-bind"
 	nsSession = "urn:ietf:params:xml:ns:xmpp-session"
 	nsClient  = "jabber:client"
+	nsStanzas = "urn:ietf:params:xml:ns:xmpp-stanzas"
 )
 
 var DefaultConfig tls.Config
@@ -49,6 +50,19 @@ type Client struct {
 // If host is not specified, the  DNS SRV should be used to find the host from the domainpart of the JID.
 // Default the port to 5222.
 func NewClient(host, user, passwd string) (*Client, error) {
+	client, err := dial(host, user)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.init(user, passwd); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// dial connects to host as NewClient, through the HTTP proxy of the environment if set.
+func dial(host, user string) (*Client, error) {
 	addr := host
 
 	if strings.TrimSpace(host) == "" {
@@ -98,10 +112,6 @@ func NewClient(host, user, passwd string) (*Client, error) {
 
 	client := new(Client)
 	client.conn = c
-	if err := client.init(user, passwd); err != nil {
-		client.Close()
-		return nil, err
-	}
 	return client, nil
 }
 
@@ -110,30 +120,17 @@ func (c *Client) Close() error {
 }
 
 func (c *Client) init(user, passwd string) error {
-	c.p = xml.NewDecoder(c.conn)
-
 	a := strings.SplitN(user, "@", 2)
 	if len(a) != 2 {
 		return errors.New("xmpp: invalid username (want user@domain): " + user)
 	}
 	user = a[0]
-	c.domain = a[1]
 
-	features, streamErr := c.openStreamAndGetFeatures()
+	features, streamErr := c.startStream(a[1])
 	if streamErr != nil {
 		return streamErr
 	}
 
-	if features.StartTLS != nil {
-		if tlsErr := c.startTls(); tlsErr != nil {
-			return tlsErr
-		}
-		features, streamErr = c.openStreamAndGetFeatures()
-		if streamErr != nil {
-			return streamErr
-		}
-	}
-
 	if authErr := c.authenticate(features, user, passwd); authErr != nil {
 		return authErr
 	}
@@ -359,6 +356,28 @@ func cnonce() string {
 	return fmt.Sprintf("%016x", cn)
 }
 
+// startStream opens the stream to domain and negotiates TLS if offered.
+func (c *Client) startStream(domain string) (*streamFeatures, error) {
+	c.p = xml.NewDecoder(c.conn)
+	c.domain = domain
+
+	features, streamErr := c.openStreamAndGetFeatures()
+	if streamErr != nil {
+		return nil, streamErr
+	}
+
+	if features.StartTLS != nil {
+		if tlsErr := c.startTls(); tlsErr != nil {
+			return nil, tlsErr
+		}
+		features, streamErr = c.openStreamAndGetFeatures()
+		if streamErr != nil {
+			return nil, streamErr
+		}
+	}
+	return features, nil
+}
+
 func (c *Client) openStreamAndGetFeatures() (*streamFeatures, error) {
 	// Declare intent to be a xmpp client.
 	openStream := fmt.Sprintf("<?xml version='1.0'?><stream:stream to='%s' xmlns='%s' xmlns:stream='%s' version='1.0'>",
@@ -455,6 +474,7 @@ type streamFeatures struct {
 	Mechanisms saslMechanisms
 	Bind       *bindBind
 	Session    *bindSession
+	Register   *registerFeature
 }
 
 type streamError struct {
@@ -533,6 +553,45 @@ type Message struct {
 	Subject string `xml:"subject,omitempty"`
 	Body    string `xml:"body,omitempty"`
 	Thread  string `xml:"thread,omitempty"`
+	Error   *Error
+	MUCUser *MUCUser
+	Form    *DataForm
+
+	CarbonReceived *CarbonReceived
+	CarbonSent     *CarbonSent
+	CarbonPrivate  *CarbonPrivate
+	MAMResult      *MAMResult
+
+	ReceiptRequest  *ReceiptRequest
+	ReceiptReceived *ReceiptReceived
+
+	StateActive    *ChatStateNotification `xml:"http://jabber.org/protocol/chatstates active"`
+	StateComposing *ChatStateNotification `xml:"http://jabber.org/protocol/chatstates composing"`
+	StatePaused    *ChatStateNotification `xml:"http://jabber.org/protocol/chatstates paused"`
+	StateInactive  *ChatStateNotification `xml:"http://jabber.org/protocol/chatstates inactive"`
+	StateGone      *ChatStateNotification `xml:"http://jabber.org/protocol/chatstates gone"`
+
+	Delay       *Delay
+	LegacyDelay *LegacyDelay
+
+	Replace   *Replace
+	Retract   *Retract
+	Fallbacks []*Fallback `xml:"urn:xmpp:fallback:0 fallback"`
+	StoreHint *StoreHint
+	NoStore   *NoStoreHint
+
+	OriginId  *OriginId
+	StanzaIds []StanzaId `xml:"urn:xmpp:sid:0 stanza-id"`
+	Reactions *Reactions
+	Reply     *Reply
+	OOB       *OOBData
+
+	PubSubEvent *PubSubEvent
+	// "received" or "sent" if the message was unwrapped from a carbon copy
+	Carbon string `xml:"-"`
+	// set on the corrections and retractions of messages we haven't received,
+	// their sender couldn't be checked
+	Unverified bool `xml:"-"`
 }
 
 type clientText struct {
@@ -552,18 +611,53 @@ type Presence struct {
 	Status   string `xml:"status,omitempty"` // sb []clientText
 	Priority string `xml:"priority,omitempty"`
 	Error    *Error
+	MUC      *MUCJoin
+	MUCUser  *MUCUser
+	Caps     *Caps
+
+	Delay       *Delay
+	LegacyDelay *LegacyDelay
+	VCardUpdate *VCardUpdate
 }
 
 type IQ struct { // info/query
-	XMLName xml.Name `xml:"jabber:client iq"`
-	From    string   `xml:"from,attr,omitempty"`
-	Id      string   `xml:"id,attr,omitempty"`
-	To      string   `xml:"to,attr,omitempty"`
-	Type    string   `xml:"type,attr,omitempty"` // error, get, result, set
-	Error   *Error
-	Bind    *bindBind
-	Roster  *IQRoster
-	Ping    *Ping
+	XMLName  xml.Name `xml:"jabber:client iq"`
+	From     string   `xml:"from,attr,omitempty"`
+	Id       string   `xml:"id,attr,omitempty"`
+	To       string   `xml:"to,attr,omitempty"`
+	Type     string   `xml:"type,attr,omitempty"` // error, get, result, set
+	Error    *Error
+	Bind     *bindBind
+	Roster   *IQRoster
+	Ping     *Ping
+	MUCAdmin *MUCAdminQuery
+	MUCOwner *MUCOwnerQuery
+
+	DiscoInfo  *DiscoInfoQuery
+	DiscoItems *DiscoItemsQuery
+
+	CarbonEnable  *CarbonEnable
+	CarbonDisable *CarbonDisable
+	MAMQuery      *MAMQuery
+	MAMFin        *MAMFin
+
+	UploadRequest *UploadRequest
+	UploadSlot    *UploadSlot
+
+	IBBOpen  *IBBOpen
+	IBBData  *IBBData
+	IBBClose *IBBClose
+	S5BQuery *S5BQuery
+	Jingle   *Jingle
+
+	PubSub      *PubSub
+	PubSubOwner *PubSubOwner
+	VCard       *VCard
+	Register    *RegisterQuery
+	BlockList   *BlockList
+	Block       *Block
+	Unblock     *Unblock
+	Command     *Command
 }
 
 type IQRoster struct {
@@ -586,10 +680,59 @@ type Ping struct {
 
 type Error struct {
 	XMLName xml.Name `xml:"jabber:client error"`
-	Code    string   `xml:",attr"`
-	Type    string   `xml:",attr"`
-	Any     xml.Name
-	Text    string
+	Code    string   `xml:"code,attr,omitempty"`
+	Type    string   `xml:"type,attr,omitempty"` // auth, cancel, continue, modify, wait
+	Any     xml.Name `xml:",any"`                // defined condition, e.g. conflict, item-not-found
+	Text    string   `xml:"urn:ietf:params:xml:ns:xmpp-stanzas text,omitempty"`
+}
+
+// Condition returns the defined condition of the error, e.g. "conflict".
+func (self *Error) Condition() string {
+	return self.Any.Local
+}
+
+func (self *Error) Error() string {
+	msg := "xmpp: " + self.Type + " error"
+	if self.Any.Local != "" {
+		msg += ": " + self.Any.Local
+	}
+	if self.Text != "" {
+		msg += " (" + self.Text + ")"
+	}
+	return msg
+}
+
+// MarshalXML writes the condition as an element of the stanzas namespace.
+func (self *Error) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Space: nsClient, Local: "error"}}
+	if self.Code != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "code"}, Value: self.Code})
+	}
+	if self.Type != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "type"}, Value: self.Type})
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	if self.Any.Local != "" {
+		cond := xml.StartElement{Name: xml.Name{Space: self.Any.Space, Local: self.Any.Local}}
+		if cond.Name.Space == "" {
+			cond.Name.Space = nsStanzas
+		}
+		if err := e.EncodeToken(cond); err != nil {
+			return err
+		}
+		if err := e.EncodeToken(cond.End()); err != nil {
+			return err
+		}
+	}
+	if self.Text != "" {
+		text := xml.StartElement{Name: xml.Name{Space: nsStanzas, Local: "text"}}
+		if err := e.EncodeElement(self.Text, text); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
 }
 
 // Scan XML token stream to find next StartElement.
@@ -1,6 +1,7 @@
 package xmpp
 
 import (
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"strings"
@@ -11,8 +12,12 @@ import (
 type EventType int
 
 const (
-	Connection = EventType(0)
-	Stanza     = EventType(1)
+	Connection   = EventType(0)
+	Stanza       = EventType(1)
+	Receipt      = EventType(2) // Event.Stanza is a *ReceiptReport
+	Bytestream   = EventType(3) // Event.Stanza is the net.Conn of an incoming bytestream
+	Notification = EventType(4) // Event.Stanza is a *PubSubNotification
+	Avatar       = EventType(5) // Event.Stanza is an *AvatarUpdate
 )
 
 type Event struct {
@@ -41,17 +46,80 @@ type XmppClient struct {
 	stopPingCh chan int
 	mutex      sync.Mutex
 	handlers   []Handler
+	processors []stanzaProcessor
+	subs       subscriptionState
+	muc        mucState
+	disco      discoState
+	caps       capsState
+	decorators []stanzaDecorator
+	carbons    bool
+	receipts   ReceiptTracker
+	chatStates ChatStateManager
+	senders    messageSenders
+	upload     uploadState
+	ibb        ibbState
+	s5b        s5bState
+	jingle     jingleState
+	vcard      vcardState
+	avatar     avatarState
+	blocking   blockingState
+	commands   commandState
 }
 
+// stanzaProcessor inspects an incoming stanza before it is passed to the handlers.
+// It returns false if the stanza has been consumed and must not reach the handlers.
+type stanzaProcessor func(event *Event) bool
+
+// stanzaDecorator adds extensions to an outgoing stanza.
+type stanzaDecorator func(stanza interface{})
+
 func NewXmppClient(conf ClientConfig) *XmppClient {
 	xmppClient := new(XmppClient)
 	xmppClient.config = conf
+	xmppClient.subs.init()
+	xmppClient.muc.init()
+	xmppClient.disco.init()
+	xmppClient.caps.init()
+	xmppClient.receipts.init(xmppClient)
+	xmppClient.chatStates.init(xmppClient)
+	xmppClient.senders.init()
+	xmppClient.ibb.init()
+	xmppClient.s5b.init()
+	xmppClient.jingle.init()
+	xmppClient.avatar.init()
+	xmppClient.commands.init()
+	xmppClient.disco.features = append(xmppClient.disco.features, nsReceipts, nsCorrect, nsRetract,
+		nsSid, nsReactions, nsReply, nsOOB, nsIBB, nsBytestreams)
+	xmppClient.processors = []stanzaProcessor{
+		xmppClient.processRosterPush,
+		xmppClient.processCarbons,
+		xmppClient.processBlocking,
+		xmppClient.processStanzaIds,
+		xmppClient.processCorrections,
+		xmppClient.processSubscription,
+		xmppClient.processMUC,
+		xmppClient.processDisco,
+		xmppClient.processIBB,
+		xmppClient.processS5B,
+		xmppClient.processJingle,
+		xmppClient.processCommands,
+		xmppClient.processCaps,
+		xmppClient.processReceipts,
+		xmppClient.processChatStates,
+		xmppClient.processAvatar,
+		xmppClient.processPubSub,
+	}
+	xmppClient.decorators = []stanzaDecorator{
+		xmppClient.decorateCaps,
+		xmppClient.decorateOriginId,
+		xmppClient.decorateVCardUpdate,
+	}
 
 	return xmppClient
 }
 
 func (self *XmppClient) Connect(host, jid, password string) error {
-	if self.connected {
+	if self.isConnected() {
 		return errors.New("It's already connected!")
 	}
 
@@ -82,20 +150,33 @@ func (self *XmppClient) Connect(host, jid, password string) error {
 	self.password = password
 	self.domain, _ = GetDomain(jid)
 
+	self.setConnected(true)
 	go self.startReadMessage()
 	if self.config.PingEnable {
 		go self.startPing()
 	}
+	go self.fetchVCard()
 
-	self.connected = true
 	if reconnectTimes > 0 {
 		reconnectTimes = 0
 	}
 	return nil
 }
 
+func (self *XmppClient) isConnected() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.connected
+}
+
+func (self *XmppClient) setConnected(connected bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.connected = connected
+}
+
 func (self *XmppClient) Disconnect() error {
-	self.connected = false
+	self.setConnected(false)
 	if self.config.PingEnable {
 		self.stopPingCh <- 1
 	}
@@ -103,18 +184,41 @@ func (self *XmppClient) Disconnect() error {
 }
 
 func (self *XmppClient) Send(msg interface{}) error {
-	if !self.connected {
+	if !self.isConnected() {
 		return errors.New("Connection is not connected now!")
 	}
+	for _, d := range self.decorators {
+		d(msg)
+	}
 	return self.client.Send(msg)
 }
 
-func (self *XmppClient) SendChatMessage(jid, content string) {
+// SendChatMessage sends a chat message and returns its generated id.
+// If receipts are requested, the id is tracked by Receipts().
+func (self *XmppClient) SendChatMessage(jid, content string) (string, error) {
+	return self.sendChatMessage(jid, content, "")
+}
+
+// sendChatMessage sends a chat message carrying the chat state if not empty.
+func (self *XmppClient) sendChatMessage(jid, content, state string) (string, error) {
 	msg := &Message{}
+	msg.Id = RandomString(16)
 	msg.To = jid
 	msg.Type = "chat"
 	msg.Body = content
-	self.Send(msg)
+	msg.SetChatState(state)
+	self.receipts.mutex.Lock()
+	request := self.receipts.request
+	self.receipts.mutex.Unlock()
+	if request {
+		msg.ReceiptRequest = &ReceiptRequest{}
+		self.receipts.track(msg.Id, jid)
+	}
+	err := self.Send(msg)
+	if err != nil && request {
+		self.receipts.untrack(msg.Id)
+	}
+	return msg.Id, err
 }
 
 func (self *XmppClient) SendPresenceStatus(status string) {
@@ -141,23 +245,85 @@ func (self *XmppClient) RequestRoster() (*IQRoster, error) {
 	if event != nil {
 		iqResp := event.Stanza.(*IQ)
 		if iqResp.Type == "result" {
+			self.subs.setRoster(iqResp.Roster)
 			return iqResp.Roster, nil
 		}
 	}
 	return nil, errors.New("No roster response from server!")
 }
 
+// sendIQ sends iq and waits for the response with the same id.
+// If the response is an error, it is returned together with its *Error.
+func (self *XmppClient) sendIQ(iq *IQ) (*IQ, error) {
+	return self.sendIQUntil(iq, time.After(10*time.Second), nil)
+}
+
+// sendIQUntil sends iq and waits for its response until timeout or stop fire,
+// a nil channel never does.
+func (self *XmppClient) sendIQUntil(iq *IQ, timeout <-chan time.Time, stop <-chan struct{}) (*IQ, error) {
+	if iq.Id == "" {
+		iq.Id = RandomString(10)
+	}
+	iqHandler := NewIqIDHandler(iq.Id)
+	self.AddHandler(iqHandler)
+	if sendErr := self.Send(iq); sendErr != nil {
+		self.RemoveHandler(iqHandler)
+		return nil, sendErr
+	}
+	var event *Event
+	select {
+	case event = <-iqHandler.GetEventCh():
+	case <-timeout:
+	case <-stop:
+	}
+	if event == nil {
+		self.RemoveHandler(iqHandler)
+		return nil, errors.New("No response of iq " + iq.Id)
+	}
+	iqResp := event.Stanza.(*IQ)
+	if iqResp.Type == "error" {
+		if iqResp.Error != nil {
+			return iqResp, iqResp.Error
+		}
+		return iqResp, errors.New("xmpp: error response of iq " + iq.Id)
+	}
+	return iqResp, nil
+}
+
+// replyIQError answers the request iq with an error of the stanzas namespace.
+func (self *XmppClient) replyIQError(iq *IQ, errType, condition string) error {
+	resp := &IQ{
+		Id:    iq.Id,
+		To:    iq.From,
+		Type:  "error",
+		Error: &Error{Type: errType, Any: xml.Name{Space: nsStanzas, Local: condition}},
+	}
+	return self.Send(resp)
+}
+
 func (self *XmppClient) startReadMessage() {
-	for self.connected {
+	for self.isConnected() {
 		stanza, err := self.client.Recv()
 		if err != nil {
-			if self.connected {
+			if self.isConnected() {
 				self.fireHandler(&Event{Connection, nil, err, "receive stanza error"})
 			}
 			break
 		}
-		self.fireHandler(&Event{Stanza, stanza, nil, ""})
+		event := &Event{Stanza, stanza, nil, ""}
+		if self.processStanza(event) {
+			self.fireHandler(event)
+		}
+	}
+}
+
+func (self *XmppClient) processStanza(event *Event) bool {
+	for _, p := range self.processors {
+		if !p(event) {
+			return false
+		}
 	}
+	return true
 }
 
 func (self *XmppClient) startPing() {
@@ -233,14 +399,17 @@ func (self *XmppClient) RemoveHandlerByIndex(i int) {
 }
 
 func (self *XmppClient) fireHandler(event *Event) {
+	self.mutex.Lock()
 	copyHandlers := make([]Handler, len(self.handlers))
 	copy(copyHandlers, self.handlers)
+	self.mutex.Unlock()
 	for i := len(copyHandlers) - 1; i >= 0; i-- {
 		h := copyHandlers[i]
 		if h.Filter(event) {
 			h.GetEventCh() <- event
 			if h.IsOneTime() {
-				self.RemoveHandlerByIndex(i)
+				// handlers may have changed while dispatching, so don't remove by index
+				self.RemoveHandler(h)
 			}
 		}
 	}
@@ -286,4 +455,12 @@ func (self *XmppClient) handlePingError(err error) {
 	//make sure will receive roster and subscribe message
 	self.RequestRoster()
 	self.Send(&Presence{})
+	self.mutex.Lock()
+	carbons := self.carbons
+	self.mutex.Unlock()
+	if carbons {
+		self.EnableCarbons()
+	}
+	self.refreshBlockList()
+	self.rejoinRooms()
 }